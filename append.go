@@ -0,0 +1,287 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// AppendOptions contains options for Append.
+type AppendOptions struct {
+	// Perm is the permission bits used if the file needs to be created.
+	// Defaults to 0600.
+	Perm os.FileMode
+	// Lock, if not nil, enables locking the file while appending.
+	Lock *LockOptions
+	// Compression is the compression method used if the file is empty. The
+	// compression method of an existing file is detected from its magic
+	// bytes.
+	Compression Compression
+}
+
+// Appender appends messages to an mbox file. Messages are written with the
+// embedded Writer. The Close method must be called to commit them.
+type Appender struct {
+	*Writer
+
+	f     *os.File
+	lock  *Lock
+	bw    *bufio.Writer
+	zw    io.WriteCloser
+	size  int64
+	ended bool
+}
+
+// Append opens the mbox file at name for appending messages, creating it if it
+// doesn't exist. If the file doesn't end with a blank line, the missing
+// newlines are added before the first message.
+//
+// Compressed files are appended to by adding a new compressed stream, e.g. a
+// gzip member, after the existing ones. To find out how a compressed file
+// ends, only its last compressed stream is decompressed: appending to a file
+// compressed at once, rather than built by Append, decompresses it entirely.
+//
+// If writing fails, the file is truncated back to its original size when the
+// Appender is closed, so that it never contains a partial message.
+func Append(name string, options *AppendOptions) (*Appender, error) {
+	if options == nil {
+		options = new(AppendOptions)
+	}
+	perm := options.Perm
+	if perm == 0 {
+		perm = 0600
+	}
+
+	const flag = os.O_RDWR | os.O_APPEND | os.O_CREATE
+	var (
+		f    *os.File
+		lock *Lock
+		err  error
+	)
+	if options.Lock != nil {
+		f, lock, err = openLocked(name, flag, perm, true, options.Lock)
+	} else {
+		f, err = os.OpenFile(name, flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := newAppender(f, options.Compression)
+	if err != nil {
+		if lock != nil {
+			lock.Unlock()
+		}
+		f.Close()
+		return nil, err
+	}
+	a.lock = lock
+	return a, nil
+}
+
+func newAppender(f *os.File, c Compression) (*Appender, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Appender{f: f, size: fi.Size()}
+	a.bw = bufio.NewWriter(f)
+
+	var w io.Writer = a.bw
+	missing := 0
+	if a.size > 0 {
+		b := make([]byte, compressionMagicLen)
+		n, err := f.ReadAt(b, 0)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		c = DetectCompression(b[:n])
+		if c == CompressionNone {
+			missing, err = missingNewlines(f, a.size)
+		} else {
+			missing, err = missingNewlinesCompressed(f, a.size, c)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c != CompressionNone {
+		if a.zw, err = newCompressor(c, a.bw); err != nil {
+			return nil, err
+		}
+		w = a.zw
+	}
+	for i := 0; i < missing; i++ {
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return nil, err
+		}
+	}
+
+	a.Writer = NewWriter(w)
+	return a, nil
+}
+
+// missingNewlines returns the number of newlines that need to be appended to
+// an mbox file of the given size so that it ends with a blank line.
+func missingNewlines(r io.ReaderAt, size int64) (int, error) {
+	if size == 0 {
+		return 0, nil
+	}
+
+	var buf [4]byte
+	b := buf[:]
+	if size < int64(len(b)) {
+		b = b[:size]
+	}
+	if _, err := r.ReadAt(b, size-int64(len(b))); err != nil {
+		return 0, err
+	}
+
+	missing := 2
+	for missing > 0 && len(b) > 0 && b[len(b)-1] == '\n' {
+		b = b[:len(b)-1]
+		if len(b) > 0 && b[len(b)-1] == '\r' {
+			b = b[:len(b)-1]
+		}
+		missing--
+	}
+	return missing, nil
+}
+
+// missingNewlinesCompressed is like missingNewlines for a compressed file. The
+// file is searched backwards for the beginning of its last compressed stream,
+// i.e. the last offset from which it decompresses without error, so that only
+// the last stream needs to be decompressed.
+func missingNewlinesCompressed(r io.ReaderAt, size int64, c Compression) (int, error) {
+	var magic []byte
+	for _, m := range compressionMagics {
+		if m.c == c {
+			magic = m.magic
+		}
+	}
+
+	var buf [32 * 1024]byte
+	for end := size; end > 0; {
+		start := end - int64(len(buf)-len(magic)+1)
+		if start < 0 {
+			start = 0
+		}
+		// Chunks overlap so that magic bytes across chunk boundaries are found
+		stop := end + int64(len(magic)-1)
+		if stop > size {
+			stop = size
+		}
+		b := buf[:stop-start]
+		if _, err := r.ReadAt(b, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		for {
+			i := bytes.LastIndex(b, magic)
+			if i < 0 {
+				break
+			}
+			b = b[:i+len(magic)-1]
+
+			off := start + int64(i)
+			tail, err := decompressedTail(r, off, size, c)
+			if err == nil {
+				return missingNewlines(bytes.NewReader(tail), int64(len(tail)))
+			} else if off == 0 {
+				return 0, err
+			}
+		}
+		end = start
+	}
+	return 0, errors.New("mbox: compressed stream not found")
+}
+
+// decompressedTail decompresses the file from off up to size, and returns the
+// last bytes of the decompressed data.
+func decompressedTail(r io.ReaderAt, off, size int64, c Compression) ([]byte, error) {
+	zr, err := newDecompressor(c, io.NewSectionReader(r, off, size-off))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var buf [4 * 1024]byte
+	var tail []byte
+	for {
+		n, err := zr.Read(buf[:])
+		if n > 0 {
+			tail = append(tail, buf[:n]...)
+			if len(tail) > 4 {
+				tail = append(tail[:0], tail[len(tail)-4:]...)
+			}
+		}
+		if err == io.EOF {
+			return tail, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close finishes the last message and commits the appended messages to disk.
+// If any write failed, the file is truncated back to its original size and
+// the write error is returned.
+func (a *Appender) Close() error {
+	if a.ended {
+		return errors.New("mbox: Appender already closed")
+	}
+
+	err := a.Writer.Close()
+	if a.zw != nil {
+		if zErr := a.zw.Close(); err == nil {
+			err = zErr
+		}
+	}
+	if flushErr := a.bw.Flush(); err == nil {
+		err = flushErr
+	}
+	if err == nil {
+		err = a.f.Sync()
+	}
+	if err != nil {
+		a.Abort()
+		return err
+	}
+
+	a.ended = true
+	return a.close()
+}
+
+// close releases the lock, if any, and closes the file.
+func (a *Appender) close() error {
+	var err error
+	if a.lock != nil {
+		err = a.lock.Unlock()
+	}
+	if closeErr := a.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Abort discards the appended messages: the file is truncated back to its
+// original size and closed.
+func (a *Appender) Abort() error {
+	if a.ended {
+		return errors.New("mbox: Appender already closed")
+	}
+	a.ended = true
+	a.Writer.closed = true
+
+	err := a.f.Truncate(a.size)
+	if syncErr := a.f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := a.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
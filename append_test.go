@@ -0,0 +1,105 @@
+package mbox
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAppend(t *testing.T, initial string) string {
+	dir, err := ioutil.TempDir("", "mbox-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "mbox")
+	if initial != "" {
+		if err := ioutil.WriteFile(name, []byte(initial), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := Append(name, nil)
+	if err != nil {
+		t.Fatalf("Append() = %v", err)
+	}
+	date := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+	if err := a.WriteMessage("herp.derp@example.com", date, strings.NewReader("Subject: Appended\n\nHi.\n")); err != nil {
+		t.Fatalf("WriteMessage() = %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestAppend(t *testing.T) {
+	const appended = "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: Appended\n\nHi.\n\n"
+	const existing = "From derp.herp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: Existing\n\nBye."
+
+	tests := []struct {
+		initial, want string
+	}{
+		{"", appended},
+		{existing, existing + "\n\n" + appended},
+		{existing + "\n", existing + "\n\n" + appended},
+		{existing + "\n\n", existing + "\n\n" + appended},
+		{existing + "\r\n\r\n", existing + "\r\n\r\n" + appended},
+	}
+
+	for _, test := range tests {
+		if got := testAppend(t, test.initial); got != test.want {
+			t.Errorf("Appending to %q:\n%q\nexpected:\n%q", test.initial, got, test.want)
+		}
+	}
+}
+
+func TestAppender_Abort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const existing = "From derp.herp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: Existing\n\nBye."
+	name := filepath.Join(dir, "mbox")
+	if err := ioutil.WriteFile(name, []byte(existing), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := Append(name, nil)
+	if err != nil {
+		t.Fatalf("Append() = %v", err)
+	}
+	mw, err := a.CreateMessage("herp.derp@example.com", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(mw, strings.Repeat("Half a message.\n", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Abort(); err != nil {
+		t.Fatalf("Abort() = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != existing {
+		t.Errorf("File not truncated after Abort():\n%q", string(b))
+	}
+}
@@ -0,0 +1,274 @@
+// Package attachment extracts the attachments of the messages of mbox
+// archives.
+//
+// Messages are parsed as they are read: attachments are decoded and streamed
+// to a Sink, without loading whole messages in memory.
+package attachment
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-mbox"
+)
+
+// Attachment describes an attachment.
+type Attachment struct {
+	// MessageIndex is the index of the message in the mbox stream.
+	MessageIndex int
+	// MessageOffset is the offset of the message in the mbox stream, see
+	// mbox.Reader.Offset.
+	MessageOffset int64
+	// MessageID is the Message-ID of the message, without angle brackets.
+	MessageID string
+	// Part is the number of the MIME part, as used by IMAP: "2" for the second
+	// part of a multipart message, "2.1" for the first part of that part, and
+	// "1" for a message which isn't multipart.
+	Part string
+	// Filename is the file name of the attachment, decoded from RFC 2231
+	// parameters or encoded words. It may be empty and must be sanitized
+	// before being used as a path.
+	Filename string
+	// ContentType is the media type of the attachment, without parameters.
+	ContentType string
+	Header      textproto.MIMEHeader
+
+	// Size is the size of the decoded attachment and SHA256 its hex-encoded
+	// SHA-256 hash. They're set once the content has been read until io.EOF.
+	Size   int64
+	SHA256 string
+	// Err is the error encountered decoding the attachment, e.g. corrupt
+	// base64, if any. It's set once the content has been read until the error.
+	Err error
+}
+
+// Sink receives attachments.
+type Sink interface {
+	// WriteAttachment is called for each attachment. r reads the decoded
+	// content of the attachment; it's only valid until WriteAttachment
+	// returns.
+	WriteAttachment(a *Attachment, r io.Reader) error
+}
+
+// SinkFunc is a Sink implemented by a function.
+type SinkFunc func(a *Attachment, r io.Reader) error
+
+// WriteAttachment implements Sink.
+func (f SinkFunc) WriteAttachment(a *Attachment, r io.Reader) error {
+	return f(a, r)
+}
+
+// Extract writes the attachments of the messages read from r to sink. It
+// returns the number of attachments.
+//
+// Parts with an "attachment" disposition or a file name are considered
+// attachments. Forwarded messages are only extracted as a whole, if they're
+// attachments. Extraction stops at the first error returned by the sink;
+// malformed multipart bodies are processed up to the first error.
+//
+// Errors decoding an attachment are returned by the reader passed to the sink
+// and recorded in Attachment.Err. Extraction then goes on with the next part,
+// even if the sink returned an error.
+func Extract(r *mbox.Reader, sink Sink) (int, error) {
+	n := 0
+	for i := 0; ; i++ {
+		text, err := r.NextMessage()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		m, err := mail.ReadMessage(text)
+		if err != nil {
+			// Not a valid message, there's nothing to extract
+			continue
+		}
+
+		body := &errReader{r: m.Body}
+		e := &extractor{
+			sink: sink,
+			body: body,
+			msg: Attachment{
+				MessageIndex:  i,
+				MessageOffset: r.Offset(),
+				MessageID:     strings.Trim(strings.TrimSpace(m.Header.Get("Message-Id")), "<>"),
+			},
+		}
+		err = e.walk(textproto.MIMEHeader(m.Header), body, "")
+		n += e.n
+		if err != nil {
+			return n, fmt.Errorf("attachment: message %v: %v", i+1, err)
+		}
+	}
+}
+
+type extractor struct {
+	sink Sink
+	// body is the message body: errors reading it aren't decoding errors
+	body *errReader
+	// msg holds the message fields of attachments
+	msg Attachment
+	n   int
+}
+
+// walk walks a MIME entity. part is the number of the entity, empty for the
+// message itself.
+func (e *extractor) walk(h textproto.MIMEHeader, body io.Reader, part string) error {
+	t, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		t = "text/plain"
+	}
+
+	if strings.HasPrefix(t, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(body, params["boundary"])
+		for i := 1; ; i++ {
+			p, err := mr.NextPart()
+			if err != nil {
+				// io.EOF or a malformed multipart body
+				return nil
+			}
+			sub := strconv.Itoa(i)
+			if part != "" {
+				sub = part + "." + sub
+			}
+			if err := e.walk(p.Header, p, sub); err != nil {
+				return err
+			}
+		}
+	}
+
+	filename := attachmentName(h)
+	disp, _, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	if disp != "attachment" && filename == "" {
+		return nil
+	}
+
+	if part == "" {
+		part = "1"
+	}
+	a := e.msg
+	a.Part = part
+	a.Filename = filename
+	a.ContentType = t
+	a.Header = h
+
+	hr := &hashReader{r: decode(h, body), h: sha256.New(), a: &a, body: e.body}
+	if err := e.sink.WriteAttachment(&a, hr); err != nil && a.Err == nil {
+		return err
+	}
+	e.n++
+	// Read the rest of the attachment, if any, to reach the next part
+	if _, err := io.Copy(ioutil.Discard, hr); err != nil && a.Err == nil {
+		return err
+	}
+	return nil
+}
+
+// attachmentName returns the file name of a MIME entity, or an empty string.
+func attachmentName(h textproto.MIMEHeader) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil {
+			name = params["name"]
+		}
+	}
+	// Some clients use encoded words instead of RFC 2231 parameters
+	var dec mime.WordDecoder
+	if s, err := dec.DecodeHeader(name); err == nil {
+		name = s
+	}
+	return name
+}
+
+// decode decodes the content transfer encoding of a body. multipart.Reader
+// already decodes quoted-printable parts.
+func decode(h textproto.MIMEHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// base64Cleaner removes characters outside of the base64 alphabet, such as
+// line breaks.
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	for {
+		n, err := c.r.Read(p)
+		j := 0
+		for _, b := range p[:n] {
+			if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '+' || b == '/' || b == '=' {
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+// errReader records the errors of the underlying io.Reader, other than
+// io.EOF.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// hashReader computes the size and the hash of an attachment as it's read.
+// Errors which don't come from reading the message body are recorded as
+// decoding errors.
+type hashReader struct {
+	r    io.Reader
+	h    hash.Hash
+	a    *Attachment
+	body *errReader
+	err  error
+}
+
+func (hr *hashReader) Read(p []byte) (int, error) {
+	if hr.err != nil {
+		return 0, hr.err
+	}
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	hr.a.Size += int64(n)
+	if err == io.EOF {
+		hr.a.SHA256 = hex.EncodeToString(hr.h.Sum(nil))
+	} else if err != nil && hr.body.err == nil {
+		hr.a.Err = err
+	}
+	hr.err = err
+	return n, err
+}
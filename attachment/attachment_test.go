@@ -0,0 +1,182 @@
+package attachment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-mbox"
+)
+
+const testMbox = "From alice@example.com Thu Jan  1 00:00:01 2015\n" +
+	"Message-ID: <1@example.com>\n" +
+	"MIME-Version: 1.0\n" +
+	"Content-Type: multipart/mixed; boundary=outer\n" +
+	"\n" +
+	"--outer\n" +
+	"Content-Type: text/plain\n" +
+	"\n" +
+	"See attached.\n" +
+	"--outer\n" +
+	"Content-Type: text/plain; charset=utf-8\n" +
+	"Content-Disposition: attachment;\n" +
+	" filename*=UTF-8''r%C3%A9sum%C3%A9.txt\n" +
+	"Content-Transfer-Encoding: base64\n" +
+	"\n" +
+	"SGVsbG8s\n" +
+	"IHdvcmxkIQ==\n" +
+	"--outer\n" +
+	"Content-Type: multipart/related; boundary=inner\n" +
+	"\n" +
+	"--inner\n" +
+	"Content-Type: text/html\n" +
+	"\n" +
+	"<p>Hi</p>\n" +
+	"--inner\n" +
+	"Content-Type: text/csv; name=\"=?UTF-8?Q?caf=C3=A9.csv?=\"\n" +
+	"Content-Transfer-Encoding: quoted-printable\n" +
+	"\n" +
+	"a,b=3Dc\n" +
+	"--inner--\n" +
+	"--outer--\n" +
+	"\n" +
+	"From bob@example.com Thu Jan  1 00:00:02 2015\n" +
+	"Subject: No attachments\n" +
+	"\n" +
+	"Hi.\n" +
+	"\n" +
+	"From carol@example.com Thu Jan  1 00:00:03 2015\n" +
+	"Content-Type: application/octet-stream\n" +
+	"Content-Disposition: attachment; filename=\"../../etc/passwd\"\n" +
+	"\n" +
+	"root:x:0:0\n" +
+	"\n"
+
+type testAttachment struct {
+	index    int
+	offset   int64
+	id       string
+	part     string
+	filename string
+	t        string
+	content  string
+}
+
+func TestExtract(t *testing.T) {
+	var got []testAttachment
+	sink := SinkFunc(func(a *Attachment, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		if a.Size != int64(len(b)) || a.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("Size, SHA256 = %v, %v, want %v, %x", a.Size, a.SHA256, len(b), sum)
+		}
+		got = append(got, testAttachment{a.MessageIndex, a.MessageOffset, a.MessageID, a.Part, a.Filename, a.ContentType, string(b)})
+		return nil
+	})
+
+	n, err := Extract(mbox.NewReader(strings.NewReader(testMbox)), sink)
+	if err != nil {
+		t.Fatalf("Extract() = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Extract() = %v, want 3", n)
+	}
+
+	want := []testAttachment{
+		{0, 0, "1@example.com", "2", "résumé.txt", "text/plain", "Hello, world!"},
+		{0, 0, "1@example.com", "3.2", "café.csv", "text/csv", "a,b=c"},
+		{2, int64(strings.Index(testMbox, "From carol")), "", "1", "../../etc/passwd", "application/octet-stream", "root:x:0:0\r\n"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Extract() wrote:\n%+v\nwant:\n%+v", got, want)
+	}
+}
+
+func TestExtract_decodeError(t *testing.T) {
+	in := "From alice@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Content-Type: multipart/mixed; boundary=sep\n" +
+		"\n" +
+		"--sep\n" +
+		"Content-Disposition: attachment; filename=corrupt.bin\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"SGVsbG8=SGVsbG8=\n" +
+		"--sep\n" +
+		"Content-Disposition: attachment; filename=ok.txt\n" +
+		"\n" +
+		"Hello\n" +
+		"--sep--\n" +
+		"\n" +
+		"From bob@example.com Thu Jan  1 00:00:02 2015\n" +
+		"Content-Disposition: attachment; filename=last.txt\n" +
+		"\n" +
+		"Bye\n" +
+		"\n"
+
+	var names []string
+	var errs []bool
+	sink := SinkFunc(func(a *Attachment, r io.Reader) error {
+		_, err := ioutil.ReadAll(r)
+		if (err != nil) != (a.Err != nil) {
+			t.Errorf("ReadAll() = %v, but Err = %v", err, a.Err)
+		}
+		names = append(names, a.Filename)
+		errs = append(errs, a.Err != nil)
+		return err
+	})
+
+	n, err := Extract(mbox.NewReader(strings.NewReader(in)), sink)
+	if err != nil {
+		t.Fatalf("Extract() = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Extract() = %v, want 3", n)
+	}
+	if want := []string{"corrupt.bin", "ok.txt", "last.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Extract() wrote %v, want %v", names, want)
+	}
+	if want := []bool{true, false, false}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("Extract() errors = %v, want %v", errs, want)
+	}
+}
+
+func TestDirSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox-attachment-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Extract(mbox.NewReader(strings.NewReader(testMbox)), &DirSink{Dir: dir}); err != nil {
+		t.Fatalf("Extract() = %v", err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	want := []string{"000001-2-résumé.txt", "000001-3.2-café.csv", "000003-1-passwd"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("files = %v, want %v", names, want)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, want[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "Hello, world!" {
+		t.Errorf("content = %q, want %q", b, "Hello, world!")
+	}
+}
@@ -0,0 +1,62 @@
+package attachment
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// DirSink is a Sink writing attachments to files in a directory, see Name.
+type DirSink struct {
+	Dir string
+}
+
+// Name returns the name of the file an attachment is written to. It's made of
+// the message number (starting from 1), the part number and the sanitized file
+// name of the attachment, e.g. "000042-2.1-report.pdf".
+func (s *DirSink) Name(a *Attachment) string {
+	return fmt.Sprintf("%06d-%v-%v", a.MessageIndex+1, a.Part, sanitizeName(a.Filename))
+}
+
+// sanitizeName turns a file name into a safe base name.
+func sanitizeName(name string) string {
+	// Some clients send full paths
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7F || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" {
+		name = "attachment"
+	}
+	if n := 200; len(name) > n {
+		for n > 0 && !utf8.RuneStart(name[n]) {
+			n--
+		}
+		name = name[:n]
+	}
+	return name
+}
+
+// WriteAttachment implements Sink. It fails if the file already exists. The
+// file is removed if the attachment can't be read.
+func (s *DirSink) WriteAttachment(a *Attachment, r io.Reader) error {
+	f, err := os.OpenFile(filepath.Join(s.Dir, s.Name(a)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return f.Close()
+}
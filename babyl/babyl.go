@@ -0,0 +1,308 @@
+// Package babyl reads the Babyl format used by Emacs RMAIL.
+//
+// A Babyl file starts with a "BABYL OPTIONS:" header. Each message starts with
+// a "\x1f\x0c" line followed by a status line listing its attributes and
+// labels, its original header, an "*** EOOH ***" line, the header displayed
+// by RMAIL and the body. The file ends with a "\x1f" line.
+package babyl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+// ErrInvalidFormat is returned by Reader.NextMessage if the file isn't a valid
+// Babyl file.
+var ErrInvalidFormat = errors.New("babyl: invalid format")
+
+var (
+	optionsHeader = []byte("BABYL OPTIONS:")
+	eooh          = []byte("*** EOOH ***")
+	crlf          = []byte("\r\n")
+)
+
+// Attributes recognized by RMAIL in the status line.
+const (
+	AttrUnseen    = "unseen"
+	AttrDeleted   = "deleted"
+	AttrAnswered  = "answered"
+	AttrForwarded = "forwarded"
+	AttrEdited    = "edited"
+	AttrFiled     = "filed"
+	AttrResent    = "resent"
+	AttrRetried   = "retried"
+)
+
+type bodyReader struct {
+	r              *bufio.Reader
+	next           bytes.Buffer
+	atEnd, atEOF   bool
+	atMiddleOfLine bool
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	if br.next.Len() == 0 {
+		if br.atEnd {
+			return 0, io.EOF
+		}
+
+		b, isPrefix, err := br.r.ReadLine()
+		if err == io.EOF {
+			// Missing final "\x1f" line
+			br.atEnd, br.atEOF = true, true
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+
+		if !br.atMiddleOfLine && len(b) > 0 && b[0] == '\x1f' {
+			br.atEnd = true
+			br.atEOF = !bytes.HasPrefix(b, []byte("\x1f\x0c"))
+			return 0, io.EOF
+		}
+
+		br.next.Write(b)
+		if !isPrefix {
+			br.next.Write(crlf)
+		}
+		br.atMiddleOfLine = isPrefix
+	}
+
+	return br.next.Read(p)
+}
+
+// Reader reads messages from a Babyl file.
+type Reader struct {
+	r      *bufio.Reader
+	body   *bodyReader
+	hdr    []byte
+	attrs  []string
+	labels []string
+}
+
+// NewReader returns a new Reader to read messages from the Babyl data provided
+// by r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+func (r *Reader) readLine() ([]byte, error) {
+	var l []byte
+	for {
+		b, isPrefix, err := r.r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, b...)
+		if !isPrefix {
+			return l, nil
+		}
+	}
+}
+
+// NextMessage returns the next message text (containing both the header and
+// the body), with CRLF line endings as returned by mbox.Reader.NextMessage.
+// It returns io.EOF if there are no messages left.
+func (r *Reader) NextMessage() (io.Reader, error) {
+	if r.body == nil {
+		// Read the file header, up to the first message separator
+		l, err := r.readLine()
+		if err == io.EOF {
+			return nil, ErrInvalidFormat
+		} else if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(l, optionsHeader) {
+			return nil, ErrInvalidFormat
+		}
+		for {
+			l, err := r.readLine()
+			if err == io.EOF {
+				return nil, io.EOF
+			} else if err != nil {
+				return nil, err
+			}
+			if len(l) > 0 && l[0] == '\x1f' {
+				if !bytes.HasPrefix(l, []byte("\x1f\x0c")) {
+					return nil, io.EOF
+				}
+				break
+			}
+		}
+	} else {
+		if _, err := io.Copy(ioutil.Discard, r.body); err != nil {
+			return nil, err
+		}
+		if r.body.atEOF {
+			return nil, io.EOF
+		}
+	}
+
+	// Some files have the status line on the same line as the separator
+	status, err := r.readLine()
+	if err != nil {
+		return nil, ErrInvalidFormat
+	}
+	status = bytes.TrimPrefix(status, []byte("\x1f\x0c"))
+	if len(status) == 0 {
+		if status, err = r.readLine(); err != nil {
+			return nil, ErrInvalidFormat
+		}
+	}
+	reformatted, err := r.parseStatus(string(status))
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the original header, up to EOOH
+	var orig, hdr []byte
+	foundEOOH := false
+	for {
+		b, err := r.r.Peek(1)
+		if err != nil || b[0] == '\x1f' {
+			break
+		}
+		l, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(l, eooh) {
+			foundEOOH = true
+			break
+		}
+		if len(l) == 0 {
+			// No EOOH line: the header ends with a blank line
+			hdr, orig = orig, nil
+			break
+		}
+		if !bytes.HasPrefix(l, []byte("Summary-line:")) {
+			orig = append(append(orig, l...), crlf...)
+		}
+	}
+
+	if foundEOOH {
+		// Read the displayed header
+		for {
+			b, err := r.r.Peek(1)
+			if err != nil || b[0] == '\x1f' {
+				break
+			}
+			l, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if len(l) == 0 {
+				break
+			}
+			hdr = append(append(hdr, l...), crlf...)
+		}
+		if reformatted && len(orig) > 0 {
+			hdr = orig
+		}
+	}
+
+	r.hdr = hdr
+	r.body = &bodyReader{r: r.r}
+	return io.MultiReader(bytes.NewReader(hdr), bytes.NewReader(crlf), r.body), nil
+}
+
+// parseStatus parses a status line such as "1, answered, unseen,, label1,".
+// It returns whether the header has been reformatted by RMAIL.
+func (r *Reader) parseStatus(status string) (bool, error) {
+	r.attrs, r.labels = nil, nil
+
+	i := strings.IndexByte(status, ',')
+	if i < 0 {
+		return false, ErrInvalidFormat
+	}
+	reformatted := strings.TrimSpace(status[:i]) == "1"
+	status = status[i+1:]
+
+	attrs, labels := status, ""
+	if i := strings.Index(status, ",,"); i >= 0 {
+		attrs, labels = status[:i], status[i+2:]
+	}
+	r.attrs = splitList(attrs)
+	r.labels = splitList(labels)
+	return reformatted, nil
+}
+
+func splitList(s string) []string {
+	var l []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			l = append(l, item)
+		}
+	}
+	return l
+}
+
+// Attributes returns the RMAIL attributes of the message last returned by
+// NextMessage, such as AttrUnseen or AttrAnswered.
+func (r *Reader) Attributes() []string {
+	return r.attrs
+}
+
+// Labels returns the user-defined labels of the message last returned by
+// NextMessage.
+func (r *Reader) Labels() []string {
+	return r.labels
+}
+
+// Flags returns the Status and X-Status flags equivalent to the attributes of
+// the message last returned by NextMessage.
+func (r *Reader) Flags() mbox.Flags {
+	flags := mbox.FlagRead | mbox.FlagOld
+	for _, attr := range r.attrs {
+		switch attr {
+		case AttrUnseen:
+			flags &^= mbox.FlagRead
+		case AttrDeleted:
+			flags |= mbox.FlagDeleted
+		case AttrAnswered:
+			flags |= mbox.FlagAnswered
+		}
+	}
+	return flags
+}
+
+// Convert reads a Babyl file from r and writes its messages to w. Attributes
+// are stored in the Status and X-Status header fields and labels in the
+// X-Keywords header field. The envelope sender and date are derived from the
+// message header, as in mbox.Writer.WriteMessage.
+func Convert(w *mbox.Writer, r io.Reader) error {
+	br := NewReader(r)
+	for {
+		if _, err := br.NextMessage(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		hdr := msgutil.StripFields(br.hdr, "Status", "X-Status", "X-Keywords")
+		flags := br.Flags()
+		if s := flags.Status(); s != "" {
+			hdr = append(hdr, "Status: "+s+"\r\n"...)
+		}
+		if s := flags.XStatus(); s != "" {
+			hdr = append(hdr, "X-Status: "+s+"\r\n"...)
+		}
+		if len(br.labels) > 0 {
+			hdr = append(hdr, "X-Keywords: "+strings.Join(br.labels, ", ")+"\r\n"...)
+		}
+		hdr = append(hdr, crlf...)
+
+		text := io.MultiReader(bytes.NewReader(hdr), br.body)
+		if err := w.WriteMessage("", time.Time{}, text); err != nil {
+			return err
+		}
+	}
+}
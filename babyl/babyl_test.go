@@ -0,0 +1,141 @@
+package babyl
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-mbox"
+)
+
+const babylFile = "BABYL OPTIONS: -*- rmail -*-\n" +
+	"Version: 5\n" +
+	"Labels: work,personal\n" +
+	"Note:   This is the header of an rmail file.\n" +
+	"Note:   If you are seeing it in rmail,\n" +
+	"Note:    it means the file has no messages in it.\n" +
+	"\x1f\x0c\n" +
+	"1, answered,, work,\n" +
+	"Summary-line:  1-Jan  herp.derp@example.com  Test\n" +
+	"Received: from mx.example.org by mail.example.com; Thu, 1 Jan 2015 00:00:01 +0000\n" +
+	"From: herp.derp@example.com (Herp Derp)\n" +
+	"Date: Thu, 01 Jan 2015 00:00:01 +0100\n" +
+	"Subject: Test\n" +
+	"*** EOOH ***\n" +
+	"From: herp.derp@example.com (Herp Derp)\n" +
+	"Subject: Test\n" +
+	"\n" +
+	"This is a simple test.\n" +
+	"\x1f\x0c\n" +
+	"0, unseen,,\n" +
+	"*** EOOH ***\n" +
+	"From: derp.herp@example.com (Derp Herp)\n" +
+	"Date: Fri, 02 Jan 2015 00:00:01 +0100\n" +
+	"Subject: Another test\n" +
+	"\n" +
+	"This is another simple test.\n" +
+	"\x1f"
+
+func TestReader(t *testing.T) {
+	r := NewReader(strings.NewReader(babylFile))
+
+	want := []struct {
+		text   string
+		attrs  []string
+		labels []string
+		flags  mbox.Flags
+	}{
+		{
+			"Received: from mx.example.org by mail.example.com; Thu, 1 Jan 2015 00:00:01 +0000\r\n" +
+				"From: herp.derp@example.com (Herp Derp)\r\n" +
+				"Date: Thu, 01 Jan 2015 00:00:01 +0100\r\n" +
+				"Subject: Test\r\n" +
+				"\r\n" +
+				"This is a simple test.\r\n",
+			[]string{AttrAnswered},
+			[]string{"work"},
+			mbox.FlagRead | mbox.FlagOld | mbox.FlagAnswered,
+		},
+		{
+			"From: derp.herp@example.com (Derp Herp)\r\n" +
+				"Date: Fri, 02 Jan 2015 00:00:01 +0100\r\n" +
+				"Subject: Another test\r\n" +
+				"\r\n" +
+				"This is another simple test.\r\n",
+			[]string{AttrUnseen},
+			nil,
+			mbox.FlagOld,
+		},
+	}
+
+	for i, w := range want {
+		mr, err := r.NextMessage()
+		if err != nil {
+			t.Fatalf("NextMessage() = %v", err)
+		}
+		b, err := ioutil.ReadAll(mr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != w.text {
+			t.Errorf("Message %v:\n%q\nexpected:\n%q", i, b, w.text)
+		}
+		if !reflect.DeepEqual(r.Attributes(), w.attrs) {
+			t.Errorf("Attributes() = %q, want %q", r.Attributes(), w.attrs)
+		}
+		if !reflect.DeepEqual(r.Labels(), w.labels) {
+			t.Errorf("Labels() = %q, want %q", r.Labels(), w.labels)
+		}
+		if r.Flags() != w.flags {
+			t.Errorf("Flags() = %v, want %v", r.Flags(), w.flags)
+		}
+	}
+
+	if _, err := r.NextMessage(); err != io.EOF {
+		t.Errorf("NextMessage() = %v, want io.EOF", err)
+	}
+}
+
+func TestReader_invalid(t *testing.T) {
+	r := NewReader(strings.NewReader("From herp.derp@example.com Thu Jan  1 00:00:01 2015\n"))
+	if _, err := r.NextMessage(); err != ErrInvalidFormat {
+		t.Errorf("NextMessage() = %v, want ErrInvalidFormat", err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	var b bytes.Buffer
+	w := mbox.NewWriter(&b)
+	if err := Convert(w, strings.NewReader(babylFile)); err != nil {
+		t.Fatalf("Convert() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Received: from mx.example.org by mail.example.com; Thu, 1 Jan 2015 00:00:01 +0000\n" +
+		"From: herp.derp@example.com (Herp Derp)\n" +
+		"Date: Thu, 01 Jan 2015 00:00:01 +0100\n" +
+		"Subject: Test\n" +
+		"Status: RO\n" +
+		"X-Status: A\n" +
+		"X-Keywords: work\n" +
+		"\n" +
+		"This is a simple test.\n" +
+		"\n" +
+		"From derp.herp@example.com Thu Jan  1 23:00:01 2015\n" +
+		"From: derp.herp@example.com (Derp Herp)\n" +
+		"Date: Fri, 02 Jan 2015 00:00:01 +0100\n" +
+		"Subject: Another test\n" +
+		"Status: O\n" +
+		"\n" +
+		"This is another simple test.\n" +
+		"\n"
+	if b.String() != want {
+		t.Errorf("Convert() output:\n%q\nexpected:\n%q", b.String(), want)
+	}
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/attachment"
+	"github.com/emersion/go-mbox/dedupe"
+	"github.com/emersion/go-mbox/filter"
+	"github.com/emersion/go-mbox/internal/msgutil"
+	"github.com/emersion/go-mbox/merge"
+	"github.com/emersion/go-mbox/split"
+	"github.com/emersion/go-mbox/transform"
+)
+
+func runCount(ctx *context, args []string) error {
+	fs := newFlagSet(ctx, "count")
+	format := fs.String("format", "auto", "input mbox variant")
+	if err := parseFlags(fs, args, 0, 1); err != nil {
+		return err
+	}
+
+	in, err := openInput(ctx, fs.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	n := 0
+	for {
+		if _, err := in.NextMessage(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		n++
+	}
+	_, err = fmt.Fprintln(ctx.stdout, n)
+	return err
+}
+
+var wordDecoder mime.WordDecoder
+
+func runList(ctx *context, args []string) error {
+	fs := newFlagSet(ctx, "ls")
+	format := fs.String("format", "auto", "input mbox variant")
+	if err := parseFlags(fs, args, 0, 1); err != nil {
+		return err
+	}
+
+	in, err := openInput(ctx, fs.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	bw := bufio.NewWriter(ctx.stdout)
+	for i := 1; ; i++ {
+		msg, err := in.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		hdr, err := msgutil.ReadHeader(bufio.NewReader(msg))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var subject string
+		if m, err := mail.ReadMessage(bytes.NewReader(hdr)); err == nil {
+			subject = m.Header.Get("Subject")
+		}
+
+		listMessage(bw, i, in.Offset(), in.FromLine(), subject)
+	}
+	return bw.Flush()
+}
+
+// listMessage prints a line describing a message, as the ls command does.
+func listMessage(w io.Writer, number int, offset int64, fromLine, subject string) {
+	sender, date, _ := mbox.ParseFromLine(fromLine)
+	dateStr := "-"
+	if !date.IsZero() {
+		dateStr = date.Format(time.RFC3339)
+	}
+	if sender == "" {
+		sender = "-"
+	}
+	if s, err := wordDecoder.DecodeHeader(subject); err == nil {
+		subject = s
+	}
+	fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", number, offset, sender, dateStr, subject)
+}
+
+func runCat(ctx *context, args []string) error {
+	fs := newFlagSet(ctx, "cat")
+	format := fs.String("format", "auto", "input mbox variant")
+	if err := parseFlags(fs, args, 1, 2); err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(fs.Arg(0))
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid message number %q", fs.Arg(0))
+	}
+
+	in, err := openInput(ctx, fs.Arg(1), *format)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var msg io.Reader
+	for i := 0; i < n; i++ {
+		msg, err = in.NextMessage()
+		if err == io.EOF {
+			return fmt.Errorf("no message %v", n)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	w := msgutil.NewLFWriter(ctx.stdout)
+	if _, err := io.Copy(w, msg); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func runSplit(ctx *context, args []string) error {
+	fs := newFlagSet(ctx, "split")
+	format := fs.String("format", "auto", "input mbox variant")
+	to := fs.String("to", "mboxo", "output mbox variant")
+	count := fs.Int("n", 0, "maximum number of messages per output file (default 1000 without -size and -month)")
+	size := fs.String("size", "", "maximum size of output files, with an optional K, M or G suffix")
+	byMonth := fs.Bool("month", false, "write one output file per month")
+	prefix := fs.String("prefix", "x", "output file name prefix, followed by the file number")
+	name := fs.String("name", "", "output file name template, overriding -prefix")
+	if err := parseFlags(fs, args, 0, 1); err != nil {
+		return err
+	}
+	if *count == 0 && *size == "" && !*byMonth {
+		*count = 1000
+	}
+	if *name == "" {
+		*name = strings.Replace(*prefix, "{{", `{{"{{"}}`, -1) + `{{printf "%04d" .Index}}.mbox`
+	}
+	if *count < 0 {
+		return fmt.Errorf("invalid message count %v", *count)
+	}
+	maxSize, err := parseSize(*size)
+	if err != nil {
+		return err
+	}
+	toFormat, err := parseFormat(*to)
+	if err != nil {
+		return err
+	}
+
+	in, err := openInput(ctx, fs.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	s, err := split.New(*name)
+	if err != nil {
+		return err
+	}
+	s.Format = toFormat
+	s.MaxMessages = *count
+	s.MaxSize = maxSize
+	s.ByMonth = *byMonth
+
+	err = s.Split(in.Reader)
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// parseSize parses a size in bytes, with an optional K, M or G suffix. An
+// empty string is parsed as zero.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	var mult int64 = 1
+	switch s[len(s)-1] {
+	case 'K', 'k':
+		mult = 1 << 10
+	case 'M', 'm':
+		mult = 1 << 20
+	case 'G', 'g':
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+func runMerge(ctx *context, args []string) error {
+	fs := newFlagSet(ctx, "merge")
+	format := fs.String("format", "auto", "input mbox variant")
+	to := fs.String("to", "mboxo", "output mbox variant")
+	output := fs.String("o", "-", "output file")
+	sortByDate := fs.Bool("sort", false, "sort messages by date")
+	key := fs.String("key", "envelope", "date to sort by: envelope or header")
+	sorted := fs.Bool("sorted", false, "inputs are already sorted by date")
+	tempDir := fs.String("tmpdir", "", "directory for temporary files")
+	if err := parseFlags(fs, args, 1, -1); err != nil {
+		return err
+	}
+	toFormat, err := parseFormat(*to)
+	if err != nil {
+		return err
+	}
+	options := &merge.Options{Sorted: *sorted, TempDir: *tempDir}
+	switch *key {
+	case "envelope":
+		options.Key = merge.KeyEnvelopeDate
+	case "header":
+		options.Key = merge.KeyHeaderDate
+	default:
+		return fmt.Errorf("invalid sort key %q", *key)
+	}
+
+	out, err := createOutput(ctx, *output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := mbox.NewWriter(out)
+	w.Format = toFormat
+	if *sortByDate {
+		var readers []*mbox.Reader
+		for _, name := range fs.Args() {
+			in, err := openInput(ctx, name, *format)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			readers = append(readers, in.Reader)
+		}
+		if err := merge.Merge(w, readers, options); err != nil {
+			return err
+		}
+	} else {
+		for _, name := range fs.Args() {
+			in, err := openInput(ctx, name, *format)
+			if err != nil {
+				return err
+			}
+			_, err = copyMessages(w, in.Reader, 0)
+			in.Close()
+			if err != nil {
+				return fmt.Errorf("%v: %v", name, err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func runConvert(ctx *context, args []string) error {
+	fs := newFlagSet(ctx, "convert")
+	format := fs.String("format", "auto", "input mbox variant")
+	to := fs.String("to", "", "output mbox variant")
+	output := fs.String("o", "-", "output file")
+	if err := parseFlags(fs, args, 0, 1); err != nil {
+		return err
+	}
+	if *to == "" {
+		fs.Usage()
+		return errUsage
+	}
+	toFormat, err := parseFormat(*to)
+	if err != nil {
+		return err
+	}
+
+	in, err := openInput(ctx, fs.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createOutput(ctx, *output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := mbox.NewWriter(out)
+	w.Format = toFormat
+	if _, err := copyMessages(w, in.Reader, 0); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func runFsck(ctx *context, args []string) error {
+	fs := newFlagSet(ctx, "fsck")
+	format := fs.String("format", "auto", "input mbox variant")
+	to := fs.String("to", "mboxo", "repaired copy mbox variant")
+	output := fs.String("o", "", "write a repaired copy to this file")
+	if err := parseFlags(fs, args, 0, 1); err != nil {
+		return err
+	}
+	toFormat, err := parseFormat(*to)
+	if err != nil {
+		return err
+	}
+
+	in, err := openRawInput(ctx, fs.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var rep *mbox.Report
+	if *output == "" {
+		rep, err = mbox.Validate(in.raw, in.format)
+	} else {
+		var out io.WriteCloser
+		if out, err = createOutput(ctx, *output); err != nil {
+			return err
+		}
+		defer out.Close()
+
+		w := mbox.NewWriter(out)
+		w.Format = toFormat
+		if rep, err = mbox.Repair(w, in.raw, in.format); err == nil {
+			if err = w.Close(); err == nil {
+				err = out.Close()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(ctx.stderr)
+	for _, f := range rep.Findings {
+		// Messages are numbered from 1, as in ls
+		msg := "-"
+		if f.Message >= 0 {
+			msg = strconv.Itoa(f.Message + 1)
+		}
+		fmt.Fprintf(bw, "%v\t%v\t%v\t%q\n", f.Offset, msg, f.Kind, f.Text)
+	}
+	fmt.Fprintf(bw, "%v messages, %v problems\n", rep.Messages, len(rep.Findings))
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if !rep.OK() {
+		return errProblems
+	}
+	return nil
+}
+
+func runDedupe(ctx *context, args []string) error {
+	fs := newFlagSet(ctx, "dedupe")
+	format := fs.String("format", "auto", "input mbox variant")
+	to := fs.String("to", "mboxo", "output mbox variant")
+	output := fs.String("o", "-", "output file")
+	by := fs.String("by", "id", "identify duplicates by: id, content or both")
+	tempDir := fs.String("tmpdir", "", "directory for temporary files")
+	if err := parseFlags(fs, args, 0, 1); err != nil {
+		return err
+	}
+	toFormat, err := parseFormat(*to)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(ctx.stderr)
+	options := &dedupe.Options{
+		TempDir: *tempDir,
+		Dropped: func(d *dedupe.Duplicate) {
+			fmt.Fprintf(bw, "%v\t%v\t%v\t%v\n", d.Index+1, d.Offset, d.Original+1, d.MessageID)
+		},
+	}
+	switch *by {
+	case "id":
+		options.Key = dedupe.KeyMessageID
+	case "content":
+		options.Key = dedupe.KeyContent
+	case "both":
+		options.Key = dedupe.KeyMessageIDAndContent
+	default:
+		return fmt.Errorf("invalid duplicate key %q", *by)
+	}
+
+	in, err := openInput(ctx, fs.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createOutput(ctx, *output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := mbox.NewWriter(out)
+	w.Format = toFormat
+	res, err := dedupe.Dedupe(w, in.Reader, options)
+	if err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(bw, "%v messages, %v duplicates dropped\n", res.Messages, res.Dropped)
+	return bw.Flush()
+}
+
+func runGrep(ctx *context, args []string) error {
+	fs := newFlagSet(ctx, "grep")
+	format := fs.String("format", "auto", "input mbox variant")
+	to := fs.String("to", "mboxo", "output mbox variant")
+	output := fs.String("o", "-", "output file")
+	list := fs.Bool("l", false, "list matching messages instead of printing them")
+	count := fs.Bool("c", false, "print the number of matching messages")
+	invert := fs.Bool("v", false, "select messages not matching the query")
+	if err := parseFlags(fs, args, 1, 2); err != nil {
+		return err
+	}
+	toFormat, err := parseFormat(*to)
+	if err != nil {
+		return err
+	}
+	p, err := filter.Parse(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *invert {
+		p = filter.Not(p)
+	}
+
+	in, err := openInput(ctx, fs.Arg(1), *format)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if *list || *count {
+		fr := filter.NewReader(in.Reader, p)
+		defer fr.Close()
+
+		bw := bufio.NewWriter(ctx.stdout)
+		n := 0
+		for {
+			msg, _, err := fr.NextMessage()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if *list {
+				listMessage(bw, msg.Index+1, msg.Offset, msg.FromLine, msg.Header.Get("Subject"))
+			}
+			n++
+		}
+		if *count {
+			fmt.Fprintln(bw, n)
+		}
+		return bw.Flush()
+	}
+
+	out, err := createOutput(ctx, *output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := mbox.NewWriter(out)
+	w.Format = toFormat
+	if _, err := filter.Filter(w, in.Reader, p); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func runRedact(ctx *context, args []string) error {
+	fs := newFlagSet(ctx, "redact")
+	format := fs.String("format", "auto", "input mbox variant")
+	to := fs.String("to", "mboxo", "output mbox variant")
+	output := fs.String("o", "-", "output file")
+	drop := fs.String("drop", "", "comma-separated list of header fields to remove")
+	strip := fs.Bool("strip", false, "replace addresses with redacted@redacted.invalid")
+	hashKey := fs.String("hash", "", "replace addresses with pseudonyms hashed with this key")
+	attachments := fs.Bool("attachments", false, "remove attachments")
+	if err := parseFlags(fs, args, 0, 1); err != nil {
+		return err
+	}
+	if *strip && *hashKey != "" {
+		return errors.New("-strip and -hash are mutually exclusive")
+	}
+	toFormat, err := parseFormat(*to)
+	if err != nil {
+		return err
+	}
+
+	var transforms []transform.Transform
+	if *drop != "" {
+		transforms = append(transforms, transform.DropFields(strings.Split(*drop, ",")...))
+	}
+	if *strip {
+		transforms = append(transforms, transform.StripAddresses())
+	} else if *hashKey != "" {
+		transforms = append(transforms, transform.HashAddresses([]byte(*hashKey)))
+	}
+	if *attachments {
+		transforms = append(transforms, transform.RemoveAttachments())
+	}
+
+	in, err := openInput(ctx, fs.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createOutput(ctx, *output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := mbox.NewWriter(out)
+	w.Format = toFormat
+	if _, err := transform.Apply(w, in.Reader, transforms...); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func runExtract(ctx *context, args []string) error {
+	fs := newFlagSet(ctx, "extract")
+	format := fs.String("format", "auto", "input mbox variant")
+	dir := fs.String("d", "", "write attachments to this directory")
+	if err := parseFlags(fs, args, 0, 1); err != nil {
+		return err
+	}
+
+	in, err := openInput(ctx, fs.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var dirSink *attachment.DirSink
+	if *dir != "" {
+		dirSink = &attachment.DirSink{Dir: *dir}
+	}
+	// Print the message number, offset, part number, size, hash, content type
+	// and file name of each attachment. Attachments which can't be decoded
+	// are reported on stderr instead.
+	bw := bufio.NewWriter(ctx.stdout)
+	failed := false
+	sink := attachment.SinkFunc(func(a *attachment.Attachment, r io.Reader) error {
+		name := a.Filename
+		var err error
+		if dirSink != nil {
+			err = dirSink.WriteAttachment(a, r)
+			name = dirSink.Name(a)
+		} else {
+			_, err = io.Copy(ioutil.Discard, r)
+		}
+		if a.Err != nil {
+			failed = true
+			fmt.Fprintf(ctx.stderr, "mbox: message %v part %v: %v\n", a.MessageIndex+1, a.Part, a.Err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", a.MessageIndex+1, a.MessageOffset, a.Part, a.Size, a.SHA256, a.ContentType, name)
+		return nil
+	})
+	_, err = attachment.Extract(in.Reader, sink)
+	if flushErr := bw.Flush(); err == nil {
+		err = flushErr
+	}
+	if err == nil && failed {
+		err = errProblems
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+var formats = []mbox.Format{
+	mbox.FormatMboxo,
+	mbox.FormatMboxrd,
+	mbox.FormatMboxcl2,
+	mbox.FormatMMDF,
+}
+
+// parseFormat parses an mbox variant name, as returned by mbox.Format.String.
+func parseFormat(name string) (mbox.Format, error) {
+	for _, f := range formats {
+		if f.String() == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown mbox format %q", name)
+}
+
+// input is an mbox file opened for reading.
+type input struct {
+	*mbox.Reader
+
+	raw    io.Reader
+	format mbox.Format
+	f      io.Closer
+	zr     io.Closer
+}
+
+// openRawInput opens an mbox file without creating an mbox.Reader: the
+// decompressed data can be read from in.raw. If name is empty or "-", the
+// standard input is read. format is an mbox variant name or "auto".
+func openRawInput(ctx *context, name, format string) (*input, error) {
+	in := new(input)
+	var r io.Reader
+	if name == "" || name == "-" {
+		r = ctx.stdin
+	} else {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		in.f = f
+		r = f
+	}
+
+	zr, compression, err := mbox.Decompress(r)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	in.zr = zr
+
+	// Uncompressed files are sampled without moving their read offset
+	var size int64 = -1
+	if f, ok := in.f.(*os.File); ok && compression == mbox.CompressionNone {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			size = fi.Size()
+		}
+	}
+
+	switch {
+	case format != "auto":
+		in.raw = zr
+		in.format, err = parseFormat(format)
+	case size >= 0:
+		in.raw = zr
+		in.format, _, err = mbox.DetectFormatAt(in.f.(*os.File), size)
+	default:
+		br := bufio.NewReaderSize(zr, mbox.DetectSize)
+		var b []byte
+		b, err = br.Peek(mbox.DetectSize)
+		if err == io.EOF {
+			err = nil
+		}
+		in.raw = br
+		in.format, _ = mbox.DetectFormat(b)
+	}
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	return in, nil
+}
+
+// openInput opens an mbox file for reading, see openRawInput.
+func openInput(ctx *context, name, format string) (*input, error) {
+	in, err := openRawInput(ctx, name, format)
+	if err != nil {
+		return nil, err
+	}
+	in.Reader = mbox.NewReader(in.raw)
+	in.Reader.Format = in.format
+	return in, nil
+}
+
+func (in *input) Close() error {
+	var err error
+	if in.zr != nil {
+		err = in.zr.Close()
+	}
+	if in.f != nil {
+		if closeErr := in.f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// createOutput creates an output file. If name is empty or "-", the standard
+// output is used.
+func createOutput(ctx *context, name string) (io.WriteCloser, error) {
+	if name == "" || name == "-" {
+		return nopWriteCloser{ctx.stdout}, nil
+	}
+	return os.Create(name)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// copyMessage writes a message read from r to w, keeping its From line as
+// is.
+func copyMessage(w *mbox.Writer, r *mbox.Reader, msg io.Reader) error {
+	// Messages are read with CRLF line endings: convert them back to LF, since
+	// mboxcl2 messages are written as is. mboxcl2 messages are read as is.
+	if r.Format != mbox.FormatMboxcl2 {
+		msg = msgutil.NewLFReader(msg)
+	}
+	if r.FromLine() == "" {
+		// The envelope is derived from the header
+		return w.WriteMessage("", time.Time{}, msg)
+	}
+
+	mw, err := w.CreateMessageFromLine(r.FromLine())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(mw, msg); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// copyMessages writes the messages read from r to w, up to max messages if
+// max is positive. It returns the number of copied messages.
+func copyMessages(w *mbox.Writer, r *mbox.Reader, max int) (int, error) {
+	n := 0
+	for max <= 0 || n < max {
+		msg, err := r.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		if err := copyMessage(w, r, msg); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,136 @@
+// Command mbox inspects and manipulates mbox files.
+//
+// Usage:
+//
+//	mbox <command> [flags] [arguments]
+//
+// The commands are:
+//
+//	count    print the number of messages
+//	ls       list messages: number, offset, envelope sender, date and subject
+//	cat      print a message
+//	split    split a mailbox into several files
+//	merge    concatenate mailboxes, optionally sorting messages by date
+//	convert  convert a mailbox to another mbox variant
+//	fsck     check a mailbox for problems and optionally repair it
+//	dedupe   remove duplicate messages
+//	grep     select messages matching a query, see filter.Parse
+//	redact   remove header fields, addresses and attachments
+//	extract  list attachments and optionally write them to a directory
+//
+// Inputs can be compressed, see mbox.Decompress. An input named "-" or
+// missing reads the standard input. Unless the -format flag is given, the
+// mbox variant of inputs is detected automatically.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+type command struct {
+	run   func(ctx *context, args []string) error
+	usage string
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"count":   {runCount, "count [-format format] [file]"},
+		"ls":      {runList, "ls [-format format] [file]"},
+		"cat":     {runCat, "cat [-format format] <number> [file]"},
+		"split":   {runSplit, "split [-format format] [-to format] [-n count] [-size size] [-month] [-prefix prefix | -name template] [file]"},
+		"merge":   {runMerge, "merge [-format format] [-to format] [-o output] [-sort [-key key] [-sorted] [-tmpdir dir]] <file>..."},
+		"convert": {runConvert, "convert [-format format] -to format [-o output] [file]"},
+		"fsck":    {runFsck, "fsck [-format format] [-to format] [-o output] [file]"},
+		"dedupe":  {runDedupe, "dedupe [-format format] [-to format] [-o output] [-by key] [-tmpdir dir] [file]"},
+		"grep":    {runGrep, "grep [-format format] [-to format] [-o output] [-l] [-c] [-v] <query> [file]"},
+		"redact":  {runRedact, "redact [-format format] [-to format] [-o output] [-drop fields] [-strip | -hash key] [-attachments] [file]"},
+		"extract": {runExtract, "extract [-format format] [-d dir] [file]"},
+	}
+}
+
+// context holds the standard streams of a command.
+type context struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// errUsage is returned when a command is invoked with invalid arguments. The
+// usage has already been printed.
+var errUsage = errors.New("invalid usage")
+
+// errProblems is returned by fsck when problems are found, and by extract when
+// attachments can't be decoded. They have already been printed.
+var errProblems = errors.New("problems found")
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: mbox <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(w, "  mbox "+commands[name].usage)
+	}
+}
+
+func run(ctx *context, args []string) error {
+	if len(args) == 0 {
+		usage(ctx.stderr)
+		return errUsage
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(ctx.stderr, "mbox: unknown command %q\n", args[0])
+		usage(ctx.stderr)
+		return errUsage
+	}
+	return cmd.run(ctx, args[1:])
+}
+
+// newFlagSet creates a flag set for a command.
+func newFlagSet(ctx *context, name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ctx.stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(ctx.stderr, "usage: mbox "+commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses the flags of a command and checks the number of
+// remaining arguments. max is -1 for an unlimited number of arguments.
+func parseFlags(fs *flag.FlagSet, args []string, min, max int) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if n := fs.NArg(); n < min || (max >= 0 && n > max) {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func main() {
+	ctx := &context{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}
+	if err := run(ctx, os.Args[1:]); err == errUsage {
+		os.Exit(2)
+	} else if err == errProblems {
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "mbox: "+strings.TrimPrefix(err.Error(), "mbox: "))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output doesn't match %v:\n%s\nwant:\n%s", golden, got, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"count", []string{"count", "testdata/input.mbox"}},
+		{"ls", []string{"ls", "testdata/input.mbox"}},
+		{"cat", []string{"cat", "2", "testdata/input.mbox"}},
+		{"merge", []string{"merge", "testdata/input.mbox", "testdata/input.mbox"}},
+		{"merge-sort", []string{"merge", "-sort", "testdata/input.mbox", "testdata/unsorted.mbox"}},
+		{"convert-mboxrd", []string{"convert", "-to", "mboxrd", "testdata/input.mbox"}},
+		{"convert-mboxcl2", []string{"convert", "-to", "mboxcl2", "testdata/input.mbox"}},
+		{"convert-mmdf", []string{"convert", "-to", "mmdf", "testdata/input.mbox"}},
+		{"grep", []string{"grep", "from:bob or subject:résumé", "testdata/input.mbox"}},
+		{"grep-list", []string{"grep", "-l", "-v", "domain:example.com before:2015-01-02", "testdata/input.mbox"}},
+		{"grep-count", []string{"grep", "-c", "larger:150", "testdata/input.mbox"}},
+		{"extract", []string{"extract", "testdata/attachments.mbox"}},
+		{"redact", []string{"redact", "-drop", "Message-ID,Date", "-hash", "secret", "testdata/input.mbox"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			ctx := &context{stdout: &stdout, stderr: &stderr}
+			if err := run(ctx, test.args); err != nil {
+				t.Fatalf("run(%q) = %v, stderr:\n%s", test.args, err, stderr.String())
+			}
+			checkGolden(t, test.name, stdout.Bytes())
+		})
+	}
+}
+
+func TestCommands_stdinCompressed(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/input.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+
+	var stdout bytes.Buffer
+	ctx := &context{stdin: &buf, stdout: &stdout, stderr: ioutil.Discard}
+	if err := run(ctx, []string{"ls"}); err != nil {
+		t.Fatalf("run() = %v", err)
+	}
+	checkGolden(t, "ls", stdout.Bytes())
+}
+
+func TestSplit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox-split-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := &context{stdout: ioutil.Discard, stderr: ioutil.Discard}
+	args := []string{"split", "-n", "2", "-prefix", filepath.Join(dir, "part"), "testdata/input.mbox"}
+	if err := run(ctx, args); err != nil {
+		t.Fatalf("run() = %v", err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	var got bytes.Buffer
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.WriteString("== " + filepath.Base(name) + "\n")
+		got.Write(b)
+	}
+	checkGolden(t, "split", got.Bytes())
+}
+
+func TestUsage(t *testing.T) {
+	tests := [][]string{
+		nil,
+		{"unknown"},
+		{"cat"},
+		{"cat", "-unknown-flag", "1"},
+		{"convert", "testdata/input.mbox"},
+		{"merge"},
+	}
+	for _, args := range tests {
+		var stderr bytes.Buffer
+		ctx := &context{stdout: ioutil.Discard, stderr: &stderr}
+		if err := run(ctx, args); err != errUsage {
+			t.Errorf("run(%q) = %v, want errUsage", args, err)
+		}
+		if !strings.Contains(stderr.String(), "usage: mbox") {
+			t.Errorf("run(%q) didn't print usage: %q", args, stderr.String())
+		}
+	}
+}
+
+func TestFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox-fsck-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stderr bytes.Buffer
+	ctx := &context{stdout: ioutil.Discard, stderr: &stderr}
+	if err := run(ctx, []string{"fsck", "testdata/input.mbox"}); err != nil {
+		t.Errorf("run(fsck) on valid input = %v, stderr:\n%s", err, stderr.String())
+	}
+
+	stderr.Reset()
+	repaired := filepath.Join(dir, "repaired.mbox")
+	if err := run(ctx, []string{"fsck", "-o", repaired, "testdata/broken.mbox"}); err != errProblems {
+		t.Errorf("run(fsck) = %v, want errProblems", err)
+	}
+	checkGolden(t, "fsck", stderr.Bytes())
+
+	b, err := ioutil.ReadFile(repaired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "fsck-repaired", b)
+}
+
+func TestConvert_mboxcl2(t *testing.T) {
+	in := "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: CRLF\r\n" +
+		"Content-Length: 5\r\n\r\n" +
+		"Hi.\r\n\n"
+
+	var stdout bytes.Buffer
+	ctx := &context{stdin: strings.NewReader(in), stdout: &stdout, stderr: ioutil.Discard}
+	if err := run(ctx, []string{"convert", "-format", "mboxcl2", "-to", "mboxcl2"}); err != nil {
+		t.Fatalf("run(convert) = %v", err)
+	}
+	if stdout.String() != in {
+		t.Errorf("run(convert) = %q, want %q", stdout.String(), in)
+	}
+}
+
+func TestExtract_decodeError(t *testing.T) {
+	in := "From alice@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Content-Disposition: attachment; filename=corrupt.bin\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"SGVsbG8=SGVsbG8=\n" +
+		"\n" +
+		"From bob@example.com Thu Jan  1 00:00:02 2015\n" +
+		"Content-Disposition: attachment; filename=ok.txt\n" +
+		"\n" +
+		"Hello\n" +
+		"\n"
+
+	var stdout, stderr bytes.Buffer
+	ctx := &context{stdin: strings.NewReader(in), stdout: &stdout, stderr: &stderr}
+	if err := run(ctx, []string{"extract"}); err != errProblems {
+		t.Errorf("run(extract) = %v, want errProblems", err)
+	}
+	if !strings.HasPrefix(stderr.String(), "mbox: message 1 part 1: ") {
+		t.Errorf("stderr = %q, want the decoding error of message 1", stderr.String())
+	}
+	if !strings.HasPrefix(stdout.String(), "2\t") || strings.Count(stdout.String(), "\n") != 1 {
+		t.Errorf("stdout = %q, want message 2 only", stdout.String())
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	ctx := &context{stdout: &stdout, stderr: &stderr}
+	if err := run(ctx, []string{"dedupe", "testdata/dupes.mbox"}); err != nil {
+		t.Fatalf("run(dedupe) = %v, stderr:\n%s", err, stderr.String())
+	}
+	checkGolden(t, "dedupe", stdout.Bytes())
+	checkGolden(t, "dedupe-report", stderr.Bytes())
+}
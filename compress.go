@@ -0,0 +1,177 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is a compression method for mbox files.
+type Compression int
+
+const (
+	// CompressionNone is used for uncompressed files.
+	CompressionNone Compression = iota
+	// CompressionGzip is the gzip format (RFC 1952).
+	CompressionGzip
+	// CompressionBzip2 is the bzip2 format. No encoder is registered by
+	// default, see RegisterCompression.
+	CompressionBzip2
+	// CompressionXz is the xz format.
+	CompressionXz
+	// CompressionZstd is the Zstandard format (RFC 8878).
+	CompressionZstd
+)
+
+// String implements fmt.Stringer.
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionBzip2:
+		return "bzip2"
+	case CompressionXz:
+		return "xz"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return "unknown"
+	}
+}
+
+var compressionMagics = []struct {
+	c     Compression
+	magic []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionBzip2, []byte("BZh")},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// compressionMagicLen is the number of bytes needed by DetectCompression.
+const compressionMagicLen = 6
+
+// DetectCompression detects the compression method from the magic bytes at the
+// beginning of b.
+func DetectCompression(b []byte) Compression {
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(b, m.magic) {
+			return m.c
+		}
+	}
+	return CompressionNone
+}
+
+type codec struct {
+	newReader func(r io.Reader) (io.ReadCloser, error)
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	codecsMu sync.Mutex
+	codecs   = map[Compression]codec{
+		CompressionGzip: {
+			newReader: func(r io.Reader) (io.ReadCloser, error) {
+				return gzip.NewReader(r)
+			},
+			newWriter: func(w io.Writer) (io.WriteCloser, error) {
+				return gzip.NewWriter(w), nil
+			},
+		},
+		CompressionBzip2: {
+			newReader: func(r io.Reader) (io.ReadCloser, error) {
+				return ioutil.NopCloser(bzip2.NewReader(r)), nil
+			},
+		},
+		CompressionXz: {
+			newReader: func(r io.Reader) (io.ReadCloser, error) {
+				zr, err := xz.NewReader(r)
+				if err != nil {
+					return nil, err
+				}
+				return ioutil.NopCloser(zr), nil
+			},
+			newWriter: func(w io.Writer) (io.WriteCloser, error) {
+				return xz.NewWriter(w)
+			},
+		},
+		CompressionZstd: {
+			newReader: func(r io.Reader) (io.ReadCloser, error) {
+				zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+				if err != nil {
+					return nil, err
+				}
+				return zr.IOReadCloser(), nil
+			},
+			newWriter: func(w io.Writer) (io.WriteCloser, error) {
+				return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+			},
+		},
+	}
+)
+
+// RegisterCompression registers a decoder and an encoder for a compression
+// method, replacing the existing ones. Either can be nil. Decoders and
+// encoders are registered by default for gzip, xz and zstd, and a decoder for
+// bzip2.
+//
+// Encoders must produce a complete stream which can be concatenated to an
+// existing one, as done by Append.
+func RegisterCompression(c Compression, newReader func(r io.Reader) (io.ReadCloser, error), newWriter func(w io.Writer) (io.WriteCloser, error)) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c] = codec{newReader: newReader, newWriter: newWriter}
+}
+
+func getCodec(c Compression) codec {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	return codecs[c]
+}
+
+// newDecompressor returns a reader decompressing data from r.
+func newDecompressor(c Compression, r io.Reader) (io.ReadCloser, error) {
+	if c == CompressionNone {
+		return ioutil.NopCloser(r), nil
+	}
+	newReader := getCodec(c).newReader
+	if newReader == nil {
+		return nil, fmt.Errorf("mbox: no %v decoder registered", c)
+	}
+	return newReader(r)
+}
+
+// newCompressor returns a writer compressing data to w.
+func newCompressor(c Compression, w io.Writer) (io.WriteCloser, error) {
+	newWriter := getCodec(c).newWriter
+	if newWriter == nil {
+		return nil, fmt.Errorf("mbox: no %v encoder registered", c)
+	}
+	return newWriter(w)
+}
+
+// Decompress detects the compression method of r from its magic bytes and
+// returns a reader decompressing it. If r isn't compressed, its data is
+// returned as is. Concatenated streams, such as gzip members added by Append,
+// are decompressed as a single stream.
+func Decompress(r io.Reader) (io.ReadCloser, Compression, error) {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(compressionMagicLen)
+	if err != nil && err != io.EOF {
+		return nil, CompressionNone, err
+	}
+	c := DetectCompression(b)
+	rc, err := newDecompressor(c, br)
+	return rc, c, err
+}
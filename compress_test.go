@@ -0,0 +1,238 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectCompression(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want Compression
+	}{
+		{nil, CompressionNone},
+		{[]byte("From foo@example.com"), CompressionNone},
+		{[]byte{0x1f, 0x8b, 0x08}, CompressionGzip},
+		{[]byte("BZh91AY&SY"), CompressionBzip2},
+		{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}, CompressionXz},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, CompressionZstd},
+	}
+	for _, test := range tests {
+		if got := DetectCompression(test.b); got != test.want {
+			t.Errorf("DetectCompression(%q) = %v, want %v", test.b, got, test.want)
+		}
+	}
+}
+
+func TestAppend_noEncoder(t *testing.T) {
+	name, cleanup := tempMailbox(t, "")
+	defer cleanup()
+
+	if a, err := Append(name, &AppendOptions{Compression: CompressionBzip2}); err == nil {
+		a.Abort()
+		t.Errorf("Append() = nil error without a bzip2 encoder")
+	}
+}
+
+func TestAppend_gzip(t *testing.T) {
+	name, cleanup := tempMailbox(t, "")
+	defer cleanup()
+	os.Remove(name)
+
+	date := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+	for i, subject := range []string{"First", "Second"} {
+		a, err := Append(name, &AppendOptions{Compression: CompressionGzip})
+		if err != nil {
+			t.Fatalf("Append() = %v", err)
+		}
+		body := "Subject: " + subject + "\n\nHi."
+		if err := a.WriteMessage("herp.derp@example.com", date, strings.NewReader(body)); err != nil {
+			t.Fatalf("WriteMessage() = %v", err)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+
+		// Each Append adds an independent gzip member
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(f)
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members := 0
+		zr.Multistream(false)
+		for {
+			if _, err := ioutil.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+			members++
+			if err := zr.Reset(br); err != nil {
+				break
+			}
+			zr.Multistream(false)
+		}
+		f.Close()
+		if members != i+1 {
+			t.Errorf("got %v gzip members, want %v", members, i+1)
+		}
+	}
+
+	fr, err := OpenReader(name, nil)
+	if err != nil {
+		t.Fatalf("OpenReader() = %v", err)
+	}
+	defer fr.Close()
+
+	var subjects []string
+	for {
+		r, err := fr.NextMessage()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subjects = append(subjects, string(b))
+	}
+	want := []string{"Subject: First\r\n\r\nHi.\r\n", "Subject: Second\r\n\r\nHi.\r\n"}
+	if len(subjects) != len(want) {
+		t.Fatalf("got %q, want %q", subjects, want)
+	}
+	for i := range want {
+		if subjects[i] != want[i] {
+			t.Errorf("message #%v = %q, want %q", i, subjects[i], want[i])
+		}
+	}
+}
+
+func readSubjects(t *testing.T, name string) []string {
+	fr, err := OpenReader(name, nil)
+	if err != nil {
+		t.Fatalf("OpenReader() = %v", err)
+	}
+	defer fr.Close()
+
+	var subjects []string
+	for {
+		r, err := fr.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("NextMessage() = %v", err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subjects = append(subjects, string(b))
+	}
+	return subjects
+}
+
+func TestAppend_xzZstd(t *testing.T) {
+	date := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+	for _, c := range []Compression{CompressionXz, CompressionZstd} {
+		name, cleanup := tempMailbox(t, "")
+		os.Remove(name)
+
+		for _, subject := range []string{"First", "Second"} {
+			a, err := Append(name, &AppendOptions{Compression: c})
+			if err != nil {
+				t.Fatalf("%v: Append() = %v", c, err)
+			}
+			body := "Subject: " + subject + "\n\nHi."
+			if err := a.WriteMessage("herp.derp@example.com", date, strings.NewReader(body)); err != nil {
+				t.Fatalf("%v: WriteMessage() = %v", c, err)
+			}
+			if err := a.Close(); err != nil {
+				t.Fatalf("%v: Close() = %v", c, err)
+			}
+		}
+
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := DetectCompression(b); got != c {
+			t.Errorf("DetectCompression() = %v, want %v", got, c)
+		}
+
+		subjects := readSubjects(t, name)
+		want := []string{"Subject: First\r\n\r\nHi.\r\n", "Subject: Second\r\n\r\nHi.\r\n"}
+		if !reflect.DeepEqual(subjects, want) {
+			t.Errorf("%v: got %q, want %q", c, subjects, want)
+		}
+		cleanup()
+	}
+}
+
+func TestAppend_compressedTail(t *testing.T) {
+	// The first member is corrupted: only the last one should be
+	// decompressed to find out how the file ends
+	corrupted := []byte{0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xde, 0xad, 0xbe, 0xef}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("From foo@example.com Thu Jan  1 00:00:01 2015\n\nHi."))
+	zw.Close()
+
+	name, cleanup := tempMailbox(t, string(corrupted)+buf.String())
+	defer cleanup()
+
+	a, err := Append(name, nil)
+	if err != nil {
+		t.Fatalf("Append() = %v", err)
+	}
+	date := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+	if err := a.WriteMessage("herp.derp@example.com", date, strings.NewReader("Subject: Test\n\nHi.\n")); err != nil {
+		t.Fatalf("WriteMessage() = %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b[len(corrupted):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From foo@example.com Thu Jan  1 00:00:01 2015\n\nHi.\n\n" +
+		"From herp.derp@example.com Thu Jan  1 00:00:01 2015\nSubject: Test\n\nHi.\n\n"
+	if string(got) != want {
+		t.Errorf("Decompressed file:\n%q\nexpected:\n%q", got, want)
+	}
+}
+
+func TestOpenMailbox_compressed(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("From foo@example.com Thu Jan  1 00:00:01 2015\n\nHi.\n\n"))
+	zw.Close()
+
+	name, cleanup := tempMailbox(t, buf.String())
+	defer cleanup()
+
+	if mb, err := OpenMailbox(name, nil); err == nil {
+		mb.Close()
+		t.Error("OpenMailbox() = nil error for a gzip file")
+	}
+}
@@ -0,0 +1,255 @@
+// Package dedupe removes duplicate messages from mbox archives.
+//
+// Duplicates are identified by Message-ID, by a hash of the normalized
+// message content, or both. The set of seen messages is kept in memory up to
+// a limit, then spilled to an on-disk hash table, so that archives with
+// millions of messages can be processed with bounded memory.
+package dedupe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/internal/msgutil"
+	"github.com/emersion/go-mbox/internal/spool"
+)
+
+// Key selects how duplicates are identified.
+type Key int
+
+const (
+	// KeyMessageID identifies duplicates by Message-ID. Messages without a
+	// Message-ID are never duplicates.
+	KeyMessageID Key = iota
+	// KeyContent identifies duplicates by a hash of their content, ignoring
+	// header fields added on delivery, see IgnoredFields.
+	KeyContent
+	// KeyMessageIDAndContent identifies duplicates by both Message-ID and
+	// content: messages are duplicates only if both are the same. As with
+	// KeyMessageID, messages without a Message-ID are never duplicates, even
+	// if their content is the same.
+	KeyMessageIDAndContent
+)
+
+// IgnoredFields are the header fields ignored when hashing message content.
+// They are added or modified on delivery or by mail clients.
+var IgnoredFields = []string{
+	"Received",
+	"Return-Path",
+	"Delivered-To",
+	"Content-Length",
+	"Status",
+	"X-Status",
+	"X-Keywords",
+	"X-UID",
+	"X-Mozilla-Status",
+	"X-Mozilla-Status2",
+	"X-Mozilla-Keys",
+}
+
+const (
+	// defaultMaxMemory is the default value of Options.MaxMemory.
+	defaultMaxMemory = 64 << 20
+	// entrySize is an estimate of the memory used by an in-memory entry of
+	// the set of seen messages.
+	entrySize = 64
+	// maxMessageMemory is the number of bytes of a message buffered in
+	// memory before it's spilled to a temporary file.
+	maxMessageMemory = 10 << 20
+)
+
+// Options contains options for Dedupe.
+type Options struct {
+	// Key selects how duplicates are identified.
+	Key Key
+	// MaxMemory is the approximate number of bytes used to remember seen
+	// messages before spilling them to a temporary file. Zero means a default
+	// of 64 MiB.
+	MaxMemory int64
+	// TempDir is the directory where temporary files are created. Defaults
+	// to os.TempDir.
+	TempDir string
+	// Dropped, if not nil, is called for each dropped message.
+	Dropped func(d *Duplicate)
+}
+
+// Duplicate describes a dropped message.
+type Duplicate struct {
+	// Index is the index of the message in the input.
+	Index int
+	// Offset is the offset of the message in the input.
+	Offset int64
+	// Original is the index of the first message it's a duplicate of.
+	Original int
+	// FromLine is the From line of the message.
+	FromLine string
+	// MessageID is the Message-ID of the message, if any.
+	MessageID string
+}
+
+// Result contains statistics about a Dedupe run.
+type Result struct {
+	// Messages is the number of messages read.
+	Messages int
+	// Dropped is the number of dropped duplicates.
+	Dropped int
+}
+
+// Dedupe reads messages from r and writes them to w, dropping duplicates. The
+// first occurrence of a message is kept. The From line and the text of kept
+// messages are preserved.
+func Dedupe(w *mbox.Writer, r *mbox.Reader, options *Options) (*Result, error) {
+	if options == nil {
+		options = new(Options)
+	}
+	maxMemory := options.MaxMemory
+	if maxMemory <= 0 {
+		maxMemory = defaultMaxMemory
+	}
+	set := newKeySet(int(maxMemory/entrySize), options.TempDir)
+	defer set.close()
+
+	res := new(Result)
+	for i := 0; ; i++ {
+		msg, err := r.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return res, err
+		}
+		res.Messages++
+
+		d, err := dedupeMessage(w, r, msg, set, i, options.Key)
+		if err != nil {
+			return res, err
+		}
+		if d != nil {
+			res.Dropped++
+			if options.Dropped != nil {
+				options.Dropped(d)
+			}
+		}
+	}
+	return res, nil
+}
+
+// dedupeMessage writes a message to w unless it's a duplicate, in which case
+// the duplicate is returned.
+func dedupeMessage(w *mbox.Writer, r *mbox.Reader, msg io.Reader, set *keySet, index int, k Key) (*Duplicate, error) {
+	br := bufio.NewReader(msg)
+	hdr, err := msgutil.ReadHeader(br)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	hdr = bytes.Replace(hdr, []byte("\r\n"), []byte("\n"), -1)
+
+	h := mail.Header{}
+	if m, err := mail.ReadMessage(bytes.NewReader(hdr)); err == nil {
+		h = m.Header
+	}
+	id := strings.TrimSpace(h.Get("Message-Id"))
+
+	d := &Duplicate{
+		Index:     index,
+		Offset:    r.Offset(),
+		FromLine:  r.FromLine(),
+		MessageID: id,
+	}
+
+	if k == KeyMessageID {
+		// The body isn't needed to find out whether this is a duplicate
+		if id != "" {
+			if dup, err := d.check(set, hashKey(sha256.New(), "id:"+id)); err != nil || dup {
+				return d, err
+			}
+		}
+		return nil, writeMessage(w, d.FromLine, h, hdr, br)
+	}
+
+	if k == KeyMessageIDAndContent && id == "" {
+		return nil, writeMessage(w, d.FromLine, h, hdr, br)
+	}
+
+	// Spool the message while hashing its content
+	s := &spool.Spool{Max: maxMessageMemory}
+	defer s.Close()
+
+	hasher := sha256.New()
+	if k == KeyMessageIDAndContent {
+		io.WriteString(hasher, "id:"+id+"\n")
+	}
+	hasher.Write(msgutil.StripFields(hdr, IgnoredFields...))
+	lw := msgutil.NewLFWriter(io.MultiWriter(s, hasher))
+	if _, err := io.Copy(lw, br); err != nil {
+		return nil, err
+	}
+	if err := lw.Flush(); err != nil {
+		return nil, err
+	}
+
+	if dup, err := d.check(set, hashKey(hasher, "")); err != nil || dup {
+		return d, err
+	}
+
+	body, err := s.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return nil, writeMessage(w, d.FromLine, h, hdr, body)
+}
+
+// hashKey returns the key for the data written to hasher and s.
+func hashKey(hasher hash.Hash, s string) key {
+	io.WriteString(hasher, s)
+	var k key
+	copy(k[:], hasher.Sum(nil))
+	if k == (key{}) {
+		k[0] = 1
+	}
+	return k
+}
+
+// check adds the message key to the set. It returns true if the message is a
+// duplicate.
+func (d *Duplicate) check(set *keySet, k key) (bool, error) {
+	orig, dup, err := set.add(k, uint64(d.Index))
+	if err != nil {
+		return false, err
+	}
+	d.Original = int(orig)
+	return dup, nil
+}
+
+// writeMessage writes a message to w. hdr has LF line endings, body may have
+// CRLF line endings.
+func writeMessage(w *mbox.Writer, fromLine string, h mail.Header, hdr []byte, body io.Reader) error {
+	var mw io.WriteCloser
+	var err error
+	if fromLine != "" {
+		mw, err = w.CreateMessageFromLine(fromLine)
+	} else {
+		from, t := mbox.HeaderEnvelope(h)
+		mw, err = w.CreateMessage(from, t)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := mw.Write(hdr); err != nil {
+		return err
+	}
+	lw := msgutil.NewLFWriter(mw)
+	if _, err := io.Copy(lw, body); err != nil {
+		return err
+	}
+	if err := lw.Flush(); err != nil {
+		return err
+	}
+	return mw.Close()
+}
@@ -0,0 +1,147 @@
+package dedupe
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-mbox"
+)
+
+var testMessages = []string{
+	"From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Message-ID: <1@example.com>\nSubject: First\n\nHello.\n\n",
+	"From herp.derp@example.com Thu Jan  1 00:00:02 2015\n" +
+		"Received: from mx.example.org by mx.example.com\n" +
+		"Message-ID: <1@example.com>\nSubject: First\nStatus: RO\n\nHello.\n\n",
+	"From herp.derp@example.com Thu Jan  1 00:00:03 2015\n" +
+		"Message-ID: <1@example.com>\nSubject: First, edited\n\nHello!\n\n",
+	"From derp.herp@example.com Thu Jan  1 00:00:04 2015\n" +
+		"Subject: No Message-ID\n\nHi.\n\n",
+	"From derp.herp@example.com Thu Jan  1 00:00:05 2015\n" +
+		"Subject: No Message-ID\n\nHi.\n\n",
+}
+
+var testMbox = strings.Join(testMessages, "")
+
+func testDedupe(t *testing.T, in string, options *Options) (string, []int) {
+	var dropped []int
+	options.Dropped = func(d *Duplicate) {
+		dropped = append(dropped, d.Index)
+	}
+
+	var buf bytes.Buffer
+	w := mbox.NewWriter(&buf)
+	res, err := Dedupe(w, mbox.NewReader(strings.NewReader(in)), options)
+	if err != nil {
+		t.Fatalf("Dedupe() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if res.Dropped != len(dropped) {
+		t.Errorf("Result.Dropped = %v, want %v", res.Dropped, len(dropped))
+	}
+	return buf.String(), dropped
+}
+
+func TestDedupe(t *testing.T) {
+	tests := []struct {
+		key     Key
+		dropped []int
+	}{
+		{KeyMessageID, []int{1, 2}},
+		{KeyContent, []int{1, 4}},
+		{KeyMessageIDAndContent, []int{1}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.key), func(t *testing.T) {
+			out, dropped := testDedupe(t, testMbox, &Options{Key: test.key})
+			if !reflect.DeepEqual(dropped, test.dropped) {
+				t.Errorf("dropped = %v, want %v", dropped, test.dropped)
+			}
+
+			var want string
+			j := 0
+			for i, msg := range testMessages {
+				if j < len(test.dropped) && test.dropped[j] == i {
+					j++
+					continue
+				}
+				want += msg
+			}
+			if out != want {
+				t.Errorf("Dedupe() = \n%v\nwant:\n%v", out, want)
+			}
+		})
+	}
+}
+
+func TestDedupe_duplicate(t *testing.T) {
+	var got []Duplicate
+	options := &Options{Dropped: func(d *Duplicate) {
+		got = append(got, *d)
+	}}
+	w := mbox.NewWriter(ioutil.Discard)
+	if _, err := Dedupe(w, mbox.NewReader(strings.NewReader(testMbox)), options); err != nil {
+		t.Fatalf("Dedupe() = %v", err)
+	}
+
+	offset := int64(strings.Index(testMbox, "From herp.derp@example.com Thu Jan  1 00:00:02 2015"))
+	want := Duplicate{
+		Index:     1,
+		Offset:    offset,
+		Original:  0,
+		FromLine:  "From herp.derp@example.com Thu Jan  1 00:00:02 2015",
+		MessageID: "<1@example.com>",
+	}
+	if len(got) != 2 || got[0] != want {
+		t.Errorf("Dropped got %v, want first %v", got, want)
+	}
+}
+
+func TestDedupe_disk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedupe-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const n = 3000
+	var sb strings.Builder
+	for i := 0; i < 2*n; i++ {
+		fmt.Fprintf(&sb, "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n")
+		fmt.Fprintf(&sb, "Message-ID: <%v@example.com>\n\nHi.\n\n", i%n)
+	}
+
+	var buf bytes.Buffer
+	w := mbox.NewWriter(&buf)
+	originals := make(map[int]int)
+	options := &Options{
+		MaxMemory: 100 * entrySize,
+		TempDir:   dir,
+		Dropped: func(d *Duplicate) {
+			originals[d.Index] = d.Original
+		},
+	}
+	res, err := Dedupe(w, mbox.NewReader(strings.NewReader(sb.String())), options)
+	if err != nil {
+		t.Fatalf("Dedupe() = %v", err)
+	}
+	if res.Messages != 2*n || res.Dropped != n {
+		t.Errorf("Dedupe() = %+v, want %v messages and %v dropped", res, 2*n, n)
+	}
+	for i := n; i < 2*n; i++ {
+		if originals[i] != i-n {
+			t.Fatalf("message %v: original = %v, want %v", i, originals[i], i-n)
+		}
+	}
+
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Errorf("%v temporary files left", len(names))
+	}
+}
@@ -0,0 +1,187 @@
+package dedupe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// key identifies a message. Zero keys are never used, since zero slots are
+// empty in a diskSet.
+type key [16]byte
+
+// keySet is a set of keys, each associated to the index of the message it was
+// first seen in. It's kept in memory until it grows larger than max entries,
+// then spilled to a diskSet.
+type keySet struct {
+	max     int
+	tempDir string
+	mem     map[key]uint64
+	disk    *diskSet
+}
+
+func newKeySet(max int, tempDir string) *keySet {
+	return &keySet{max: max, tempDir: tempDir, mem: make(map[key]uint64)}
+}
+
+// add adds a key to the set. If the key is already in the set, the index it
+// was added with is returned.
+func (s *keySet) add(k key, index uint64) (uint64, bool, error) {
+	if s.disk != nil {
+		return s.disk.add(k, index)
+	}
+	if prev, ok := s.mem[k]; ok {
+		return prev, true, nil
+	}
+	if len(s.mem) < s.max {
+		s.mem[k] = index
+		return 0, false, nil
+	}
+
+	slots := uint64(minDiskSlots)
+	for slots < 4*uint64(len(s.mem)) {
+		slots *= 2
+	}
+	ds, err := newDiskSet(s.tempDir, slots)
+	if err != nil {
+		return 0, false, err
+	}
+	for k, v := range s.mem {
+		if _, _, err := ds.add(k, v); err != nil {
+			ds.close()
+			return 0, false, err
+		}
+	}
+	s.disk = ds
+	s.mem = nil
+	return ds.add(k, index)
+}
+
+func (s *keySet) close() error {
+	if s.disk != nil {
+		return s.disk.close()
+	}
+	return nil
+}
+
+const (
+	slotSize     = len(key{}) + 8
+	minDiskSlots = 1024
+	pageSlots    = 128
+)
+
+// diskSet is an open-addressing hash table stored in a temporary file. Each
+// slot contains a key and an index. The table is grown when it's half full.
+type diskSet struct {
+	dir   string
+	f     *os.File
+	slots uint64
+	count uint64
+	page  []byte
+}
+
+func newDiskSet(dir string, slots uint64) (*diskSet, error) {
+	f, err := ioutil.TempFile(dir, "mbox-dedupe-")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(slots) * int64(slotSize)); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &diskSet{
+		dir:   dir,
+		f:     f,
+		slots: slots,
+		page:  make([]byte, pageSlots*slotSize),
+	}, nil
+}
+
+func (ds *diskSet) add(k key, index uint64) (uint64, bool, error) {
+	if 2*(ds.count+1) > ds.slots {
+		if err := ds.grow(); err != nil {
+			return 0, false, err
+		}
+	}
+
+	i := binary.LittleEndian.Uint64(k[:8]) & (ds.slots - 1)
+	for {
+		n := ds.slots - i
+		if n > pageSlots {
+			n = pageSlots
+		}
+		page := ds.page[:n*uint64(slotSize)]
+		if _, err := ds.f.ReadAt(page, int64(i)*int64(slotSize)); err != nil {
+			return 0, false, err
+		}
+
+		for j := uint64(0); j < n; j++ {
+			slot := page[j*uint64(slotSize) : (j+1)*uint64(slotSize)]
+			var sk key
+			copy(sk[:], slot)
+			if sk == k {
+				return binary.LittleEndian.Uint64(slot[len(sk):]), true, nil
+			}
+			if sk == (key{}) {
+				copy(slot, k[:])
+				binary.LittleEndian.PutUint64(slot[len(k):], index)
+				if _, err := ds.f.WriteAt(slot, int64(i+j)*int64(slotSize)); err != nil {
+					return 0, false, err
+				}
+				ds.count++
+				return 0, false, nil
+			}
+		}
+
+		i = (i + n) & (ds.slots - 1)
+	}
+}
+
+// grow doubles the number of slots.
+func (ds *diskSet) grow() error {
+	bigger, err := newDiskSet(ds.dir, 2*ds.slots)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ds.f.Seek(0, io.SeekStart); err != nil {
+		bigger.close()
+		return err
+	}
+	br := bufio.NewReader(ds.f)
+	slot := make([]byte, slotSize)
+	for i := uint64(0); i < ds.slots; i++ {
+		if _, err := io.ReadFull(br, slot); err != nil {
+			bigger.close()
+			return err
+		}
+		var k key
+		copy(k[:], slot)
+		if k == (key{}) {
+			continue
+		}
+		if _, _, err := bigger.add(k, binary.LittleEndian.Uint64(slot[len(k):])); err != nil {
+			bigger.close()
+			return err
+		}
+	}
+
+	if err := ds.close(); err != nil {
+		bigger.close()
+		return err
+	}
+	*ds = *bigger
+	return nil
+}
+
+// close removes the temporary file.
+func (ds *diskSet) close() error {
+	err := ds.f.Close()
+	if rmErr := os.Remove(ds.f.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
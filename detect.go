@@ -0,0 +1,223 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+// DetectSize is the number of bytes of the beginning of an archive sampled by
+// NewAutoReader to detect its format.
+const DetectSize = 64 << 10
+
+// detectSamples is the number of samples of the body of an archive read by
+// DetectFormatAt, in addition to its beginning.
+const detectSamples = 8
+
+// isHeaderLine checks whether a line looks like the first line of a header
+// field.
+func isHeaderLine(l []byte) bool {
+	i := bytes.IndexByte(l, ':')
+	if i <= 0 {
+		return false
+	}
+	for _, c := range l[:i] {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// DetectFormat guesses the format of an mbox archive from a sample of its
+// beginning. It returns the most likely format along with a confidence between
+// 0 and 1. The larger the sample, the more reliable the result.
+//
+// MMDF is detected with a confidence of 0.99 from its leading delimiter line,
+// and FormatMessage with 0.9 from a leading header field. mboxcl2 is detected
+// with 0.9 if all the messages in the sample have a valid Content-Length
+// header field. If the sample doesn't start with a From line, FormatMboxo is
+// returned with 0.1, and with 0 if the sample is empty.
+//
+// Otherwise, mboxo and mboxrd only differ in how lines starting with ">From "
+// are escaped, see escapeFormat.
+func DetectFormat(b []byte) (Format, float64) {
+	b = bytes.TrimLeft(b, "\r\n")
+	if len(b) == 0 {
+		return FormatMboxo, 0
+	}
+
+	if bytes.HasPrefix(b, mmdfDelimiter) {
+		return FormatMMDF, 0.99
+	}
+
+	if !bytes.HasPrefix(b, header) {
+		firstLine := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			firstLine = b[:i]
+		}
+		if isHeaderLine(firstLine) {
+			return FormatMessage, 0.9
+		}
+		return FormatMboxo, 0.1
+	}
+
+	if isMboxcl2(b) {
+		return FormatMboxcl2, 0.9
+	}
+
+	return escapeFormat(countEscaped(b))
+}
+
+// countEscaped counts the lines of b starting with ">From ", and those
+// starting with ">>From " or more quotes.
+func countEscaped(b []byte) (escaped, doubleEscaped int) {
+	for _, l := range bytes.Split(b, []byte("\n")) {
+		i := 0
+		for i < len(l) && l[i] == '>' {
+			i++
+		}
+		if i == 0 || !bytes.HasPrefix(l[i:], header) {
+			continue
+		}
+		if i == 1 {
+			escaped++
+		} else {
+			doubleEscaped++
+		}
+	}
+	return escaped, doubleEscaped
+}
+
+// escapeFormat chooses between mboxo and mboxrd from the lines counted by
+// countEscaped.
+//
+// mboxo doesn't escape ">From " lines: ">>From " lines only appear if they were
+// already in the original messages, which is rare. The confidence for mboxrd
+// is between 0.6 and 1, depending on the proportion of ">>From " lines.
+//
+// Both formats escape "From " lines the same way, so ">From " lines alone are
+// weak evidence for mboxo: an mboxrd archive would also contain ">>From " lines
+// if the original messages had ">From " lines. The confidence for mboxo grows
+// from 0.5 with a single ">From " line towards 0.8 with many.
+//
+// Without any escaped line, both formats are equivalent for the sample and
+// mboxo is returned with a confidence of 0.7.
+func escapeFormat(escaped, doubleEscaped int) (Format, float64) {
+	switch {
+	case doubleEscaped > 0:
+		return FormatMboxrd, 0.6 + 0.4*float64(doubleEscaped)/float64(escaped+doubleEscaped)
+	case escaped > 0:
+		return FormatMboxo, 0.8 - 0.3/float64(escaped)
+	default:
+		return FormatMboxo, 0.7
+	}
+}
+
+// DetectFormatAt is like DetectFormat, but reads its sample from r, an archive
+// of size bytes. In addition to the beginning of the archive, it samples its
+// body at evenly spaced offsets, so that ">>From " lines appearing late in a
+// large archive are taken into account to distinguish mboxo from mboxrd. The
+// other formats are detected from the beginning only.
+func DetectFormatAt(r io.ReaderAt, size int64) (Format, float64, error) {
+	b, err := readSample(r, 0, size)
+	if err != nil {
+		return 0, 0, err
+	}
+	format, confidence := DetectFormat(b)
+	isMbox := bytes.HasPrefix(bytes.TrimLeft(b, "\r\n"), header)
+	if format != FormatMboxo && format != FormatMboxrd || !isMbox || size <= DetectSize {
+		return format, confidence, nil
+	}
+
+	escaped, doubleEscaped := countEscaped(b)
+	step := (size - DetectSize) / detectSamples
+	if step < DetectSize {
+		step = DetectSize
+	}
+	for off := int64(DetectSize); off < size; off += step {
+		b, err := readSample(r, off, size)
+		if err != nil {
+			return 0, 0, err
+		}
+		// Skip the partial first line
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[i+1:]
+		} else {
+			continue
+		}
+		e, d := countEscaped(b)
+		escaped += e
+		doubleEscaped += d
+	}
+	format, confidence = escapeFormat(escaped, doubleEscaped)
+	return format, confidence, nil
+}
+
+func readSample(r io.ReaderAt, off, size int64) ([]byte, error) {
+	n := size - off
+	if n > DetectSize {
+		n = DetectSize
+	}
+	b := make([]byte, n)
+	n2, err := r.ReadAt(b, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return b[:n2], err
+}
+
+// isMboxcl2 checks whether all messages in the sample have a Content-Length
+// header field pointing to the next From line.
+func isMboxcl2(b []byte) bool {
+	n := 0
+	for len(b) > 0 {
+		// Skip the From line
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			break
+		}
+		b = b[i+1:]
+
+		hdr, err := msgutil.ReadHeader(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			return false
+		}
+		fields, blank := msgutil.SplitHeader(hdr)
+		if blank == nil {
+			// Truncated sample
+			break
+		}
+		length, ok := contentLength(fields)
+		if !ok {
+			return false
+		}
+		n++
+
+		b = b[len(hdr):]
+		if int64(len(b)) < length {
+			// Truncated sample
+			break
+		}
+		b = bytes.TrimLeft(b[length:], "\r\n")
+		if len(b) > 0 && !bytes.HasPrefix(b, header) {
+			return false
+		}
+	}
+	return n > 0
+}
+
+// NewAutoReader returns a new Reader to read messages from r, with its format
+// detected by DetectFormat from a sample of the beginning of the data.
+func NewAutoReader(r io.Reader) (*Reader, error) {
+	cr := &countingReader{r: r}
+	mr := &Reader{r: bufio.NewReaderSize(cr, DetectSize), cr: cr}
+	b, err := mr.r.Peek(DetectSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	mr.Format, _ = DetectFormat(b)
+	return mr, nil
+}
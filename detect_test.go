@@ -0,0 +1,153 @@
+package mbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const mboxrdWithQuotedFrom = `From herp.derp@example.com Thu Jan  1 00:00:01 2015
+Subject: Test
+
+>From the start.
+>>From a quoted message.
+
+`
+
+const mboxcl2WithFrom = `From herp.derp@example.com Thu Jan  1 00:00:01 2015
+Subject: Test
+Content-Length: 16
+
+From the start.
+
+From derp.herp@example.com Thu Jan  1 00:00:01 2015
+Subject: Another test
+Content-Length: 5
+
+Bye.
+`
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		mbox   string
+		format Format
+	}{
+		{mboxWithThreeMessages, FormatMboxo},
+		{mboxWithStartingLF, FormatMboxo},
+		{mboxrdWithQuotedFrom, FormatMboxrd},
+		{mboxcl2WithFrom, FormatMboxcl2},
+		{"\x01\x01\x01\x01\nSubject: Test\n\nHi.\n\x01\x01\x01\x01\n", FormatMMDF},
+		{"From: herp.derp@example.com\nSubject: Test\n\nHi.\n", FormatMessage},
+		{"", FormatMboxo},
+	}
+
+	for _, test := range tests {
+		format, confidence := DetectFormat([]byte(test.mbox))
+		if format != test.format {
+			t.Errorf("DetectFormat(%q) = %v, want %v", test.mbox, format, test.format)
+		}
+		if confidence < 0 || confidence > 1 {
+			t.Errorf("DetectFormat(%q) returned confidence %v", test.mbox, confidence)
+		}
+
+		mr, err := NewAutoReader(strings.NewReader(test.mbox))
+		if err != nil {
+			t.Fatalf("NewAutoReader() = %v", err)
+		}
+		if mr.Format != test.format {
+			t.Errorf("NewAutoReader(%q) detected %v, want %v", test.mbox, mr.Format, test.format)
+		}
+	}
+}
+
+func TestDetectFormat_confidence(t *testing.T) {
+	const from = "From herp.derp@example.com Thu Jan  1 00:00:01 2015\nSubject: Test\n\n"
+	tests := []struct {
+		mbox       string
+		format     Format
+		confidence float64
+	}{
+		{"", FormatMboxo, 0},
+		{"Not an mbox archive.\n", FormatMboxo, 0.1},
+		{"\x01\x01\x01\x01\n", FormatMMDF, 0.99},
+		{"Subject: Test\n\nHi.\n", FormatMessage, 0.9},
+		{mboxcl2WithFrom, FormatMboxcl2, 0.9},
+		{from + "Hi.\n", FormatMboxo, 0.7},
+		{from + ">From here.\n", FormatMboxo, 0.5},
+		{from + strings.Repeat(">From here.\n", 3), FormatMboxo, 0.7},
+		{from + ">>From here.\n", FormatMboxrd, 1},
+		{from + ">From here.\n>>From there.\n", FormatMboxrd, 0.8},
+	}
+
+	for _, test := range tests {
+		format, confidence := DetectFormat([]byte(test.mbox))
+		if format != test.format || confidence < test.confidence-0.001 || confidence > test.confidence+0.001 {
+			t.Errorf("DetectFormat(%q) = %v, %v, want %v, %v", test.mbox, format, confidence, test.format, test.confidence)
+		}
+	}
+
+	// More ">From " lines without ">>From " lines are more likely to be mboxo
+	_, few := DetectFormat([]byte(from + ">From here.\n"))
+	_, many := DetectFormat([]byte(from + strings.Repeat(">From here.\n", 100)))
+	if many <= few || many > 0.8 {
+		t.Errorf("DetectFormat() confidence = %v with 100 escaped lines, %v with 1", many, few)
+	}
+}
+
+func TestDetectFormatAt(t *testing.T) {
+	// A large mboxrd archive with the only ">>From " line far from its
+	// beginning
+	var b bytes.Buffer
+	b.WriteString("From herp.derp@example.com Thu Jan  1 00:00:01 2015\nSubject: Test\n\n>From the start.\n")
+	for b.Len() < 4*DetectSize {
+		b.WriteString("Some padding text.\n")
+	}
+	b.WriteString(">>From a quoted message.\n")
+	for b.Len() < 8*DetectSize {
+		b.WriteString("Some padding text.\n")
+	}
+	b.WriteString("\n")
+
+	if format, _ := DetectFormat(b.Bytes()[:DetectSize]); format != FormatMboxo {
+		t.Fatalf("DetectFormat() on the beginning = %v, want %v", format, FormatMboxo)
+	}
+
+	format, confidence, err := DetectFormatAt(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("DetectFormatAt() = %v", err)
+	}
+	if format != FormatMboxrd || confidence < 0.6 || confidence > 1 {
+		t.Errorf("DetectFormatAt() = %v, %v, want %v", format, confidence, FormatMboxrd)
+	}
+
+	// Other formats are detected from the beginning
+	format, _, err = DetectFormatAt(strings.NewReader(mboxcl2WithFrom), int64(len(mboxcl2WithFrom)))
+	if err != nil || format != FormatMboxcl2 {
+		t.Errorf("DetectFormatAt() = %v, %v, want %v", format, err, FormatMboxcl2)
+	}
+}
+
+func TestNewAutoReader_message(t *testing.T) {
+	mr, err := NewAutoReader(strings.NewReader("From: herp.derp@example.com\nSubject: Test\n\nFrom the body.\n"))
+	if err != nil {
+		t.Fatalf("NewAutoReader() = %v", err)
+	}
+
+	r, err := mr.NextMessage()
+	if err != nil {
+		t.Fatalf("NextMessage() = %v", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From: herp.derp@example.com\r\nSubject: Test\r\n\r\nFrom the body.\r\n"
+	if string(b) != want {
+		t.Errorf("Message:\n%q\nexpected:\n%q", b, want)
+	}
+
+	if _, err := mr.NextMessage(); err == nil {
+		t.Errorf("NextMessage() returned a second message")
+	}
+}
@@ -0,0 +1,255 @@
+// Package eml converts between mbox archives and directories of .eml files,
+// one file per message.
+package eml
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+// LineEnding is a line ending convention.
+type LineEnding int
+
+const (
+	// CRLF line endings, as used on the wire and expected by most .eml
+	// consumers.
+	CRLF LineEnding = iota
+	// LF line endings.
+	LF
+)
+
+// String implements fmt.Stringer.
+func (le LineEnding) String() string {
+	switch le {
+	case CRLF:
+		return "CRLF"
+	case LF:
+		return "LF"
+	default:
+		return fmt.Sprintf("LineEnding(%d)", int(le))
+	}
+}
+
+// Options are options for Export.
+type Options struct {
+	// LineEnding is the line ending of the written files. Defaults to CRLF.
+	LineEnding LineEnding
+}
+
+// maxIDLen is the maximum length of the Message-ID part of file names.
+const maxIDLen = 100
+
+// Name returns the name of the .eml file of a message, made of the message
+// number (starting from 1) and its sanitized Message-ID, if any. For
+// instance, the third message with the Message-ID <abc@example.com> is named
+// "000003-abc@example.com.eml". Message numbers are padded to six digits, so
+// names only sort in message order up to message 999999; Import compares the
+// message numbers instead.
+func Name(index int, messageID string) string {
+	id := strings.Trim(strings.TrimSpace(messageID), "<>")
+	id = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7F || strings.ContainsRune(`/\<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, id)
+	id = strings.TrimLeft(id, ".")
+	if n := maxIDLen; len(id) > n {
+		for n > 0 && !utf8.RuneStart(id[n]) {
+			n--
+		}
+		id = id[:n]
+	}
+
+	name := fmt.Sprintf("%06d", index+1)
+	if id != "" {
+		name += "-" + id
+	}
+	return name + ".eml"
+}
+
+// Export writes each message read from r to a .eml file in dir, which is
+// created if it doesn't exist, see Name. It fails if a file already exists.
+// It returns the number of messages written.
+//
+// The envelope sender is stored in a Return-Path header field if the message
+// doesn't have one, and the file modification time is set to the envelope
+// date.
+func Export(dir string, r *mbox.Reader, options *Options) (int, error) {
+	if options == nil {
+		options = new(Options)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	for i := 0; ; i++ {
+		mr, err := r.NextMessage()
+		if err == io.EOF {
+			return i, nil
+		} else if err != nil {
+			return i, err
+		}
+
+		if err := export(dir, i, r.FromLine(), mr, options); err != nil {
+			return i, err
+		}
+	}
+}
+
+func export(dir string, index int, fromLine string, r io.Reader, options *Options) error {
+	br := bufio.NewReader(r)
+	hdr, err := msgutil.ReadHeader(br)
+	if err != nil {
+		return err
+	}
+	sender, date, _ := mbox.ParseFromLine(fromLine)
+	var messageID string
+	if m, err := mail.ReadMessage(bytes.NewReader(hdr)); err == nil {
+		messageID = m.Header.Get("Message-Id")
+		if m.Header.Get("Return-Path") == "" {
+			hdr = append([]byte(msgutil.ReturnPathField(sender)), hdr...)
+		}
+	}
+
+	path := filepath.Join(dir, Name(index, messageID))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	var w interface {
+		io.Writer
+		Flush() error
+	}
+	switch options.LineEnding {
+	case LF:
+		w = msgutil.NewLFWriter(f)
+	default:
+		w = msgutil.NewCRLFWriter(f)
+	}
+	_, err = w.Write(hdr)
+	if err == nil {
+		_, err = io.Copy(w, br)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !date.IsZero() {
+		err = os.Chtimes(path, date, date)
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Import writes the .eml files of dir to w. Files are sorted by the number
+// their name starts with, if any, and then by name, so that files written by
+// Export are imported in message order. It returns the number of messages
+// written.
+//
+// The envelope sender and date are derived from the header, see
+// mbox.HeaderEnvelope. If the date can't be derived, the file modification
+// time is used. Files can have CRLF or LF line endings.
+func Import(w *mbox.Writer, dir string) (int, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, fi := range infos {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || strings.HasPrefix(name, ".") || !strings.EqualFold(filepath.Ext(name), ".eml") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return lessName(names[i], names[j])
+	})
+
+	for i, name := range names {
+		if err := importFile(w, filepath.Join(dir, name)); err != nil {
+			return i, err
+		}
+	}
+	return len(names), nil
+}
+
+// lessName compares file names by the number they start with, then by name.
+// Names without a number sort last.
+func lessName(a, b string) bool {
+	na, nb := leadingNumber(a), leadingNumber(b)
+	switch {
+	case (na == "") != (nb == ""):
+		return na != ""
+	case len(na) != len(nb):
+		return len(na) < len(nb)
+	case na != nb:
+		return na < nb
+	}
+	return a < b
+}
+
+// leadingNumber returns the digits a name starts with, without leading zeros.
+// It returns "0" for a name starting with zeros only, and an empty string for
+// a name not starting with a digit.
+func leadingNumber(name string) string {
+	i := 0
+	for i < len(name) && name[i] >= '0' && name[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return ""
+	}
+	n := strings.TrimLeft(name[:i], "0")
+	if n == "" {
+		n = "0"
+	}
+	return n
+}
+
+func importFile(w *mbox.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	hdr, err := msgutil.ReadHeader(br)
+	if err != nil {
+		return err
+	}
+
+	var h mail.Header
+	if m, err := mail.ReadMessage(bytes.NewReader(hdr)); err == nil {
+		h = m.Header
+	}
+	from, t := mbox.HeaderEnvelope(h)
+	if t.IsZero() {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		t = fi.ModTime()
+	}
+
+	return w.WriteMessage(from, t, io.MultiReader(bytes.NewReader(hdr), br))
+}
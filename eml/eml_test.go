@@ -0,0 +1,198 @@
+package eml
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-mbox"
+)
+
+const testMbox = `From herp.derp@example.com Thu Jan  1 00:00:01 2015
+From: herp.derp@example.com (Herp Derp)
+Message-ID: <1@example.com>
+Subject: First
+
+>From the top.
+
+From derp.herp@example.com Fri Jan  2 00:00:01 2015
+Return-Path: <bounces@example.com>
+From: derp.herp@example.com (Derp Herp)
+Message-ID: <a/b:c@example.com>
+Subject: Second
+
+Hi.
+
+From MAILER-DAEMON Sat Jan  3 00:00:01 2015
+From: MAILER-DAEMON@example.com
+Subject: No Message-ID
+
+Bounce.
+
+`
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		index int
+		id    string
+		want  string
+	}{
+		{0, "<1@example.com>", "000001-1@example.com.eml"},
+		{41, " <a/b:c d@example.com> ", "000042-a_b_c_d@example.com.eml"},
+		{2, "<../../passwd>", "000003-_.._passwd.eml"},
+		{9, "", "000010.eml"},
+	}
+	for _, test := range tests {
+		if got := Name(test.index, test.id); got != test.want {
+			t.Errorf("Name(%v, %q) = %q, want %q", test.index, test.id, got, test.want)
+		}
+	}
+}
+
+func TestImport_order(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox-eml-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Names written by Export past message 999999 don't sort in message order
+	indexes := []int{1000000, 999998, 9, 999999}
+	for _, i := range indexes {
+		text := fmt.Sprintf("Subject: %v\n\nHi.\n", i+1)
+		if err := ioutil.WriteFile(filepath.Join(dir, Name(i, "")), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.eml"), []byte("Subject: other\n\nHi.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w := mbox.NewWriter(&buf)
+	if _, err := Import(w, dir); err != nil {
+		t.Fatalf("Import() = %v", err)
+	}
+	w.Close()
+
+	var got []string
+	r := mbox.NewReader(&buf)
+	for {
+		mr, err := r.NextMessage()
+		if err != nil {
+			break
+		}
+		m, err := mail.ReadMessage(mr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m.Header.Get("Subject"))
+	}
+	want := []string{"10", "999999", "1000000", "1000001", "other"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Import() order = %v, want %v", got, want)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, le := range []LineEnding{CRLF, LF} {
+		t.Run(le.String(), func(t *testing.T) {
+			testRoundTrip(t, le)
+		})
+	}
+}
+
+func testRoundTrip(t *testing.T, le LineEnding) {
+	dir, err := ioutil.TempDir("", "eml-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n, err := Export(dir, mbox.NewReader(strings.NewReader(testMbox)), &Options{LineEnding: le})
+	if err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Export() = %v, want 3", n)
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "*"))
+	var names []string
+	for _, p := range paths {
+		names = append(names, filepath.Base(p))
+	}
+	wantNames := []string{"000001-1@example.com.eml", "000002-a_b_c@example.com.eml", "000003.eml"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("files = %v, want %v", names, wantNames)
+	}
+
+	b, err := ioutil.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Return-Path: <herp.derp@example.com>\n" +
+		"From: herp.derp@example.com (Herp Derp)\n" +
+		"Message-ID: <1@example.com>\n" +
+		"Subject: First\n\nFrom the top.\n"
+	if le == CRLF {
+		want = strings.Replace(want, "\n", "\r\n", -1)
+	}
+	if string(b) != want {
+		t.Errorf("exported message:\n%q\nwant:\n%q", b, want)
+	}
+
+	fi, err := os.Stat(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if date := time.Date(2015, 1, 1, 0, 0, 1, 0, time.UTC); !fi.ModTime().Equal(date) {
+		t.Errorf("modification time = %v, want %v", fi.ModTime(), date)
+	}
+
+	var out bytes.Buffer
+	w := mbox.NewWriter(&out)
+	if n, err := Import(w, dir); err != nil {
+		t.Fatalf("Import() = %v", err)
+	} else if n != 3 {
+		t.Errorf("Import() = %v, want 3", n)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wantMbox := `From herp.derp@example.com Thu Jan  1 00:00:01 2015
+Return-Path: <herp.derp@example.com>
+From: herp.derp@example.com (Herp Derp)
+Message-ID: <1@example.com>
+Subject: First
+
+>From the top.
+
+From bounces@example.com Fri Jan  2 00:00:01 2015
+Return-Path: <bounces@example.com>
+From: derp.herp@example.com (Derp Herp)
+Message-ID: <a/b:c@example.com>
+Subject: Second
+
+Hi.
+
+From MAILER-DAEMON Sat Jan  3 00:00:01 2015
+Return-Path: <>
+From: MAILER-DAEMON@example.com
+Subject: No Message-ID
+
+Bounce.
+
+`
+	if out.String() != wantMbox {
+		t.Errorf("Import() wrote:\n%v\nwant:\n%v", out.String(), wantMbox)
+	}
+}
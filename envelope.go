@@ -0,0 +1,101 @@
+package mbox
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// fromLineLayouts are the date layouts found in From lines. The first one is
+// the layout of asctime(3), used by most implementations.
+var fromLineLayouts = []string{
+	"Mon Jan _2 15:04:05 2006",
+	"Mon Jan _2 15:04:05 -0700 2006",
+	"Mon Jan _2 15:04:05 MST 2006",
+	"Mon Jan _2 15:04:05 2006 -0700",
+	"Mon Jan _2 15:04:05 2006 MST",
+	"Mon Jan _2 15:04 2006",
+	"Mon, _2 Jan 2006 15:04:05 -0700",
+}
+
+// ParseFromLine parses the From line separating messages, with or without
+// the "From " prefix and the line ending. It returns the envelope sender and
+// the delivery date. If the date can't be parsed, the sender is returned along
+// with an error.
+func ParseFromLine(line string) (sender string, date time.Time, err error) {
+	line = strings.TrimRight(line, "\r\n")
+	line = strings.TrimPrefix(line, string(header))
+	line = strings.TrimLeft(line, " ")
+
+	sender = line
+	s := ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		sender, s = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	if sender == "" {
+		return "", time.Time{}, errors.New("mbox: missing sender in From line")
+	}
+
+	// Some implementations append extra information after the date, such as
+	// "remote from <host>"
+	fields := strings.Fields(s)
+	for n := len(fields); n >= 4; n-- {
+		s := strings.Join(fields[:n], " ")
+		for _, layout := range fromLineLayouts {
+			if date, err := time.Parse(layout, s); err == nil {
+				return sender, date, nil
+			}
+		}
+	}
+	return sender, time.Time{}, errors.New("mbox: invalid date in From line")
+}
+
+// HeaderEnvelope derives the envelope sender and date of a message from its
+// header, as done by Writer.WriteMessage. The sender is empty and the date is
+// zero if they can't be derived.
+func HeaderEnvelope(h mail.Header) (sender string, date time.Time) {
+	return envelopeSender(h), envelopeDate(h)
+}
+
+// envelopeSender derives the envelope sender of a message from its header. It
+// uses, in order of preference, the Return-Path, Sender and From fields.
+func envelopeSender(h mail.Header) string {
+	if rp := strings.TrimSpace(h.Get("Return-Path")); rp != "" {
+		if rp == "<>" {
+			// Null reverse-path, used for bounces
+			return "MAILER-DAEMON"
+		}
+		if addr, err := mail.ParseAddress(rp); err == nil {
+			return addr.Address
+		}
+	}
+
+	for _, k := range []string{"Sender", "From"} {
+		addrs, err := h.AddressList(k)
+		if err == nil && len(addrs) > 0 {
+			return addrs[0].Address
+		}
+	}
+
+	return ""
+}
+
+// envelopeDate derives the delivery date of a message from its header. It
+// uses the date of the topmost Received field, falling back to the Date field.
+func envelopeDate(h mail.Header) time.Time {
+	if received := h["Received"]; len(received) > 0 {
+		s := received[0]
+		if i := strings.LastIndexByte(s, ';'); i >= 0 {
+			if t, err := mail.ParseDate(strings.TrimSpace(s[i+1:])); err == nil {
+				return t
+			}
+		}
+	}
+
+	if t, err := h.Date(); err == nil {
+		return t
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,63 @@
+package mbox
+
+import (
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func TestParseFromLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		sender string
+		date   time.Time
+	}{
+		{
+			"From herp.derp@example.com Thu Jan  1 00:00:01 2015",
+			"herp.derp@example.com",
+			time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC),
+		},
+		{
+			"From 1632461782359385342@xxx Sun Apr 28 10:32:11 +0000 2019\n",
+			"1632461782359385342@xxx",
+			time.Date(2019, time.April, 28, 10, 32, 11, 0, time.UTC),
+		},
+		{
+			"MAILER-DAEMON Fri Jan 13 09:30:00 2017 remote from example.org",
+			"MAILER-DAEMON",
+			time.Date(2017, time.January, 13, 9, 30, 0, 0, time.UTC),
+		},
+	}
+
+	for _, test := range tests {
+		sender, date, err := ParseFromLine(test.line)
+		if err != nil {
+			t.Errorf("ParseFromLine(%q) = %v", test.line, err)
+			continue
+		}
+		if sender != test.sender || !date.Equal(test.date) {
+			t.Errorf("ParseFromLine(%q) = %q, %v, want %q, %v", test.line, sender, date, test.sender, test.date)
+		}
+	}
+
+	if sender, _, err := ParseFromLine("From - garbage"); err == nil || sender != "-" {
+		t.Errorf("ParseFromLine() with invalid date = %q, %v", sender, err)
+	}
+}
+
+func TestHeaderEnvelope(t *testing.T) {
+	h := mail.Header{
+		"From":     {"Herp Derp <herp.derp@example.com>"},
+		"Received": {"from mx.example.org by mx.example.com; Thu, 1 Jan 2015 00:00:01 +0000"},
+		"Date":     {"Wed, 31 Dec 2014 23:59:00 +0000"},
+	}
+	sender, date := HeaderEnvelope(h)
+	want := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+	if sender != "herp.derp@example.com" || !date.Equal(want) {
+		t.Errorf("HeaderEnvelope() = %q, %v, want %q, %v", sender, date, "herp.derp@example.com", want)
+	}
+
+	if sender, date := HeaderEnvelope(mail.Header{}); sender != "" || !date.IsZero() {
+		t.Errorf("HeaderEnvelope() on empty header = %q, %v", sender, date)
+	}
+}
@@ -0,0 +1,69 @@
+package mbox
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// FileReader reads messages from an mbox file. The Close method must be called
+// to release the file.
+type FileReader struct {
+	*Reader
+
+	f      *os.File
+	zr     io.ReadCloser
+	lock   *Lock
+	closed bool
+}
+
+// OpenReader opens the mbox file at name for reading. If lock is not nil, a
+// shared lock is held on the file until the FileReader is closed.
+//
+// Compressed files are transparently decompressed, see Decompress.
+func OpenReader(name string, lock *LockOptions) (*FileReader, error) {
+	var (
+		f   *os.File
+		l   *Lock
+		err error
+	)
+	if lock != nil {
+		f, l, err = openLocked(name, os.O_RDONLY, 0, false, lock)
+	} else {
+		f, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fr := &FileReader{f: f, lock: l}
+
+	if fr.zr, _, err = Decompress(f); err != nil {
+		fr.Close()
+		return nil, err
+	}
+	fr.Reader = NewReader(fr.zr)
+	return fr, nil
+}
+
+// Close releases the lock, if any, and closes the file.
+func (fr *FileReader) Close() error {
+	if fr.closed {
+		return errors.New("mbox: FileReader already closed")
+	}
+	fr.closed = true
+
+	var err error
+	if fr.zr != nil {
+		err = fr.zr.Close()
+	}
+	if fr.lock != nil {
+		if unlockErr := fr.lock.Unlock(); err == nil {
+			err = unlockErr
+		}
+	}
+	if closeErr := fr.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,395 @@
+// Package filter selects messages of mbox archives with predicates.
+//
+// Predicates inspect the envelope, the header and the size of messages. They
+// can be combined with And, Or and Not, or parsed from a query with Parse.
+// Bodies are only read to compute the size of messages, if a predicate needs
+// it.
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/internal/msgutil"
+	"github.com/emersion/go-mbox/internal/spool"
+)
+
+// Message is a message inspected by a Predicate.
+type Message struct {
+	// Index is the index of the message in the mbox stream.
+	Index int
+	// Offset is the offset of the message in the mbox stream, see
+	// mbox.Reader.Offset.
+	Offset int64
+	// FromLine is the From line of the message.
+	FromLine string
+	Header   mail.Header
+	// Size is the size of the message text with LF line endings. It's only
+	// set if the predicate contains Larger or Smaller.
+	Size int64
+}
+
+// Sender returns the envelope sender of the message, from its From line or
+// derived from its header.
+func (msg *Message) Sender() string {
+	sender, _, err := mbox.ParseFromLine(msg.FromLine)
+	if err != nil || sender == "" {
+		sender, _ = mbox.HeaderEnvelope(msg.Header)
+	}
+	return sender
+}
+
+// Date returns the envelope date of the message, from its From line or
+// derived from its header. It's zero if unknown.
+func (msg *Message) Date() time.Time {
+	_, date, err := mbox.ParseFromLine(msg.FromLine)
+	if err != nil {
+		_, date = mbox.HeaderEnvelope(msg.Header)
+	}
+	return date
+}
+
+var wordDecoder mime.WordDecoder
+
+// headerValues returns the decoded values of a header field.
+func (msg *Message) headerValues(k string) []string {
+	values := msg.Header[textproto.CanonicalMIMEHeaderKey(k)]
+	l := make([]string, len(values))
+	for i, v := range values {
+		if s, err := wordDecoder.DecodeHeader(v); err == nil {
+			v = s
+		}
+		l[i] = v
+	}
+	return l
+}
+
+// Predicate selects messages.
+type Predicate interface {
+	Match(msg *Message) bool
+}
+
+// sizePredicate is implemented by predicates which need Message.Size.
+type sizePredicate interface {
+	needsSize() bool
+}
+
+func needsSize(p Predicate) bool {
+	sp, ok := p.(sizePredicate)
+	return ok && sp.needsSize()
+}
+
+// PredicateFunc is a Predicate implemented by a function.
+type PredicateFunc func(msg *Message) bool
+
+// Match implements Predicate.
+func (f PredicateFunc) Match(msg *Message) bool {
+	return f(msg)
+}
+
+type andPredicate []Predicate
+
+func (ps andPredicate) Match(msg *Message) bool {
+	for _, p := range ps {
+		if !p.Match(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ps andPredicate) needsSize() bool {
+	for _, p := range ps {
+		if needsSize(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// And returns a predicate matching messages matched by all of ps.
+func And(ps ...Predicate) Predicate {
+	return andPredicate(ps)
+}
+
+type orPredicate []Predicate
+
+func (ps orPredicate) Match(msg *Message) bool {
+	for _, p := range ps {
+		if p.Match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ps orPredicate) needsSize() bool {
+	return andPredicate(ps).needsSize()
+}
+
+// Or returns a predicate matching messages matched by any of ps.
+func Or(ps ...Predicate) Predicate {
+	return orPredicate(ps)
+}
+
+type notPredicate struct {
+	p Predicate
+}
+
+func (p notPredicate) Match(msg *Message) bool {
+	return !p.p.Match(msg)
+}
+
+func (p notPredicate) needsSize() bool {
+	return needsSize(p.p)
+}
+
+// Not returns a predicate matching messages not matched by p.
+func Not(p Predicate) Predicate {
+	return notPredicate{p}
+}
+
+// All is a predicate matching all messages.
+var All Predicate = PredicateFunc(func(msg *Message) bool {
+	return true
+})
+
+// Domain returns a predicate matching messages whose envelope sender or From
+// address belongs to domain or one of its subdomains.
+func Domain(domain string) Predicate {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "@"))
+	match := func(addr string) bool {
+		i := strings.LastIndexByte(addr, '@')
+		if i < 0 {
+			return false
+		}
+		d := strings.ToLower(addr[i+1:])
+		return d == domain || strings.HasSuffix(d, "."+domain)
+	}
+	return PredicateFunc(func(msg *Message) bool {
+		if match(msg.Sender()) {
+			return true
+		}
+		addrs, _ := msg.Header.AddressList("From")
+		for _, addr := range addrs {
+			if match(addr.Address) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Sender returns a predicate matching messages whose envelope sender or From
+// field contains s, ignoring case.
+func Sender(s string) Predicate {
+	s = strings.ToLower(s)
+	return PredicateFunc(func(msg *Message) bool {
+		if strings.Contains(strings.ToLower(msg.Sender()), s) {
+			return true
+		}
+		for _, v := range msg.headerValues("From") {
+			if strings.Contains(strings.ToLower(v), s) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Header returns a predicate matching messages with a header field k whose
+// value contains s, ignoring case. Encoded words are decoded.
+func Header(k, s string) Predicate {
+	s = strings.ToLower(s)
+	return PredicateFunc(func(msg *Message) bool {
+		for _, v := range msg.headerValues(k) {
+			if strings.Contains(strings.ToLower(v), s) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// HeaderRegexp returns a predicate matching messages with a header field k
+// whose value matches re. Encoded words are decoded.
+func HeaderRegexp(k string, re *regexp.Regexp) Predicate {
+	return PredicateFunc(func(msg *Message) bool {
+		for _, v := range msg.headerValues(k) {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// After returns a predicate matching messages whose envelope date is t or
+// later.
+func After(t time.Time) Predicate {
+	return PredicateFunc(func(msg *Message) bool {
+		date := msg.Date()
+		return !date.IsZero() && !date.Before(t)
+	})
+}
+
+// Before returns a predicate matching messages whose envelope date is before
+// t.
+func Before(t time.Time) Predicate {
+	return PredicateFunc(func(msg *Message) bool {
+		date := msg.Date()
+		return !date.IsZero() && date.Before(t)
+	})
+}
+
+type sizeFunc func(size int64) bool
+
+func (f sizeFunc) Match(msg *Message) bool {
+	return f(msg.Size)
+}
+
+func (f sizeFunc) needsSize() bool {
+	return true
+}
+
+// Larger returns a predicate matching messages larger than n bytes.
+func Larger(n int64) Predicate {
+	return sizeFunc(func(size int64) bool {
+		return size > n
+	})
+}
+
+// Smaller returns a predicate matching messages smaller than n bytes.
+func Smaller(n int64) Predicate {
+	return sizeFunc(func(size int64) bool {
+		return size < n
+	})
+}
+
+// maxMemory is the number of bytes of a message buffered in memory, when its
+// size is needed, before it's spilled to a temporary file.
+const maxMemory = 10 << 20
+
+// Reader reads the messages of an mbox stream matching a predicate. The Close
+// method must be called to release resources.
+type Reader struct {
+	r         *mbox.Reader
+	p         Predicate
+	needsSize bool
+	index     int
+	spool     *spool.Spool
+}
+
+// NewReader returns a new Reader reading messages from r matching p.
+func NewReader(r *mbox.Reader, p Predicate) *Reader {
+	return &Reader{r: r, p: p, needsSize: needsSize(p)}
+}
+
+// NextMessage returns the next matching message and its text (containing both
+// the header and the body), with LF line endings. It returns io.EOF if there
+// are no messages left.
+func (r *Reader) NextMessage() (*Message, io.Reader, error) {
+	for {
+		if err := r.closeSpool(); err != nil {
+			return nil, nil, err
+		}
+
+		text, err := r.r.NextMessage()
+		if err != nil {
+			return nil, nil, err
+		}
+		msg := &Message{
+			Index:    r.index,
+			Offset:   r.r.Offset(),
+			FromLine: r.r.FromLine(),
+			Header:   mail.Header{},
+		}
+		r.index++
+
+		br := bufio.NewReader(text)
+		hdr, err := msgutil.ReadHeader(br)
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		hdr = bytes.Replace(hdr, []byte("\r\n"), []byte("\n"), -1)
+		if m, err := mail.ReadMessage(bytes.NewReader(hdr)); err == nil {
+			msg.Header = m.Header
+		}
+
+		var body io.Reader = msgutil.NewLFReader(br)
+		if r.needsSize {
+			r.spool = &spool.Spool{Max: maxMemory}
+			n, err := io.Copy(r.spool, body)
+			if err != nil {
+				return nil, nil, err
+			}
+			msg.Size = int64(len(hdr)) + n
+			if body, err = r.spool.Reader(); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if r.p.Match(msg) {
+			return msg, io.MultiReader(bytes.NewReader(hdr), body), nil
+		}
+	}
+}
+
+func (r *Reader) closeSpool() error {
+	if r.spool == nil {
+		return nil
+	}
+	err := r.spool.Close()
+	r.spool = nil
+	return err
+}
+
+// Close releases the resources held by the Reader. It doesn't close the
+// underlying mbox.Reader.
+func (r *Reader) Close() error {
+	return r.closeSpool()
+}
+
+// Filter copies the messages read from r matching p to w. It returns the
+// number of matching messages. The From line and the text of messages are
+// preserved.
+func Filter(w *mbox.Writer, r *mbox.Reader, p Predicate) (int, error) {
+	fr := NewReader(r, p)
+	defer fr.Close()
+
+	n := 0
+	for {
+		msg, text, err := fr.NextMessage()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		var mw io.WriteCloser
+		if msg.FromLine != "" {
+			mw, err = w.CreateMessageFromLine(msg.FromLine)
+		} else {
+			from, t := mbox.HeaderEnvelope(msg.Header)
+			mw, err = w.CreateMessage(from, t)
+		}
+		if err != nil {
+			return n, err
+		}
+		if _, err := io.Copy(mw, text); err != nil {
+			return n, err
+		}
+		if err := mw.Close(); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,136 @@
+package filter
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-mbox"
+)
+
+var testMessages = []string{
+	"From alice@example.com Thu Jan  1 00:00:01 2015\n" +
+		"From: Alice <alice@example.com>\nSubject: Hello\n\nHi Bob,\n>From here.\n\n",
+	"From bob@lists.example.org Fri Jan  2 10:30:00 2015\n" +
+		"From: Bob <bob@example.org>\nSubject: =?UTF-8?Q?R=C3=A9sum=C3=A9?=\n\n" +
+		strings.Repeat("Lorem ipsum dolor sit amet.\n", 20) + "\n",
+	"From carol@example.net Sat Jan  3 08:00:00 2015\n" +
+		"From: Carol <carol@example.net>\nSubject: Re: Hello\nX-Spam: yes\n\nBye.\n\n",
+}
+
+var testMbox = strings.Join(testMessages, "")
+
+func readMatches(t *testing.T, p Predicate) []int {
+	r := NewReader(mbox.NewReader(strings.NewReader(testMbox)), p)
+	defer r.Close()
+
+	var indexes []int
+	for {
+		msg, _, err := r.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("NextMessage() = %v", err)
+		}
+		indexes = append(indexes, msg.Index)
+	}
+	return indexes
+}
+
+func TestPredicates(t *testing.T) {
+	date := func(s string) time.Time {
+		t, _ := time.Parse("2006-01-02", s)
+		return t
+	}
+	tests := []struct {
+		name string
+		p    Predicate
+		want []int
+	}{
+		{"All", All, []int{0, 1, 2}},
+		{"Domain", Domain("example.org"), []int{1}},
+		{"Domain/envelope", Domain("lists.example.org"), []int{1}},
+		{"Sender", Sender("CAROL"), []int{2}},
+		{"Header", Header("subject", "hello"), []int{0, 2}},
+		{"Header/encoded", Header("Subject", "résumé"), []int{1}},
+		{"HeaderRegexp", HeaderRegexp("Subject", regexp.MustCompile("^Re: ")), []int{2}},
+		{"After", After(date("2015-01-02")), []int{1, 2}},
+		{"Before", Before(date("2015-01-02")), []int{0}},
+		{"Larger", Larger(200), []int{1}},
+		{"Smaller", Smaller(200), []int{0, 2}},
+		{"And", And(Header("Subject", "hello"), Not(Header("X-Spam", "yes"))), []int{0}},
+		{"Or", Or(Domain("example.net"), Larger(200)), []int{1, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := readMatches(t, test.p)
+			if !equalInts(got, test.want) {
+				t.Errorf("matches = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReader(t *testing.T) {
+	for _, p := range []Predicate{Sender("bob"), And(Sender("bob"), Larger(0))} {
+		r := NewReader(mbox.NewReader(strings.NewReader(testMbox)), p)
+
+		msg, text, err := r.NextMessage()
+		if err != nil {
+			t.Fatalf("NextMessage() = %v", err)
+		}
+		b, err := ioutil.ReadAll(text)
+		if err != nil {
+			t.Fatalf("ReadAll() = %v", err)
+		}
+		want := strings.SplitN(testMessages[1], "\n", 2)[1]
+		want = strings.TrimSuffix(want, "\n")
+		if string(b) != want {
+			t.Errorf("message text = %q, want %q", b, want)
+		}
+		if needsSize(p) && msg.Size != int64(len(want)) {
+			t.Errorf("Message.Size = %v, want %v", msg.Size, len(want))
+		}
+
+		if _, _, err := r.NextMessage(); err != io.EOF {
+			t.Errorf("NextMessage() = %v, want io.EOF", err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("Close() = %v", err)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var buf bytes.Buffer
+	w := mbox.NewWriter(&buf)
+	n, err := Filter(w, mbox.NewReader(strings.NewReader(testMbox)), Not(Domain("example.org")))
+	if err != nil {
+		t.Fatalf("Filter() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Filter() = %v, want 2", n)
+	}
+	if want := testMessages[0] + testMessages[2]; buf.String() != want {
+		t.Errorf("Filter() wrote:\n%v\nwant:\n%v", buf.String(), want)
+	}
+}
@@ -0,0 +1,271 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse parses a query into a predicate. A query is made of terms combined
+// with the "and", "or" and "not" operators and parentheses. Terms separated
+// by spaces are combined with "and". The terms are:
+//
+//	from:s          envelope sender or From field contains s
+//	domain:d        envelope sender or From address is in domain d
+//	after:date      envelope date is date or later
+//	before:date     envelope date is before date
+//	larger:size     message is larger than size bytes
+//	smaller:size    message is smaller than size bytes
+//	field:s         header field contains s
+//	field~regexp    header field matches regexp
+//
+// Dates are formatted as "2006-01-02", "2006-01" or RFC 3339. Sizes can have a
+// K, M or G suffix. Values can be quoted with double quotes. Matching ignores
+// case, except for regular expressions. For instance:
+//
+//	domain:example.com after:2015-01 subject~"^(Re|Fwd): " not larger:10M
+//
+// An empty query matches all messages.
+func Parse(query string) (Predicate, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return All, nil
+	}
+
+	p := &parser{tokens: tokens}
+	pred, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.tokens) > 0 {
+		return nil, fmt.Errorf("filter: unexpected %q", p.tokens[0].text)
+	}
+	return pred, nil
+}
+
+type token struct {
+	text string
+	// sep is the index of the first unquoted ':' or '~' in text, or -1
+	sep int
+	// quoted is true if the token contains quotes
+	quoted bool
+}
+
+func (tok *token) isKeyword(kw string) bool {
+	return !tok.quoted && tok.sep < 0 && strings.EqualFold(tok.text, kw)
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			return tokens, nil
+		}
+		if s[0] == '(' || s[0] == ')' {
+			tokens = append(tokens, token{text: s[:1], sep: -1})
+			s = s[1:]
+			continue
+		}
+
+		tok := token{sep: -1}
+		var sb strings.Builder
+		for s != "" && !strings.ContainsRune(" \t\r\n()", rune(s[0])) {
+			c := s[0]
+			if c == '"' {
+				tok.quoted = true
+				s = s[1:]
+				for {
+					if s == "" {
+						return nil, fmt.Errorf("filter: unterminated quoted string")
+					}
+					c := s[0]
+					s = s[1:]
+					if c == '"' {
+						break
+					}
+					if c == '\\' && s != "" {
+						c = s[0]
+						s = s[1:]
+					}
+					sb.WriteByte(c)
+				}
+				continue
+			}
+			if (c == ':' || c == '~') && tok.sep < 0 && !tok.quoted {
+				tok.sep = sb.Len()
+			}
+			sb.WriteByte(c)
+			s = s[1:]
+		}
+		tok.text = sb.String()
+		tokens = append(tokens, tok)
+	}
+}
+
+type parser struct {
+	tokens []token
+}
+
+func (p *parser) peek() *token {
+	if len(p.tokens) == 0 {
+		return nil
+	}
+	return &p.tokens[0]
+}
+
+func (p *parser) next() *token {
+	tok := p.peek()
+	if tok != nil {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (Predicate, error) {
+	var ps []Predicate
+	for {
+		pred, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, pred)
+
+		if tok := p.peek(); tok == nil || !tok.isKeyword("or") {
+			break
+		}
+		p.next()
+	}
+	if len(ps) == 1 {
+		return ps[0], nil
+	}
+	return Or(ps...), nil
+}
+
+func (p *parser) parseAnd() (Predicate, error) {
+	var ps []Predicate
+	for {
+		pred, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, pred)
+
+		tok := p.peek()
+		if tok == nil || tok.isKeyword("or") || (!tok.quoted && tok.text == ")") {
+			break
+		}
+		if tok.isKeyword("and") {
+			p.next()
+		}
+	}
+	if len(ps) == 1 {
+		return ps[0], nil
+	}
+	return And(ps...), nil
+}
+
+func (p *parser) parseUnary() (Predicate, error) {
+	tok := p.next()
+	if tok == nil {
+		return nil, fmt.Errorf("filter: unexpected end of query")
+	}
+	if tok.isKeyword("not") {
+		pred, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(pred), nil
+	}
+	if !tok.quoted && tok.text == "(" {
+		pred, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok == nil || tok.quoted || tok.text != ")" {
+			return nil, fmt.Errorf("filter: missing closing parenthesis")
+		}
+		return pred, nil
+	}
+	return parseTerm(tok)
+}
+
+func parseTerm(tok *token) (Predicate, error) {
+	if tok.sep <= 0 {
+		return nil, fmt.Errorf("filter: invalid term %q", tok.text)
+	}
+	k, op, v := tok.text[:tok.sep], tok.text[tok.sep], tok.text[tok.sep+1:]
+
+	if op == '~' {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid regexp in %q: %v", tok.text, err)
+		}
+		return HeaderRegexp(k, re), nil
+	}
+
+	switch strings.ToLower(k) {
+	case "from":
+		return Sender(v), nil
+	case "domain":
+		return Domain(v), nil
+	case "after", "before":
+		t, err := parseDate(v)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(k, "after") {
+			return After(t), nil
+		}
+		return Before(t), nil
+	case "larger", "smaller":
+		n, err := parseSize(v)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(k, "larger") {
+			return Larger(n), nil
+		}
+		return Smaller(n), nil
+	default:
+		return Header(k, v), nil
+	}
+}
+
+var dateLayouts = []string{"2006-01-02", "2006-01", time.RFC3339}
+
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("filter: invalid date %q", s)
+}
+
+func parseSize(s string) (int64, error) {
+	var mult int64 = 1
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K', 'k':
+			mult = 1 << 10
+		case 'M', 'm':
+			mult = 1 << 20
+		case 'G', 'g':
+			mult = 1 << 30
+		}
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("filter: invalid size %q", s)
+	}
+	return n * mult, nil
+}
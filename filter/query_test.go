@@ -0,0 +1,58 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"", []int{0, 1, 2}},
+		{"from:alice", []int{0}},
+		{"domain:example.org or domain:example.net", []int{1, 2}},
+		{"subject:hello not x-spam:yes", []int{0}},
+		{"subject:hello and not x-spam:yes", []int{0}},
+		{"NOT (from:alice OR from:bob)", []int{2}},
+		{`subject:"re: hello"`, []int{2}},
+		{`subject~"^R[eé]"`, []int{1, 2}},
+		{"after:2015-01-02 before:2015-01-03", []int{1}},
+		{"after:2015-01", []int{0, 1, 2}},
+		{"larger:1K", nil},
+		{"smaller:1k larger:200", []int{1}},
+		{"(from:alice or from:carol) subject:re", []int{2}},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			p, err := Parse(test.query)
+			if err != nil {
+				t.Fatalf("Parse() = %v", err)
+			}
+			got := readMatches(t, p)
+			if !equalInts(got, test.want) {
+				t.Errorf("matches = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParse_invalid(t *testing.T) {
+	tests := []string{
+		"alice",
+		":alice",
+		"from:alice or",
+		"not",
+		"(from:alice",
+		"from:alice)",
+		`subject:"hello`,
+		"subject~(",
+		"after:yesterday",
+		"larger:big",
+	}
+	for _, query := range tests {
+		if _, err := Parse(query); err == nil {
+			t.Errorf("Parse(%q) = nil, want an error", query)
+		}
+	}
+}
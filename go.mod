@@ -1,3 +1,8 @@
 module github.com/emersion/go-mbox
 
-go 1.12
+go 1.17
+
+require (
+	github.com/klauspost/compress v1.15.15
+	github.com/ulikunitz/xz v0.5.15
+)
@@ -0,0 +1,171 @@
+package mbox
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+// headerField is a raw header field, including its folded continuation lines
+// and line endings.
+type headerField struct {
+	key    string
+	value  []byte // Raw field value, starting after the colon
+	raw    []byte
+	offset int // Offset of the field in the header
+}
+
+// parseHeaderFields splits header fields into individual fields. It doesn't
+// attempt to validate them.
+func parseHeaderFields(fields []byte) []headerField {
+	var l []headerField
+	offset := 0
+	for len(fields) > 0 {
+		// Find the end of the field, including continuation lines
+		end := 0
+		for {
+			i := bytes.IndexByte(fields[end:], '\n')
+			if i < 0 {
+				end = len(fields)
+				break
+			}
+			end += i + 1
+			if end >= len(fields) || (fields[end] != ' ' && fields[end] != '\t') {
+				break
+			}
+		}
+
+		raw := fields[:end]
+		fields = fields[end:]
+
+		f := headerField{raw: raw, offset: offset}
+		offset += len(raw)
+		if i := bytes.IndexByte(raw, ':'); i >= 0 {
+			f.key = string(bytes.TrimSpace(raw[:i]))
+			f.value = raw[i+1:]
+		}
+		l = append(l, f)
+	}
+	return l
+}
+
+// contentLength returns the value of the Content-Length field of a header.
+func contentLength(fields []byte) (int64, bool) {
+	for _, f := range parseHeaderFields(fields) {
+		if !strings.EqualFold(f.key, "Content-Length") {
+			continue
+		}
+		n, err := strconv.ParseInt(string(bytes.TrimSpace(f.value)), 10, 64)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// fieldUpdate is a header field value to set. The value is padded with spaces
+// to at least pad bytes, so that it can later be updated in place.
+type fieldUpdate struct {
+	key, value string
+	pad        int
+}
+
+func (u *fieldUpdate) paddedValue() string {
+	v := u.value
+	if len(v) < u.pad {
+		v += strings.Repeat(" ", u.pad-len(v))
+	}
+	return v
+}
+
+// updateHeaderInPlace sets header field values without changing the size of
+// the header, by overwriting the existing values and padding them with
+// spaces. It returns false if the existing fields are missing or too short.
+func updateHeaderInPlace(hdr []byte, updates []fieldUpdate) ([]byte, bool) {
+	fields, _ := msgutil.SplitHeader(hdr)
+	parsed := parseHeaderFields(fields)
+
+	out := append([]byte(nil), hdr...)
+	for _, u := range updates {
+		var field *headerField
+		for i := range parsed {
+			if strings.EqualFold(parsed[i].key, u.key) {
+				field = &parsed[i]
+				break
+			}
+		}
+		if field == nil {
+			if u.value == "" {
+				continue
+			}
+			return nil, false
+		}
+
+		v := field.value
+		if bytes.HasSuffix(v, []byte("\r\n")) {
+			v = v[:len(v)-2]
+		} else if bytes.HasSuffix(v, []byte("\n")) {
+			v = v[:len(v)-1]
+		}
+		if bytes.ContainsAny(v, "\r\n") {
+			// Folded field
+			return nil, false
+		}
+
+		nv := " " + u.value
+		if len(nv) > len(v) {
+			return nil, false
+		}
+		nv += strings.Repeat(" ", len(v)-len(nv))
+
+		start := field.offset + len(field.raw) - len(field.value)
+		copy(out[start:], nv)
+	}
+
+	return out, true
+}
+
+// updateHeader sets header field values. Existing fields are replaced, and
+// missing fields are appended to the header.
+func updateHeader(hdr []byte, updates []fieldUpdate) []byte {
+	fields, blank := msgutil.SplitHeader(hdr)
+	eol := "\n"
+	if bytes.Equal(blank, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+
+	var out []byte
+	done := make([]bool, len(updates))
+	for _, f := range parseHeaderFields(fields) {
+		i := -1
+		for j := range updates {
+			if strings.EqualFold(f.key, updates[j].key) {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			out = append(out, f.raw...)
+			continue
+		}
+		if !done[i] {
+			out = append(out, f.raw[:len(f.raw)-len(f.value)]...)
+			out = append(out, " "+updates[i].paddedValue()+eol...)
+			done[i] = true
+		}
+	}
+
+	for i, u := range updates {
+		if !done[i] {
+			out = append(out, u.key+": "+u.paddedValue()+eol...)
+		}
+	}
+
+	if blank == nil {
+		blank = []byte(eol)
+	}
+	return append(out, blank...)
+}
@@ -0,0 +1,270 @@
+// Package msgutil contains helpers to manipulate raw messages, shared by the
+// mbox package and the conversion packages.
+package msgutil
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// ReadHeader reads a message header from br, up to and including the blank
+// line separating it from the body.
+func ReadHeader(br *bufio.Reader) ([]byte, error) {
+	var hdr []byte
+	isPrefix := false
+	for {
+		l, err := br.ReadSlice('\n')
+		hdr = append(hdr, l...)
+		if err == bufio.ErrBufferFull {
+			isPrefix = true
+			continue
+		} else if err == io.EOF {
+			return hdr, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !isPrefix && isBlankLine(l) {
+			return hdr, nil
+		}
+		isPrefix = false
+	}
+}
+
+func isBlankLine(l []byte) bool {
+	return len(l) == 1 && l[0] == '\n' || len(l) == 2 && l[0] == '\r' && l[1] == '\n'
+}
+
+// StripFields removes header fields, including their continuation lines.
+func StripFields(hdr []byte, keys ...string) []byte {
+	var out []byte
+	skip := false
+	for len(hdr) > 0 {
+		l := hdr
+		if i := bytes.IndexByte(hdr, '\n'); i >= 0 {
+			l = hdr[:i+1]
+		}
+		hdr = hdr[len(l):]
+
+		if l[0] != ' ' && l[0] != '\t' {
+			skip = false
+			for _, k := range keys {
+				if len(l) > len(k) && l[len(k)] == ':' && strings.EqualFold(string(l[:len(k)]), k) {
+					skip = true
+				}
+			}
+		}
+		if !skip {
+			out = append(out, l...)
+		}
+	}
+	return out
+}
+
+// SplitHeader splits a header returned by ReadHeader into its fields and its
+// terminating blank line. The returned fields always end with a newline,
+// unless empty. blank is nil if the header isn't terminated by a blank line.
+func SplitHeader(hdr []byte) (fields, blank []byte) {
+	switch {
+	case bytes.Equal(hdr, []byte("\n")), bytes.Equal(hdr, []byte("\r\n")):
+		return nil, hdr
+	case bytes.HasSuffix(hdr, []byte("\n\r\n")):
+		return hdr[:len(hdr)-2], hdr[len(hdr)-2:]
+	case bytes.HasSuffix(hdr, []byte("\n\n")):
+		return hdr[:len(hdr)-1], hdr[len(hdr)-1:]
+	}
+
+	if len(hdr) > 0 && hdr[len(hdr)-1] != '\n' {
+		hdr = append(hdr[:len(hdr):len(hdr)], '\n')
+	}
+	return hdr, nil
+}
+
+// AddFields inserts raw header fields at the end of a header, before the blank
+// line separating it from the body. If the header isn't terminated by a blank
+// line, one is added.
+func AddFields(hdr []byte, fields string) []byte {
+	hdr, blank := SplitHeader(hdr)
+	if blank == nil {
+		blank = []byte("\n")
+	}
+
+	out := append([]byte(nil), hdr...)
+	out = append(out, fields...)
+	return append(out, blank...)
+}
+
+// SetStatus replaces the Status and X-Status fields of a header, as returned
+// by mbox.Flags.Status and XStatus. Empty values remove the fields.
+func SetStatus(hdr []byte, status, xStatus string) []byte {
+	var fields string
+	if status != "" {
+		fields += "Status: " + status + "\n"
+	}
+	if xStatus != "" {
+		fields += "X-Status: " + xStatus + "\n"
+	}
+	return AddFields(StripFields(hdr, "Status", "X-Status"), fields)
+}
+
+// ReturnPathField formats a Return-Path field for an envelope sender, as
+// returned by mbox.ParseFromLine. It returns an empty string if the sender
+// isn't an address.
+func ReturnPathField(sender string) string {
+	if sender == "MAILER-DAEMON" {
+		return "Return-Path: <>\n"
+	} else if strings.Contains(sender, "@") {
+		return "Return-Path: <" + sender + ">\n"
+	}
+	return ""
+}
+
+// LFWriter converts CRLF line endings to LF. Flush must be called after the
+// last write.
+type LFWriter struct {
+	w  *bufio.Writer
+	cr bool
+}
+
+// NewLFWriter returns a new LFWriter writing to w.
+func NewLFWriter(w io.Writer) *LFWriter {
+	return &LFWriter{w: bufio.NewWriter(w)}
+}
+
+func (w *LFWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if w.cr && p[0] != '\n' {
+			if err := w.w.WriteByte('\r'); err != nil {
+				return 0, err
+			}
+		}
+		w.cr = false
+
+		// Write up to the next CR, which is held back until the next byte is
+		// known
+		i := bytes.IndexByte(p, '\r')
+		if i < 0 {
+			i = len(p)
+		} else {
+			w.cr = true
+		}
+		if _, err := w.w.Write(p[:i]); err != nil {
+			return 0, err
+		}
+		if w.cr {
+			i++
+		}
+		p = p[i:]
+	}
+	return n, nil
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (w *LFWriter) Flush() error {
+	if w.cr {
+		w.cr = false
+		if err := w.w.WriteByte('\r'); err != nil {
+			return err
+		}
+	}
+	return w.w.Flush()
+}
+
+// LFReader converts CRLF line endings to LF.
+type LFReader struct {
+	r *bufio.Reader
+}
+
+// NewLFReader returns a new LFReader reading from r.
+func NewLFReader(r io.Reader) *LFReader {
+	return &LFReader{r: bufio.NewReader(r)}
+}
+
+func (r *LFReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Make sure some data is buffered, and that a leading CR is buffered
+	// along with the byte following it
+	b, err := r.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	if b[0] == '\r' {
+		if _, err := r.r.Peek(2); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+
+	b, _ = r.r.Peek(r.r.Buffered())
+	n, i := 0, 0
+	for i < len(b) && n < len(p) {
+		if b[i] == '\r' {
+			if i+1 == len(b) && n > 0 {
+				// The next byte isn't buffered yet
+				break
+			} else if i+1 < len(b) && b[i+1] == '\n' {
+				i++
+				continue
+			}
+		}
+		p[n] = b[i]
+		n++
+		i++
+	}
+	r.r.Discard(i)
+	return n, nil
+}
+
+// CRLFWriter converts LF line endings to CRLF. Existing CRLF line endings are
+// kept as is. Flush must be called after the last write.
+type CRLFWriter struct {
+	w  *bufio.Writer
+	cr bool
+}
+
+// NewCRLFWriter returns a new CRLFWriter writing to w.
+func NewCRLFWriter(w io.Writer) *CRLFWriter {
+	return &CRLFWriter{w: bufio.NewWriter(w)}
+}
+
+func (w *CRLFWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if _, err := w.w.Write(p); err != nil {
+				return 0, err
+			}
+			w.cr = p[len(p)-1] == '\r'
+			break
+		}
+
+		cr := w.cr
+		if i > 0 {
+			cr = p[i-1] == '\r'
+		}
+		if _, err := w.w.Write(p[:i]); err != nil {
+			return 0, err
+		}
+		eol := "\r\n"
+		if cr {
+			eol = "\n"
+		}
+		if _, err := w.w.WriteString(eol); err != nil {
+			return 0, err
+		}
+		w.cr = false
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (w *CRLFWriter) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,94 @@
+package msgutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestLFReader(t *testing.T) {
+	text := "Subject: Test\r\n\r\nLone \r and \r\r\n, trailing CR\r"
+	want := "Subject: Test\n\nLone \r and \r\n, trailing CR\r"
+
+	for name, r := range map[string]func() *LFReader{
+		"whole":   func() *LFReader { return NewLFReader(strings.NewReader(text)) },
+		"onebyte": func() *LFReader { return NewLFReader(iotest.OneByteReader(strings.NewReader(text))) },
+	} {
+		b, err := ioutil.ReadAll(r())
+		if err != nil {
+			t.Fatalf("%v: ReadAll() = %v", name, err)
+		}
+		if string(b) != want {
+			t.Errorf("%v: LFReader output:\n%q\nexpected:\n%q", name, b, want)
+		}
+
+		// Read into a one-byte buffer
+		var out bytes.Buffer
+		lr := r()
+		p := make([]byte, 1)
+		for {
+			n, err := lr.Read(p)
+			out.Write(p[:n])
+			if err != nil {
+				break
+			}
+		}
+		if out.String() != want {
+			t.Errorf("%v: LFReader output with a one-byte buffer:\n%q\nexpected:\n%q", name, out.String(), want)
+		}
+	}
+}
+
+func TestLFWriter(t *testing.T) {
+	text := "Subject: Test\r\n\r\nLone \r and \r\r\n, trailing CR\r"
+	want := "Subject: Test\n\nLone \r and \r\n, trailing CR\r"
+
+	for _, size := range []int{len(text), 1, 7} {
+		var out bytes.Buffer
+		w := NewLFWriter(&out)
+		for p := text; len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write([]byte(p[:n])); err != nil {
+				t.Fatalf("Write() = %v", err)
+			}
+			p = p[n:]
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("Flush() = %v", err)
+		}
+		if out.String() != want {
+			t.Errorf("LFWriter output with %v-byte writes:\n%q\nexpected:\n%q", size, out.String(), want)
+		}
+	}
+}
+
+func TestCRLFWriter(t *testing.T) {
+	text := "Subject: Test\n\r\nLone \r and \r\n\n, no newline"
+	want := "Subject: Test\r\n\r\nLone \r and \r\n\r\n, no newline"
+
+	for _, size := range []int{len(text), 1, 7} {
+		var out bytes.Buffer
+		w := NewCRLFWriter(&out)
+		for p := text; len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write([]byte(p[:n])); err != nil {
+				t.Fatalf("Write() = %v", err)
+			}
+			p = p[n:]
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("Flush() = %v", err)
+		}
+		if out.String() != want {
+			t.Errorf("CRLFWriter output with %v-byte writes:\n%q\nexpected:\n%q", size, out.String(), want)
+		}
+	}
+}
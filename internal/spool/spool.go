@@ -0,0 +1,75 @@
+// Package spool buffers data in memory, spilling it to a temporary file once
+// it grows too large.
+package spool
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Spool buffers data in memory, spilling it to a temporary file once it grows
+// larger than Max bytes.
+type Spool struct {
+	Max int64
+
+	buf  bytes.Buffer
+	f    *os.File
+	size int64
+}
+
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.f == nil && s.size+int64(len(p)) > s.Max {
+		f, err := ioutil.TempFile("", "mbox-spool-")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if s.f != nil {
+		n, err = s.f.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes written to the spool.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// Reader returns an io.Reader reading back the spooled data from the
+// beginning.
+func (s *Spool) Reader() (io.Reader, error) {
+	if s.f == nil {
+		return bytes.NewReader(s.buf.Bytes()), nil
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.f, nil
+}
+
+// Close releases the resources held by the spool.
+func (s *Spool) Close() error {
+	s.buf.Reset()
+	if s.f == nil {
+		return nil
+	}
+	name := s.f.Name()
+	err := s.f.Close()
+	if rmErr := os.Remove(name); err == nil {
+		err = rmErr
+	}
+	s.f = nil
+	return err
+}
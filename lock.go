@@ -0,0 +1,281 @@
+package mbox
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ErrLocked is returned when a mailbox lock couldn't be acquired before the
+// timeout expired.
+var ErrLocked = errors.New("mbox: mailbox is locked")
+
+// LockMethod is a set of mailbox locking methods. Methods can be combined, for
+// instance procmail and Dovecot use LockDotlock|LockFcntl by default. When
+// multiple methods are used, they are acquired in the order dotlock, fcntl,
+// flock.
+type LockMethod int
+
+const (
+	// LockDotlock creates a "<mailbox>.lock" file next to the mailbox. This
+	// requires write access to the mailbox directory. Dotlocks are always
+	// exclusive.
+	LockDotlock LockMethod = 1 << iota
+	// LockFcntl uses POSIX record locks (fcntl F_SETLK). They are owned by the
+	// process: they don't provide mutual exclusion between goroutines.
+	LockFcntl
+	// LockFlock uses BSD locks (flock).
+	LockFlock
+)
+
+const (
+	defaultLockTimeout      = 30 * time.Second
+	defaultLockStaleTimeout = 5 * time.Minute
+	lockRetryInterval       = 50 * time.Millisecond
+)
+
+// LockOptions contains options for locking a mailbox.
+type LockOptions struct {
+	// Methods is the set of locking methods to use. Defaults to
+	// LockDotlock|LockFcntl, or LockDotlock on platforms without fcntl
+	// locks.
+	Methods LockMethod
+	// Timeout is the maximum time to wait for the lock. Zero means a default
+	// of 30 seconds, a negative value means not to wait at all.
+	Timeout time.Duration
+	// StaleTimeout is the age after which a dotlock file is considered stale
+	// and removed, for instance because its owner crashed. Zero means a
+	// default of 5 minutes. Long-running lock holders should call Touch to
+	// keep their dotlock fresh.
+	StaleTimeout time.Duration
+}
+
+// Lock is a lock held on a mailbox file.
+type Lock struct {
+	f        *os.File
+	methods  LockMethod
+	dotlock  string
+	unlocked bool
+}
+
+// LockFile locks the mailbox file f. If exclusive is false, a shared lock is
+// acquired for the methods supporting it. The lock is released with Unlock.
+func LockFile(f *os.File, exclusive bool, options *LockOptions) (*Lock, error) {
+	if options == nil {
+		options = new(LockOptions)
+	}
+	methods := options.Methods
+	if methods == 0 {
+		methods = defaultLockMethods
+	}
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = defaultLockTimeout
+	}
+	stale := options.StaleTimeout
+	if stale == 0 {
+		stale = defaultLockStaleTimeout
+	}
+
+	l := &Lock{f: f}
+	deadline := time.Now().Add(timeout)
+	try := func(method LockMethod, lock func() (bool, error)) error {
+		if methods&method == 0 {
+			return nil
+		}
+		for {
+			ok, err := lock()
+			if err != nil {
+				return err
+			} else if ok {
+				l.methods |= method
+				return nil
+			}
+
+			if !time.Now().Before(deadline) {
+				return ErrLocked
+			}
+			time.Sleep(lockRetryInterval)
+		}
+	}
+
+	err := try(LockDotlock, func() (bool, error) {
+		path := f.Name() + ".lock"
+		ok, err := dotlock(path, stale)
+		if ok {
+			l.dotlock = path
+		}
+		return ok, err
+	})
+	if err == nil {
+		err = try(LockFcntl, func() (bool, error) {
+			return fcntlLock(f, exclusive)
+		})
+	}
+	if err == nil {
+		err = try(LockFlock, func() (bool, error) {
+			return flock(f, exclusive)
+		})
+	}
+	if err != nil {
+		l.Unlock()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// openLocked opens the file at name with the given flags and locks it. The
+// file may be replaced while waiting for the lock, for instance when
+// Mailbox.Expunge renames a new file over it: the lock would then be held on
+// a file which isn't reachable anymore, and changes made to it would be lost.
+// In that case, the lock is released and the new file is opened instead.
+func openLocked(name string, flag int, perm os.FileMode, exclusive bool, options *LockOptions) (*os.File, *Lock, error) {
+	for {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, nil, err
+		}
+		lock, err := LockFile(f, exclusive, options)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			lock.Unlock()
+			f.Close()
+			return nil, nil, err
+		}
+		nameFi, err := os.Stat(name)
+		if err == nil && os.SameFile(fi, nameFi) {
+			return f, lock, nil
+		}
+		lock.Unlock()
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+	}
+}
+
+// dotlock tries to create the dotlock file at path. To be safe on NFS, the
+// lock file is created by hard-linking a uniquely named temporary file.
+func dotlock(path string, stale time.Duration) (bool, error) {
+	hostname, _ := os.Hostname()
+	pid := strconv.Itoa(os.Getpid())
+	tmp, err := ioutil.TempFile(filepath.Dir(path), fmt.Sprintf(".%s.%s.%s.", filepath.Base(path), hostname, pid))
+	if err != nil {
+		return false, err
+	}
+	_, err = tmp.WriteString(pid + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Link(tmp.Name(), path)
+	}
+	os.Remove(tmp.Name())
+	if err == nil {
+		return true, nil
+	} else if !os.IsExist(err) {
+		return false, err
+	}
+
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// Removed in the meantime, try again
+		return dotlock(path, stale)
+	} else if err != nil {
+		return false, err
+	}
+	if time.Since(fi.ModTime()) > stale {
+		if ok, err := removeStaleDotlock(path, fi); err != nil || !ok {
+			return false, err
+		}
+		return dotlock(path, stale)
+	}
+	return false, nil
+}
+
+// removeStaleDotlock removes the dotlock file at path if it's still the one
+// described by fi. Removing the file directly would race with other waiters:
+// another process may have removed the stale lock and created a fresh one in
+// the meantime. Instead, as liblockfile does, the file is first renamed to a
+// unique name, which can only succeed once, and checked to be unchanged. It
+// returns false if the lock was replaced.
+func removeStaleDotlock(path string, fi os.FileInfo) (bool, error) {
+	hostname, _ := os.Hostname()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), fmt.Sprintf(".%s.stale.%s.%d.", filepath.Base(path), hostname, os.Getpid()))
+	if err != nil {
+		return false, err
+	}
+	tmp.Close()
+	stalePath := tmp.Name()
+
+	if err := os.Rename(path, stalePath); os.IsNotExist(err) {
+		// Already removed by another waiter
+		os.Remove(stalePath)
+		return true, nil
+	} else if err != nil {
+		os.Remove(stalePath)
+		return false, err
+	}
+
+	staleFi, err := os.Stat(stalePath)
+	if err != nil {
+		return false, err
+	}
+	if !os.SameFile(fi, staleFi) || !staleFi.ModTime().Equal(fi.ModTime()) {
+		// We've taken a fresh lock away from its owner, put it back. If
+		// yet another lock has been created in the meantime, there's
+		// nothing we can do.
+		err := os.Link(stalePath, path)
+		os.Remove(stalePath)
+		if err != nil && !os.IsExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, os.Remove(stalePath)
+}
+
+// Touch updates the modification time of the dotlock file, if any, so that it
+// isn't considered stale.
+func (l *Lock) Touch() error {
+	if l.dotlock == "" {
+		return nil
+	}
+	now := time.Now()
+	return os.Chtimes(l.dotlock, now, now)
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	if l.unlocked {
+		return errors.New("mbox: lock already released")
+	}
+	l.unlocked = true
+
+	var err error
+	setErr := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	if l.methods&LockFlock != 0 {
+		setErr(funlock(l.f))
+	}
+	if l.methods&LockFcntl != 0 {
+		setErr(fcntlUnlock(l.f))
+	}
+	if l.dotlock != "" {
+		setErr(os.Remove(l.dotlock))
+	}
+	return err
+}
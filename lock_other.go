@@ -0,0 +1,31 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package mbox
+
+import (
+	"errors"
+	"os"
+)
+
+// defaultLockMethods is the default set of locking methods. fcntl and flock
+// aren't available on this platform.
+const defaultLockMethods = LockDotlock
+
+var errLockUnsupported = errors.New("mbox: locking method not supported on this platform")
+
+func flock(f *os.File, exclusive bool) (bool, error) {
+	return false, errLockUnsupported
+}
+
+func funlock(f *os.File) error {
+	return errLockUnsupported
+}
+
+func fcntlLock(f *os.File, exclusive bool) (bool, error) {
+	return false, errLockUnsupported
+}
+
+func fcntlUnlock(f *os.File) error {
+	return errLockUnsupported
+}
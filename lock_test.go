@@ -0,0 +1,182 @@
+package mbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func tempMailbox(t *testing.T, content string) (name string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "mbox-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name = filepath.Join(dir, "mbox")
+	if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return name, func() { os.RemoveAll(dir) }
+}
+
+func testLockExclusion(t *testing.T, methods LockMethod) {
+	name, cleanup := tempMailbox(t, "")
+	defer cleanup()
+
+	var holders, overlap int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			f, err := os.OpenFile(name, os.O_RDWR, 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+
+			l, err := LockFile(f, true, &LockOptions{Methods: methods})
+			if err != nil {
+				t.Errorf("LockFile() = %v", err)
+				return
+			}
+			if atomic.AddInt32(&holders, 1) > 1 {
+				atomic.StoreInt32(&overlap, 1)
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&holders, -1)
+			if err := l.Unlock(); err != nil {
+				t.Errorf("Unlock() = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if overlap != 0 {
+		t.Errorf("Multiple goroutines held the lock at the same time")
+	}
+}
+
+func TestLockFile_dotlock(t *testing.T) {
+	testLockExclusion(t, LockDotlock)
+}
+
+func TestLockFile_dotlockTimeout(t *testing.T) {
+	name, cleanup := tempMailbox(t, "")
+	defer cleanup()
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	l, err := LockFile(f, true, &LockOptions{Methods: LockDotlock})
+	if err != nil {
+		t.Fatalf("LockFile() = %v", err)
+	}
+	if _, err := LockFile(f, true, &LockOptions{Methods: LockDotlock, Timeout: -1}); err != ErrLocked {
+		t.Errorf("LockFile() on locked mailbox = %v, want ErrLocked", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock() = %v", err)
+	}
+	if _, err := os.Stat(name + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("Dotlock file still exists after Unlock()")
+	}
+}
+
+func TestLockFile_staleDotlock(t *testing.T) {
+	name, cleanup := tempMailbox(t, "")
+	defer cleanup()
+
+	if err := ioutil.WriteFile(name+".lock", []byte("42\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(name+".lock", old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	l, err := LockFile(f, true, &LockOptions{Methods: LockDotlock, Timeout: -1})
+	if err != nil {
+		t.Fatalf("LockFile() with stale dotlock = %v", err)
+	}
+	l.Unlock()
+}
+
+func TestRemoveStaleDotlock_replaced(t *testing.T) {
+	name, cleanup := tempMailbox(t, "")
+	defer cleanup()
+
+	path := name + ".lock"
+	if err := ioutil.WriteFile(path, []byte("42\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	staleFi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another waiter removes the stale lock and creates a fresh one before
+	// we get to remove it
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := dotlock(path, time.Hour); err != nil || !ok {
+		t.Fatalf("dotlock() = %v, %v", ok, err)
+	}
+
+	if ok, err := removeStaleDotlock(path, staleFi); err != nil || ok {
+		t.Errorf("removeStaleDotlock() on a fresh lock = %v, %v, want false", ok, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("fresh dotlock removed: %v", err)
+	}
+	if names, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".*")); len(names) != 0 {
+		t.Errorf("temporary files left behind: %v", names)
+	}
+}
+
+func TestAppend_lock(t *testing.T) {
+	name, cleanup := tempMailbox(t, "")
+	defer cleanup()
+
+	lock := &LockOptions{Methods: LockDotlock, Timeout: -1}
+	a, err := Append(name, &AppendOptions{Lock: lock})
+	if err != nil {
+		t.Fatalf("Append() = %v", err)
+	}
+
+	if _, err := OpenReader(name, lock); err != ErrLocked {
+		t.Errorf("OpenReader() while appending = %v, want ErrLocked", err)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	fr, err := OpenReader(name, lock)
+	if err != nil {
+		t.Fatalf("OpenReader() = %v", err)
+	}
+	if err := fr.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package mbox
+
+import (
+	"os"
+	"syscall"
+)
+
+// defaultLockMethods is the default set of locking methods, as used by
+// procmail and Dovecot.
+const defaultLockMethods = LockDotlock | LockFcntl
+
+func flock(f *os.File, exclusive bool) (bool, error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func funlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+func fcntlLock(f *os.File, exclusive bool) (bool, error) {
+	lk := syscall.Flock_t{Type: syscall.F_RDLCK, Whence: 0}
+	if exclusive {
+		lk.Type = syscall.F_WRLCK
+	}
+	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func fcntlUnlock(f *os.File) error {
+	lk := syscall.Flock_t{Type: syscall.F_UNLCK, Whence: 0}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+}
@@ -0,0 +1,119 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package mbox
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestLockFile_flock(t *testing.T) {
+	testLockExclusion(t, LockFlock)
+}
+
+func TestLockFile_flockShared(t *testing.T) {
+	name, cleanup := tempMailbox(t, "")
+	defer cleanup()
+
+	var locks []*Lock
+	for i := 0; i < 2; i++ {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		l, err := LockFile(f, false, &LockOptions{Methods: LockFlock, Timeout: -1})
+		if err != nil {
+			t.Fatalf("LockFile() = %v", err)
+		}
+		locks = append(locks, l)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := LockFile(f, true, &LockOptions{Methods: LockFlock, Timeout: -1}); err != ErrLocked {
+		t.Errorf("LockFile() with shared locks held = %v, want ErrLocked", err)
+	}
+
+	for _, l := range locks {
+		l.Unlock()
+	}
+}
+
+// TestLockHelperProcess isn't a real test: it's used by TestLockFile_fcntl to
+// hold a lock in another process, since fcntl locks are per-process.
+func TestLockHelperProcess(t *testing.T) {
+	name := os.Getenv("MBOX_TEST_LOCK_HELPER")
+	if name == "" {
+		return
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if _, err := LockFile(f, true, &LockOptions{Methods: LockFcntl}); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("locked")
+
+	// Hold the lock until stdin is closed
+	bufio.NewReader(os.Stdin).ReadString('\n')
+	os.Exit(0)
+}
+
+func TestLockFile_fcntl(t *testing.T) {
+	name, cleanup := tempMailbox(t, "")
+	defer cleanup()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+	cmd.Env = append(os.Environ(), "MBOX_TEST_LOCK_HELPER="+name)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || l != "locked\n" {
+		stdin.Close()
+		cmd.Wait()
+		t.Fatalf("Helper process failed to lock: %q, %v", l, err)
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := LockFile(f, true, &LockOptions{Methods: LockFcntl, Timeout: -1}); err != ErrLocked {
+		t.Errorf("LockFile() while locked by another process = %v, want ErrLocked", err)
+	}
+
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Helper process: %v", err)
+	}
+
+	l, err := LockFile(f, true, &LockOptions{Methods: LockFcntl, Timeout: -1})
+	if err != nil {
+		t.Fatalf("LockFile() after helper exited = %v", err)
+	}
+	l.Unlock()
+}
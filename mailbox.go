@@ -0,0 +1,494 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+// MailboxOptions contains options for OpenMailbox.
+type MailboxOptions struct {
+	// Format is the mbox format variant of the mailbox. Defaults to
+	// FormatMboxo.
+	Format Format
+	// Lock contains options for the lock held on the mailbox. If nil, the
+	// default locking options are used.
+	Lock *LockOptions
+}
+
+// mailboxMessage is the location of a message in a mailbox file.
+type mailboxMessage struct {
+	offset, size int64
+	deleted      bool
+	// Updated header not written yet, if any
+	pending *pendingHeader
+}
+
+// pendingHeader is an updated message header which couldn't be written in
+// place.
+type pendingHeader struct {
+	// The location of the original header in the raw message
+	start, end int64
+	header     []byte
+}
+
+// Mailbox is an mbox file opened for modification. An exclusive lock is held
+// on the file until the Mailbox is closed.
+//
+// Messages are identified by their index, starting from zero. Indexes are
+// stable until the mailbox is expunged.
+type Mailbox struct {
+	name    string
+	options MailboxOptions
+	f       *os.File
+	lock    *Lock
+	msgs    []mailboxMessage
+	closed  bool
+}
+
+// OpenMailbox opens and locks the mbox file at name.
+func OpenMailbox(name string, options *MailboxOptions) (*Mailbox, error) {
+	mb := &Mailbox{name: name}
+	if options != nil {
+		mb.options = *options
+	}
+	if mb.options.Lock == nil {
+		mb.options.Lock = new(LockOptions)
+	}
+
+	if mb.options.Format == FormatMessage {
+		return nil, errors.New("mbox: Mailbox doesn't support FormatMessage")
+	}
+
+	f, lock, err := openLocked(name, os.O_RDWR, 0, true, mb.options.Lock)
+	if err != nil {
+		return nil, err
+	}
+	mb.f, mb.lock = f, lock
+
+	b := make([]byte, compressionMagicLen)
+	n, err := f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		mb.Close()
+		return nil, err
+	}
+	if c := DetectCompression(b[:n]); c != CompressionNone {
+		mb.Close()
+		return nil, fmt.Errorf("mbox: Mailbox doesn't support %v compressed files", c)
+	}
+
+	if err := mb.scan(); err != nil {
+		mb.Close()
+		return nil, err
+	}
+	return mb, nil
+}
+
+// scan locates the messages in the mailbox file.
+func (mb *Mailbox) scan() error {
+	fi, err := mb.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	mr := NewReader(io.NewSectionReader(mb.f, 0, size))
+	mr.Format = mb.options.Format
+
+	mb.msgs = nil
+	for {
+		_, err := mr.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if n := len(mb.msgs); n > 0 {
+			mb.msgs[n-1].size = mr.msgOffset - mb.msgs[n-1].offset
+		}
+		mb.msgs = append(mb.msgs, mailboxMessage{offset: mr.msgOffset})
+	}
+	if n := len(mb.msgs); n > 0 {
+		mb.msgs[n-1].size = size - mb.msgs[n-1].offset
+	}
+
+	return nil
+}
+
+func (mb *Mailbox) message(i int) (*mailboxMessage, error) {
+	if mb.closed {
+		return nil, errors.New("mbox: Mailbox is closed")
+	}
+	if i < 0 || i >= len(mb.msgs) {
+		return nil, fmt.Errorf("mbox: message index %v out of range", i)
+	}
+	return &mb.msgs[i], nil
+}
+
+// Len returns the number of messages in the mailbox, including the ones
+// marked as deleted.
+func (mb *Mailbox) Len() int {
+	return len(mb.msgs)
+}
+
+// Message returns the text of the message at index i, as returned by
+// Reader.NextMessage.
+func (mb *Mailbox) Message(i int) (io.Reader, error) {
+	msg, err := mb.message(i)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = mb.raw(msg)
+	if p := msg.pending; p != nil {
+		raw := mb.raw(msg)
+		r = io.MultiReader(
+			io.NewSectionReader(raw, 0, p.start),
+			bytes.NewReader(p.header),
+			io.NewSectionReader(raw, p.end, msg.size-p.end),
+		)
+	}
+
+	mr := NewReader(r)
+	mr.Format = mb.options.Format
+	return mr.NextMessage()
+}
+
+// header reads the raw header of a message. It returns the location of the
+// header in the raw message.
+func (mb *Mailbox) header(msg *mailboxMessage) (hdr []byte, start, end int64, err error) {
+	if p := msg.pending; p != nil {
+		return p.header, p.start, p.end, nil
+	}
+
+	br := bufio.NewReader(mb.raw(msg))
+	// Skip the From line, and for MMDF the opening delimiter
+	lines := 1
+	if mb.options.Format == FormatMMDF {
+		lines = 2
+		if b, err := br.Peek(len(mmdfDelimiter) + 1 + len(header)); err != nil || !bytes.HasSuffix(b, header) {
+			lines = 1
+		}
+	}
+	for lines > 0 {
+		l, err := br.ReadSlice('\n')
+		start += int64(len(l))
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil && err != io.EOF {
+			return nil, 0, 0, err
+		}
+		lines--
+		if err == io.EOF {
+			break
+		}
+	}
+
+	hdr, err = msgutil.ReadHeader(br)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return hdr, start, start + int64(len(hdr)), nil
+}
+
+// updateHeader sets header field values of the message at index i. The
+// mailbox file is updated in place if possible, otherwise the update is
+// pending until the next call to Flush or Expunge.
+func (mb *Mailbox) updateHeader(i int, updates []fieldUpdate) error {
+	msg, err := mb.message(i)
+	if err != nil {
+		return err
+	}
+
+	hdr, start, end, err := mb.header(msg)
+	if err != nil {
+		return err
+	}
+
+	if msg.pending != nil {
+		msg.pending.header = updateHeader(hdr, updates)
+		return nil
+	}
+
+	if newHdr, ok := updateHeaderInPlace(hdr, updates); ok {
+		if _, err := mb.f.WriteAt(newHdr, msg.offset+start); err != nil {
+			return err
+		}
+		return mb.f.Sync()
+	}
+
+	msg.pending = &pendingHeader{
+		start:  start,
+		end:    end,
+		header: updateHeader(hdr, updates),
+	}
+	return nil
+}
+
+// mailHeader parses the header of the message at index i.
+func (mb *Mailbox) mailHeader(i int) (mail.Header, error) {
+	msg, err := mb.message(i)
+	if err != nil {
+		return nil, err
+	}
+	hdr, _, _, err := mb.header(msg)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(hdr))
+	if err != nil {
+		return nil, err
+	}
+	return m.Header, nil
+}
+
+// Flags returns the flags of the message at index i, stored in its Status and
+// X-Status header fields.
+func (mb *Mailbox) Flags(i int) (Flags, error) {
+	h, err := mb.mailHeader(i)
+	if err != nil {
+		return 0, err
+	}
+	return ParseFlags(h), nil
+}
+
+// SetFlags sets the flags of the message at index i. If the existing Status
+// and X-Status header fields are long enough, they are overwritten in place.
+// Otherwise, the update is pending until the next call to Flush or Expunge,
+// which write padded fields so that further updates can be done in place.
+func (mb *Mailbox) SetFlags(i int, flags Flags) error {
+	return mb.updateHeader(i, []fieldUpdate{
+		{key: "Status", value: flags.Status(), pad: statusLen},
+		{key: "X-Status", value: flags.XStatus(), pad: xStatusLen},
+	})
+}
+
+// raw returns a reader for the message as stored in the mailbox, including its
+// From line.
+func (mb *Mailbox) raw(msg *mailboxMessage) *io.SectionReader {
+	return io.NewSectionReader(mb.f, msg.offset, msg.size)
+}
+
+// Delete marks the message at index i as deleted. It is removed from the
+// mailbox file by Expunge.
+func (mb *Mailbox) Delete(i int) error {
+	msg, err := mb.message(i)
+	if err != nil {
+		return err
+	}
+	msg.deleted = true
+	return nil
+}
+
+// Undelete removes the deleted mark from the message at index i.
+func (mb *Mailbox) Undelete(i int) error {
+	msg, err := mb.message(i)
+	if err != nil {
+		return err
+	}
+	msg.deleted = false
+	return nil
+}
+
+// Deleted reports whether the message at index i is marked as deleted.
+func (mb *Mailbox) Deleted(i int) bool {
+	msg, err := mb.message(i)
+	return err == nil && msg.deleted
+}
+
+// MozillaStatus returns the Thunderbird state of the message at index i.
+func (mb *Mailbox) MozillaStatus(i int) (*MozillaStatus, error) {
+	h, err := mb.mailHeader(i)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMozillaStatus(h)
+}
+
+// SetMozillaStatus sets the Thunderbird state of the message at index i.
+// Thunderbird writes fixed-width X-Mozilla-Status fields and pads
+// X-Mozilla-Keys, so the update is usually done in place. Otherwise, it is
+// pending as in SetFlags.
+func (mb *Mailbox) SetMozillaStatus(i int, status *MozillaStatus) error {
+	return mb.updateHeader(i, status.fieldUpdates())
+}
+
+// Flush writes the pending header updates to the mailbox file. The mailbox
+// file is rewritten as in Expunge, but messages marked as deleted are kept.
+func (mb *Mailbox) Flush() error {
+	return mb.commit(false)
+}
+
+// Expunge removes the messages marked as deleted from the mailbox file, and
+// writes the pending header updates. The other messages are preserved
+// byte-for-byte and their indexes are renumbered.
+//
+// The new mailbox is written to a temporary file which atomically replaces the
+// mailbox file, so that an interruption leaves either the old or the new
+// mailbox. The permission bits of the mailbox file are preserved, and so are
+// its owner and group on Unix: if they can't be, e.g. because the caller isn't
+// allowed to change them, Expunge fails and the mailbox file is left unchanged.
+func (mb *Mailbox) Expunge() error {
+	return mb.commit(true)
+}
+
+func (mb *Mailbox) commit(expunge bool) error {
+	if mb.closed {
+		return errors.New("mbox: Mailbox is closed")
+	}
+
+	changed := false
+	var deleted []bool
+	for _, msg := range mb.msgs {
+		changed = changed || msg.pending != nil || (expunge && msg.deleted)
+		deleted = append(deleted, msg.deleted)
+	}
+	if !changed {
+		return nil
+	}
+
+	err := mb.rewrite(func(w io.Writer) error {
+		for i := range mb.msgs {
+			msg := &mb.msgs[i]
+			if expunge && msg.deleted {
+				continue
+			}
+
+			raw := mb.raw(msg)
+			if p := msg.pending; p != nil {
+				if _, err := io.Copy(w, io.NewSectionReader(raw, 0, p.start)); err != nil {
+					return err
+				}
+				if _, err := w.Write(p.header); err != nil {
+					return err
+				}
+				raw = io.NewSectionReader(raw, p.end, msg.size-p.end)
+			}
+			if _, err := io.Copy(w, raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !expunge && len(deleted) == len(mb.msgs) {
+		for i := range mb.msgs {
+			mb.msgs[i].deleted = deleted[i]
+		}
+	}
+	return nil
+}
+
+// rewrite replaces the mailbox file with the output of write. The new file is
+// locked before it replaces the old one.
+func (mb *Mailbox) rewrite(write func(w io.Writer) error) error {
+	fi, err := mb.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	dir, base := filepath.Split(mb.name)
+	f, err := ioutil.TempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	// The dotlock is held on the mailbox name, which stays the same. Other
+	// locks are held on the file itself, so the new file needs to be locked
+	// as well.
+	lockOptions := *mb.options.Lock
+	lockOptions.Methods = lockOptions.Methods &^ LockDotlock
+	var lock *Lock
+	if lockOptions.Methods != 0 {
+		lock, err = LockFile(f, true, &lockOptions)
+	}
+
+	if err == nil {
+		err = f.Chmod(fi.Mode().Perm())
+	}
+	if err == nil {
+		// Mail spools such as /var/mail rely on the ownership of mailboxes
+		err = copyOwner(f, fi)
+	}
+	if err == nil {
+		err = write(f)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpName, mb.name)
+	}
+	if err != nil {
+		if lock != nil {
+			lock.Unlock()
+		}
+		f.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	syncDir(dir)
+
+	// Release the locks on the old file, and take over the ones on the new
+	// file
+	var dotlock string
+	if mb.lock.methods&LockDotlock != 0 {
+		dotlock = mb.lock.dotlock
+		mb.lock.methods &^= LockDotlock
+		mb.lock.dotlock = ""
+	}
+	mb.lock.Unlock()
+	mb.f.Close()
+
+	if lock == nil {
+		lock = &Lock{f: f}
+	}
+	if dotlock != "" {
+		lock.methods |= LockDotlock
+		lock.dotlock = dotlock
+	}
+	mb.f, mb.lock = f, lock
+
+	return mb.scan()
+}
+
+// syncDir flushes the directory entry changes to disk. Errors are ignored,
+// since not all platforms support syncing directories.
+func syncDir(dir string) {
+	if dir == "" {
+		dir = "."
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Close releases the lock on the mailbox and closes it. Messages marked as
+// deleted but not expunged are kept, and pending header updates are
+// discarded.
+func (mb *Mailbox) Close() error {
+	if mb.closed {
+		return errors.New("mbox: Mailbox already closed")
+	}
+	mb.closed = true
+
+	err := mb.lock.Unlock()
+	if closeErr := mb.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
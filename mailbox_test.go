@@ -0,0 +1,316 @@
+package mbox
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailbox_Expunge(t *testing.T) {
+	name, cleanup := tempMailbox(t, mboxWithThreeMessages)
+	defer cleanup()
+
+	mb, err := OpenMailbox(name, nil)
+	if err != nil {
+		t.Fatalf("OpenMailbox() = %v", err)
+	}
+	defer mb.Close()
+
+	if mb.Len() != 3 {
+		t.Fatalf("Len() = %v, want 3", mb.Len())
+	}
+
+	r, err := mb.Message(1)
+	if err != nil {
+		t.Fatalf("Message() = %v", err)
+	}
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		t.Fatalf("mail.ReadMessage() = %v", err)
+	}
+	if s := msg.Header.Get("Subject"); s != "Another test" {
+		t.Errorf("Message(1) has subject %q", s)
+	}
+
+	if _, err := OpenMailbox(name, &MailboxOptions{Lock: &LockOptions{Timeout: -1}}); err != ErrLocked {
+		t.Errorf("OpenMailbox() on locked mailbox = %v, want ErrLocked", err)
+	}
+
+	if err := mb.Delete(1); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	if !mb.Deleted(1) {
+		t.Errorf("Deleted(1) = false after Delete(1)")
+	}
+	if err := mb.Expunge(); err != nil {
+		t.Fatalf("Expunge() = %v", err)
+	}
+
+	if mb.Len() != 2 {
+		t.Fatalf("Len() = %v after Expunge(), want 2", mb.Len())
+	}
+
+	second := strings.Index(mboxWithThreeMessages, "From derp.herp@example.com")
+	third := strings.Index(mboxWithThreeMessages, "From bernd.lauert@example.com")
+	want := mboxWithThreeMessages[:second] + mboxWithThreeMessages[third:]
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("Mailbox after Expunge():\n%q\nexpected:\n%q", string(b), want)
+	}
+
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(name), ".mbox.*")); len(matches) != 0 {
+		t.Errorf("Temporary files left behind: %v", matches)
+	}
+
+	if _, err := OpenMailbox(name, &MailboxOptions{Lock: &LockOptions{Timeout: -1}}); err != ErrLocked {
+		t.Errorf("OpenMailbox() after Expunge() = %v, want ErrLocked", err)
+	}
+
+	r, err = mb.Message(1)
+	if err != nil {
+		t.Fatalf("Message() = %v", err)
+	}
+	if msg, err = mail.ReadMessage(r); err != nil {
+		t.Fatalf("mail.ReadMessage() = %v", err)
+	}
+	if s := msg.Header.Get("Subject"); s != "A last test" {
+		t.Errorf("Message(1) after Expunge() has subject %q", s)
+	}
+}
+
+func TestMailbox_rewriteError(t *testing.T) {
+	name, cleanup := tempMailbox(t, mboxWithThreeMessages)
+	defer cleanup()
+
+	mb, err := OpenMailbox(name, nil)
+	if err != nil {
+		t.Fatalf("OpenMailbox() = %v", err)
+	}
+	defer mb.Close()
+
+	errFail := errors.New("fail")
+	err = mb.rewrite(func(w io.Writer) error {
+		io.WriteString(w, "From partial")
+		return errFail
+	})
+	if err != errFail {
+		t.Errorf("rewrite() = %v, want %v", err, errFail)
+	}
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != mboxWithThreeMessages {
+		t.Errorf("Mailbox modified after failed rewrite:\n%q", string(b))
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(name), ".mbox.*")); len(matches) != 0 {
+		t.Errorf("Temporary files left behind: %v", matches)
+	}
+}
+
+func TestMailbox_SetFlags(t *testing.T) {
+	name, cleanup := tempMailbox(t, mboxWithThreeMessages)
+	defer cleanup()
+
+	mb, err := OpenMailbox(name, nil)
+	if err != nil {
+		t.Fatalf("OpenMailbox() = %v", err)
+	}
+	defer mb.Close()
+
+	if err := mb.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// No Status field yet: the update is pending
+	if err := mb.SetFlags(0, FlagRead); err != nil {
+		t.Fatalf("SetFlags() = %v", err)
+	}
+	if flags, err := mb.Flags(0); err != nil || flags != FlagRead {
+		t.Errorf("Flags() = %v, %v, want %v", flags, err, FlagRead)
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != mboxWithThreeMessages {
+		t.Errorf("Mailbox modified before Flush()")
+	}
+
+	if err := mb.Flush(); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+	if !mb.Deleted(2) {
+		t.Errorf("Flush() cleared deleted mark")
+	}
+
+	want := strings.Replace(mboxWithThreeMessages, "Subject: Test\n", "Subject: Test\nStatus: R \nX-Status:     \n", 1)
+	if b, err = ioutil.ReadFile(name); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("Mailbox after Flush():\n%q\nexpected:\n%q", string(b), want)
+	}
+
+	// The fields are padded: the update is done in place
+	flags := FlagRead | FlagOld | FlagAnswered | FlagFlagged | FlagDraft | FlagDeleted
+	if err := mb.SetFlags(0, flags); err != nil {
+		t.Fatalf("SetFlags() = %v", err)
+	}
+	if mb.msgs[0].pending != nil {
+		t.Errorf("SetFlags() on padded fields wasn't done in place")
+	}
+
+	want = strings.Replace(want, "Status: R \nX-Status:     \n", "Status: RO\nX-Status: AFTD\n", 1)
+	if b, err = ioutil.ReadFile(name); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("Mailbox after in-place SetFlags():\n%q\nexpected:\n%q", string(b), want)
+	}
+	if got, err := mb.Flags(0); err != nil || got != flags {
+		t.Errorf("Flags() = %v, %v, want %v", got, err, flags)
+	}
+}
+
+func TestMailbox_mmdf(t *testing.T) {
+	const mmdf = "\x01\x01\x01\x01\n" +
+		"From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: Test\n\nHi.\n" +
+		"\x01\x01\x01\x01\n" +
+		"\x01\x01\x01\x01\n" +
+		"Subject: Another test\n\nBye.\n" +
+		"\x01\x01\x01\x01\n"
+
+	name, cleanup := tempMailbox(t, mmdf)
+	defer cleanup()
+
+	mb, err := OpenMailbox(name, &MailboxOptions{Format: FormatMMDF})
+	if err != nil {
+		t.Fatalf("OpenMailbox() = %v", err)
+	}
+	defer mb.Close()
+
+	if mb.Len() != 2 {
+		t.Fatalf("Len() = %v, want 2", mb.Len())
+	}
+	for i := 0; i < mb.Len(); i++ {
+		if err := mb.SetFlags(i, FlagRead|FlagOld); err != nil {
+			t.Fatalf("SetFlags() = %v", err)
+		}
+	}
+	if err := mb.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := mb.Expunge(); err != nil {
+		t.Fatalf("Expunge() = %v", err)
+	}
+
+	want := "\x01\x01\x01\x01\n" +
+		"Subject: Another test\nStatus: RO\nX-Status:     \n\nBye.\n" +
+		"\x01\x01\x01\x01\n"
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("Mailbox after Expunge():\n%q\nexpected:\n%q", string(b), want)
+	}
+}
+
+// TestAppendHelperProcess isn't a real test: it's used by
+// TestMailbox_expungeWhileAppending to append to a mailbox from another
+// process.
+func TestAppendHelperProcess(t *testing.T) {
+	name := os.Getenv("MBOX_TEST_APPEND_HELPER")
+	if name == "" {
+		return
+	}
+
+	fmt.Println("started")
+	err := func() error {
+		a, err := Append(name, &AppendOptions{Lock: &LockOptions{}})
+		if err != nil {
+			return err
+		}
+		date := time.Date(2015, time.January, 4, 0, 0, 0, 0, time.UTC)
+		if err := a.WriteMessage("helper@example.com", date, strings.NewReader("Subject: Appended\n\nHi.\n")); err != nil {
+			a.Close()
+			return err
+		}
+		return a.Close()
+	}()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestMailbox_expungeWhileAppending(t *testing.T) {
+	name, cleanup := tempMailbox(t, mboxWithThreeMessages)
+	defer cleanup()
+
+	mb, err := OpenMailbox(name, nil)
+	if err != nil {
+		t.Fatalf("OpenMailbox() = %v", err)
+	}
+	defer mb.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAppendHelperProcess$")
+	cmd.Env = append(os.Environ(), "MBOX_TEST_APPEND_HELPER="+name)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || l != "started\n" {
+		cmd.Wait()
+		t.Fatalf("Helper process failed to start: %q, %v", l, err)
+	}
+
+	// Let the helper open the mailbox and wait for the lock, then replace
+	// the mailbox file
+	time.Sleep(200 * time.Millisecond)
+	if err := mb.Delete(0); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	if err := mb.Expunge(); err != nil {
+		t.Fatalf("Expunge() = %v", err)
+	}
+	if err := mb.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	out, _ := ioutil.ReadAll(stdout)
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Helper process: %v: %s", err, out)
+	}
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := strings.Index(mboxWithThreeMessages, "From derp.herp@example.com")
+	want := mboxWithThreeMessages[second:] + "\n" +
+		"From helper@example.com Sun Jan  4 00:00:00 2015\nSubject: Appended\n\nHi.\n\n"
+	if string(b) != want {
+		t.Errorf("mailbox after concurrent expunge and append:\n%v\nwant:\n%v", string(b), want)
+	}
+}
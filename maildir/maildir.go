@@ -0,0 +1,259 @@
+// Package maildir converts between mbox archives and Maildir directories.
+//
+// Message flags stored in the Status and X-Status header fields are mapped to
+// Maildir info flags and back. See https://cr.yp.to/proto/maildir.html.
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+var maildirFlags = []struct {
+	flag mbox.Flags
+	c    byte
+}{
+	// Sorted by Maildir flag, as required by the info format
+	{mbox.FlagDraft, 'D'},
+	{mbox.FlagFlagged, 'F'},
+	{mbox.FlagAnswered, 'R'},
+	{mbox.FlagRead, 'S'},
+	{mbox.FlagDeleted, 'T'},
+}
+
+// info returns the Maildir info suffix for flags.
+func info(flags mbox.Flags) string {
+	s := ":2,"
+	for _, f := range maildirFlags {
+		if flags&f.flag != 0 {
+			s += string(f.c)
+		}
+	}
+	return s
+}
+
+// parseInfo returns the flags stored in the info suffix of a Maildir file
+// name.
+func parseInfo(name string) mbox.Flags {
+	i := strings.LastIndex(name, ":2,")
+	if i < 0 {
+		return 0
+	}
+	var flags mbox.Flags
+	for _, f := range maildirFlags {
+		if strings.IndexByte(name[i+3:], f.c) >= 0 {
+			flags |= f.flag
+		}
+	}
+	return flags
+}
+
+// Init creates the tmp, new and cur subdirectories of a Maildir, if they don't
+// exist yet.
+func Init(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var counter uint32
+
+// uniqueName returns a unique Maildir file name.
+func uniqueName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	hostname = strings.Replace(hostname, "/", `\057`, -1)
+	hostname = strings.Replace(hostname, ":", `\072`, -1)
+
+	now := time.Now()
+	n := atomic.AddUint32(&counter, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, hostname)
+}
+
+// FromMbox writes each message read from r to the Maildir at dir. Messages
+// without flags are delivered to new, the others to cur with their flags.
+// Since messages in cur are considered old, FlagOld is added to the flags of
+// messages converted back with ToMbox. The envelope sender is stored in a
+// Return-Path header field if the message doesn't have one, and the file
+// modification time is set to the delivery date.
+func FromMbox(dir string, r *mbox.Reader) error {
+	if err := Init(dir); err != nil {
+		return err
+	}
+
+	for {
+		mr, err := r.NextMessage()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		sender, date, _ := mbox.ParseFromLine(r.FromLine())
+		if err := deliver(dir, mr, sender, date); err != nil {
+			return err
+		}
+	}
+}
+
+func deliver(dir string, r io.Reader, sender string, date time.Time) error {
+	br := bufio.NewReader(r)
+	hdr, err := msgutil.ReadHeader(br)
+	if err != nil {
+		return err
+	}
+	var flags mbox.Flags
+	if m, err := mail.ReadMessage(bytes.NewReader(hdr)); err == nil {
+		flags = mbox.ParseFlags(m.Header)
+		if m.Header.Get("Return-Path") == "" {
+			hdr = append([]byte(msgutil.ReturnPathField(sender)), hdr...)
+		}
+	}
+
+	name := uniqueName()
+	tmpPath := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Maildir messages are stored with LF line endings
+	w := msgutil.NewLFWriter(f)
+	_, err = w.Write(hdr)
+	if err == nil {
+		_, err = io.Copy(w, br)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !date.IsZero() {
+		err = os.Chtimes(tmpPath, date, date)
+	}
+
+	// Messages in new can't have an info suffix, so messages with flags are
+	// delivered to cur
+	sub := "new"
+	if flags != 0 {
+		sub = "cur"
+		name += info(flags)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(dir, sub, name))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Join(dir, sub))
+}
+
+// syncDir flushes the directory entry changes to disk, so that deliveries are
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type maildirMessage struct {
+	path    string
+	modTime time.Time
+	flags   mbox.Flags
+}
+
+// ToMbox writes the messages of the Maildir at dir to w, in delivery order.
+// The envelope sender is derived from the Return-Path header field and the
+// date from the file modification time. Maildir info flags are stored in the
+// Status and X-Status header fields.
+func ToMbox(w *mbox.Writer, dir string) error {
+	var msgs []maildirMessage
+	for _, sub := range []string{"new", "cur"} {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return err
+		}
+		for _, fi := range infos {
+			if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			msg := maildirMessage{
+				path:    filepath.Join(dir, sub, fi.Name()),
+				modTime: fi.ModTime(),
+			}
+			if sub == "cur" {
+				msg.flags = parseInfo(fi.Name()) | mbox.FlagOld
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if !msgs[i].modTime.Equal(msgs[j].modTime) {
+			return msgs[i].modTime.Before(msgs[j].modTime)
+		}
+		return deliveryID(msgs[i].path) < deliveryID(msgs[j].path)
+	})
+
+	for _, msg := range msgs {
+		if err := writeMessage(w, &msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliveryID returns the part of a Maildir file name before the info suffix.
+func deliveryID(path string) string {
+	name := filepath.Base(path)
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+func writeMessage(w *mbox.Writer, msg *maildirMessage) error {
+	f, err := os.Open(msg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	hdr, err := msgutil.ReadHeader(br)
+	if err != nil {
+		return err
+	}
+	hdr = msgutil.SetStatus(hdr, msg.flags.Status(), msg.flags.XStatus())
+
+	return w.WriteMessage("", msg.modTime, io.MultiReader(bytes.NewReader(hdr), br))
+}
@@ -0,0 +1,123 @@
+package maildir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-mbox"
+)
+
+const mboxWithFlags = `From herp.derp@example.com Thu Jan  1 00:00:01 2015
+From: herp.derp@example.com (Herp Derp)
+Subject: Unread
+
+New message.
+
+From derp.herp@example.com Fri Jan  2 00:00:01 2015
+From: derp.herp@example.com (Derp Herp)
+Subject: Read and answered
+Status: RO
+X-Status: A
+
+Old message.
+
+From MAILER-DAEMON Sat Jan  3 00:00:01 2015
+From: MAILER-DAEMON@example.com
+Subject: Bounce
+Status: O
+
+Seen, but not read.
+
+`
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := FromMbox(dir, mbox.NewReader(strings.NewReader(mboxWithFlags))); err != nil {
+		t.Fatalf("FromMbox() = %v", err)
+	}
+
+	newFiles, _ := filepath.Glob(filepath.Join(dir, "new", "*"))
+	curFiles, _ := filepath.Glob(filepath.Join(dir, "cur", "*"))
+	if len(newFiles) != 1 || len(curFiles) != 2 {
+		t.Fatalf("Got %v messages in new and %v in cur, want 1 and 2", len(newFiles), len(curFiles))
+	}
+	var infos []string
+	for _, p := range curFiles {
+		infos = append(infos, p[strings.LastIndexByte(p, ':'):])
+	}
+	if !(infos[0] == ":2,RS" && infos[1] == ":2," || infos[0] == ":2," && infos[1] == ":2,RS") {
+		t.Errorf("Unexpected info suffixes: %q", infos)
+	}
+
+	b, err := ioutil.ReadFile(newFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Return-Path: <herp.derp@example.com>\n" +
+		"From: herp.derp@example.com (Herp Derp)\n" +
+		"Subject: Unread\n\nNew message.\n"
+	if string(b) != want {
+		t.Errorf("Maildir message:\n%q\nexpected:\n%q", string(b), want)
+	}
+
+	var out bytes.Buffer
+	w := mbox.NewWriter(&out)
+	if err := ToMbox(w, dir); err != nil {
+		t.Fatalf("ToMbox() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want = strings.Replace(mboxWithFlags, "From: herp.derp@example.com (Herp Derp)\n", "Return-Path: <herp.derp@example.com>\nFrom: herp.derp@example.com (Herp Derp)\n", 1)
+	want = strings.Replace(want, "From: derp.herp@example.com (Derp Herp)\n", "Return-Path: <derp.herp@example.com>\nFrom: derp.herp@example.com (Derp Herp)\n", 1)
+	want = strings.Replace(want, "From: MAILER-DAEMON@example.com\n", "Return-Path: <>\nFrom: MAILER-DAEMON@example.com\n", 1)
+	if out.String() != want {
+		t.Errorf("Mbox after round-trip:\n%q\nexpected:\n%q", out.String(), want)
+	}
+}
+
+func TestRoundTrip_readNotOld(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const in = "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Return-Path: <herp.derp@example.com>\n" +
+		"Subject: Read\n" +
+		"Status: R\n\nRead message.\n\n"
+	if err := FromMbox(dir, mbox.NewReader(strings.NewReader(in))); err != nil {
+		t.Fatalf("FromMbox() = %v", err)
+	}
+
+	curFiles, _ := filepath.Glob(filepath.Join(dir, "cur", "*:2,S"))
+	if len(curFiles) != 1 {
+		t.Fatalf("Got %v read messages in cur, want 1", len(curFiles))
+	}
+
+	var out bytes.Buffer
+	w := mbox.NewWriter(&out)
+	if err := ToMbox(w, dir); err != nil {
+		t.Fatalf("ToMbox() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages in cur are old
+	want := strings.Replace(in, "Status: R\n", "Status: RO\n", 1)
+	if out.String() != want {
+		t.Errorf("Mbox after round-trip:\n%q\nexpected:\n%q", out.String(), want)
+	}
+}
@@ -1,10 +1,53 @@
 // Package mbox parses and formats the mbox file format.
 //
 // As the mbox file format is not standardized this package expects the least
-// common denominator, the so called mboxo format.
+// common denominator, the so called mboxo format, unless another variant is
+// selected via the Format field of Reader and Writer.
 package mbox
 
 var (
 	header        = []byte("From ")
 	escapedHeader = append([]byte{'>'}, header...)
+	mmdfDelimiter = []byte("\x01\x01\x01\x01")
 )
+
+// Format is an mbox format variant.
+type Format int
+
+const (
+	// FormatMboxo is the mboxo format: lines starting with "From " in message
+	// bodies are escaped by prepending a '>', which is removed when reading.
+	FormatMboxo Format = iota
+	// FormatMboxcl2 is the mboxcl2 format, used on Solaris: each message
+	// header has a Content-Length field giving the size of the body, and
+	// lines starting with "From " are not escaped.
+	FormatMboxcl2
+	// FormatMMDF is the MMDF format: each message starts and ends with a line
+	// containing four ^A characters. A From line may follow the opening
+	// delimiter. Lines are not escaped.
+	FormatMMDF
+	// FormatMboxrd is the mboxrd format: lines matching ">*From " in message
+	// bodies are escaped by prepending a '>', so that escaping is reversible.
+	FormatMboxrd
+	// FormatMessage is a single message without From line, such as an .eml
+	// file. It is only supported by Reader.
+	FormatMessage
+)
+
+// String implements fmt.Stringer.
+func (f Format) String() string {
+	switch f {
+	case FormatMboxo:
+		return "mboxo"
+	case FormatMboxcl2:
+		return "mboxcl2"
+	case FormatMMDF:
+		return "mmdf"
+	case FormatMboxrd:
+		return "mboxrd"
+	case FormatMessage:
+		return "message"
+	default:
+		return "unknown"
+	}
+}
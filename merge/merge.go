@@ -0,0 +1,463 @@
+// Package merge merges mbox archives into a single one sorted by date.
+//
+// Inputs which don't fit in memory are sorted externally: sorted runs of
+// messages are written to temporary files, then merged.
+package merge
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+// Key is the date messages are sorted by.
+type Key int
+
+const (
+	// KeyEnvelopeDate sorts messages by the date of their From line, falling
+	// back to the date derived from their header.
+	KeyEnvelopeDate Key = iota
+	// KeyHeaderDate sorts messages by their Date header field, falling back
+	// to the date of their From line.
+	KeyHeaderDate
+)
+
+// defaultMaxMemory is the default value of Options.MaxMemory.
+const defaultMaxMemory = 64 * 1024 * 1024
+
+// maxFanIn is the maximum number of sorted runs merged at once, to bound the
+// number of open files.
+const maxFanIn = 64
+
+// Options contains options for Merge.
+type Options struct {
+	// Key is the date messages are sorted by.
+	Key Key
+	// MaxMemory is the number of bytes of messages buffered in memory before
+	// a sorted run is written to a temporary file. Zero means a default of
+	// 64 MiB.
+	MaxMemory int64
+	// TempDir is the directory where temporary files are created. Defaults
+	// to os.TempDir.
+	TempDir string
+	// Sorted indicates that each input is already sorted: inputs are then
+	// merged directly, without any temporary file.
+	Sorted bool
+}
+
+// Merge reads messages from inputs and writes them to w sorted by date.
+// Messages with the same date, or without any date, are kept in input order.
+// Messages without any date are written first.
+//
+// The From line of messages is preserved, but their text isn't copied byte
+// for byte: it goes through the line ending conversions of the Readers and of
+// w. Messages with CRLF line endings are written with LF line endings, unless
+// w writes FormatMboxcl2, in which case all messages are written with CRLF
+// line endings. Only messages both read and written as FormatMboxcl2 keep
+// their line endings.
+func Merge(w *mbox.Writer, inputs []*mbox.Reader, options *Options) error {
+	if options == nil {
+		options = new(Options)
+	}
+
+	if options.Sorted {
+		srcs := make([]source, len(inputs))
+		var seq uint64
+		for i, r := range inputs {
+			srcs[i] = &readerSource{r: r, key: options.Key, seq: &seq}
+		}
+		return mergeSources(srcs, writeTo(w))
+	}
+
+	s := &sorter{options: options, fanIn: maxFanIn}
+	defer s.cleanup()
+
+	var seq uint64
+	for _, r := range inputs {
+		src := &readerSource{r: r, key: options.Key, seq: &seq}
+		for {
+			rec, err := src.next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if err := s.add(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return s.finish(w)
+}
+
+// record is a message with its sort key.
+type record struct {
+	dated    bool
+	sec      int64 // Unix time, if dated
+	nsec     int32
+	seq      uint64
+	fromLine string
+	data     []byte // message text, as returned by the Reader
+}
+
+func (rec *record) less(other *record) bool {
+	if rec.dated != other.dated {
+		return !rec.dated
+	}
+	if rec.sec != other.sec {
+		return rec.sec < other.sec
+	}
+	if rec.nsec != other.nsec {
+		return rec.nsec < other.nsec
+	}
+	return rec.seq < other.seq
+}
+
+func (rec *record) size() int64 {
+	return int64(len(rec.fromLine) + len(rec.data) + 64)
+}
+
+// writeTo returns a function writing records to w.
+func writeTo(w *mbox.Writer) func(rec *record) error {
+	return func(rec *record) error {
+		return writeRecord(w, rec)
+	}
+}
+
+func writeRecord(w *mbox.Writer, rec *record) error {
+	var mw io.WriteCloser
+	var err error
+	if rec.fromLine != "" {
+		mw, err = w.CreateMessageFromLine(rec.fromLine)
+	} else {
+		var from string
+		var t time.Time
+		if msg, err := mail.ReadMessage(bytes.NewReader(rec.data)); err == nil {
+			from, t = mbox.HeaderEnvelope(msg.Header)
+		}
+		mw, err = w.CreateMessage(from, t)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := mw.Write(rec.data); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// source is a sorted sequence of records. next returns io.EOF at the end.
+type source interface {
+	next() (*record, error)
+}
+
+// readerSource reads records from an mbox.Reader.
+type readerSource struct {
+	r   *mbox.Reader
+	key Key
+	seq *uint64
+}
+
+func (src *readerSource) next() (*record, error) {
+	msg, err := src.r.NextMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, msg); err != nil {
+		return nil, err
+	}
+
+	rec := &record{fromLine: src.r.FromLine(), seq: *src.seq, data: buf.Bytes()}
+	*src.seq++
+
+	_, envelopeDate, _ := mbox.ParseFromLine(rec.fromLine)
+	var headerDate time.Time
+	hdr, _ := msgutil.ReadHeader(bufio.NewReader(bytes.NewReader(rec.data)))
+	if msg, err := mail.ReadMessage(bytes.NewReader(hdr)); err == nil {
+		if src.key == KeyHeaderDate {
+			headerDate, _ = msg.Header.Date()
+		} else if envelopeDate.IsZero() {
+			_, envelopeDate = mbox.HeaderEnvelope(msg.Header)
+		}
+	}
+
+	date := envelopeDate
+	if src.key == KeyHeaderDate && !headerDate.IsZero() {
+		date = headerDate
+	}
+	if !date.IsZero() {
+		rec.dated = true
+		rec.sec = date.Unix()
+		rec.nsec = int32(date.Nanosecond())
+	}
+	return rec, nil
+}
+
+// sorter sorts records, spilling sorted runs to temporary files. Runs are
+// closed until they're merged, at most fanIn at a time.
+type sorter struct {
+	options *Options
+	fanIn   int
+	buf     []*record
+	size    int64
+	runs    []string
+}
+
+func (s *sorter) maxMemory() int64 {
+	if s.options.MaxMemory > 0 {
+		return s.options.MaxMemory
+	}
+	return defaultMaxMemory
+}
+
+func (s *sorter) add(rec *record) error {
+	s.buf = append(s.buf, rec)
+	s.size += rec.size()
+	if s.size >= s.maxMemory() {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *sorter) sort() {
+	sort.Slice(s.buf, func(i, j int) bool {
+		return s.buf[i].less(s.buf[j])
+	})
+}
+
+// spill writes the buffered records to a new sorted run.
+func (s *sorter) spill() error {
+	s.sort()
+	err := s.writeRun(func(emit func(rec *record) error) error {
+		return mergeSources([]source{&sliceSource{s.buf}}, emit)
+	})
+	s.buf = nil
+	s.size = 0
+	return err
+}
+
+// writeRun creates a new run and writes to it the records emitted by f.
+func (s *sorter) writeRun(f func(emit func(rec *record) error) error) error {
+	file, err := ioutil.TempFile(s.options.TempDir, "mbox-merge-")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, file.Name())
+
+	bw := bufio.NewWriter(file)
+	err = f(func(rec *record) error {
+		return encodeRecord(bw, rec)
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// mergeRuns merges sorted runs, emitting their records in order.
+func mergeRuns(names []string, emit func(rec *record) error) error {
+	srcs := make([]source, 0, len(names))
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		srcs = append(srcs, &runSource{r: bufio.NewReader(f)})
+	}
+	return mergeSources(srcs, emit)
+}
+
+// finish writes all records to w in order.
+func (s *sorter) finish(w *mbox.Writer) error {
+	if len(s.runs) == 0 {
+		s.sort()
+		return mergeSources([]source{&sliceSource{s.buf}}, writeTo(w))
+	}
+
+	if len(s.buf) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	// Merge the oldest runs together until few enough are left
+	for len(s.runs) > s.fanIn {
+		names := s.runs[:s.fanIn]
+		err := s.writeRun(func(emit func(rec *record) error) error {
+			return mergeRuns(names, emit)
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			os.Remove(name)
+		}
+		s.runs = s.runs[s.fanIn:]
+	}
+	return mergeRuns(s.runs, writeTo(w))
+}
+
+// cleanup removes the temporary files.
+func (s *sorter) cleanup() {
+	for _, name := range s.runs {
+		os.Remove(name)
+	}
+	s.runs = nil
+}
+
+// sliceSource reads records from a sorted slice.
+type sliceSource struct {
+	recs []*record
+}
+
+func (src *sliceSource) next() (*record, error) {
+	if len(src.recs) == 0 {
+		return nil, io.EOF
+	}
+	rec := src.recs[0]
+	src.recs = src.recs[1:]
+	return rec, nil
+}
+
+// A run is a sequence of encoded records: whether the record is dated, the
+// seconds and nanoseconds of the date, the sequence number, the length of the
+// From line, the From line, the length of the message text and the message
+// text. Numbers are encoded as varints, the seconds as a signed one.
+
+func encodeRecord(w *bufio.Writer, rec *record) error {
+	var buf [binary.MaxVarintLen64]byte
+	var dated uint64
+	if rec.dated {
+		dated = 1
+	}
+	n := binary.PutUvarint(buf[:], dated)
+	w.Write(buf[:n])
+	n = binary.PutVarint(buf[:], rec.sec)
+	w.Write(buf[:n])
+	for _, v := range []uint64{uint64(rec.nsec), rec.seq, uint64(len(rec.fromLine))} {
+		n := binary.PutUvarint(buf[:], v)
+		w.Write(buf[:n])
+	}
+	w.WriteString(rec.fromLine)
+	n = binary.PutUvarint(buf[:], uint64(len(rec.data)))
+	w.Write(buf[:n])
+	_, err := w.Write(rec.data)
+	return err
+}
+
+var errInvalidRun = errors.New("merge: invalid temporary file")
+
+// runSource reads records from a sorted run.
+type runSource struct {
+	r *bufio.Reader
+}
+
+func (src *runSource) next() (*record, error) {
+	dated, err := binary.ReadUvarint(src.r)
+	if err != nil {
+		return nil, err
+	}
+	sec, err := binary.ReadVarint(src.r)
+	if err != nil {
+		return nil, errInvalidRun
+	}
+
+	var fields [3]uint64
+	for i := range fields {
+		if fields[i], err = binary.ReadUvarint(src.r); err != nil {
+			return nil, errInvalidRun
+		}
+	}
+	fromLine := make([]byte, fields[2])
+	if _, err := io.ReadFull(src.r, fromLine); err != nil {
+		return nil, errInvalidRun
+	}
+	n, err := binary.ReadUvarint(src.r)
+	if err != nil {
+		return nil, errInvalidRun
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(src.r, data); err != nil {
+		return nil, errInvalidRun
+	}
+
+	return &record{
+		dated:    dated != 0,
+		sec:      sec,
+		nsec:     int32(fields[0]),
+		seq:      fields[1],
+		fromLine: string(fromLine),
+		data:     data,
+	}, nil
+}
+
+// mergeSources emits the records of sorted sources in order.
+func mergeSources(srcs []source, emit func(rec *record) error) error {
+	h := make(recordHeap, 0, len(srcs))
+	for _, src := range srcs {
+		rec, err := src.next()
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+		h = append(h, heapItem{rec, src})
+	}
+	heap.Init(&h)
+
+	for len(h) > 0 {
+		item := h[0]
+		if err := emit(item.rec); err != nil {
+			return err
+		}
+
+		rec, err := item.src.next()
+		if err == io.EOF {
+			heap.Pop(&h)
+			continue
+		} else if err != nil {
+			return err
+		}
+		h[0].rec = rec
+		heap.Fix(&h, 0)
+	}
+	return nil
+}
+
+type heapItem struct {
+	rec *record
+	src source
+}
+
+type recordHeap []heapItem
+
+func (h recordHeap) Len() int           { return len(h) }
+func (h recordHeap) Less(i, j int) bool { return h[i].rec.less(h[j].rec) }
+func (h recordHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *recordHeap) Push(x interface{}) {
+	*h = append(*h, x.(heapItem))
+}
+
+func (h *recordHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,196 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-mbox"
+)
+
+// testMbox returns an mbox with one message per day of January 2015. The Date
+// fields are in the reverse order of the envelope dates.
+func testMbox(days []int, name string) string {
+	var sb strings.Builder
+	for _, d := range days {
+		t := time.Date(2015, time.January, d, 0, 0, 0, 0, time.UTC)
+		fmt.Fprintf(&sb, "From herp.derp@example.com %v remote from %v\n", t.Format(time.ANSIC), name)
+		fmt.Fprintf(&sb, "Subject: %v-%v\n", name, d)
+		fmt.Fprintf(&sb, "Date: %v\n\n", t.AddDate(0, 0, -2*d).Format(time.RFC1123Z))
+		fmt.Fprintf(&sb, ">From the body.\n\n")
+	}
+	return sb.String()
+}
+
+func subjects(t *testing.T, b []byte) []string {
+	r := mbox.NewReader(bytes.NewReader(b))
+	var l []string
+	for {
+		msg, err := r.NextMessage()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l = append(l, strings.TrimPrefix(strings.SplitN(string(b), "\r\n", 2)[0], "Subject: "))
+	}
+	return l
+}
+
+func testMerge(t *testing.T, inputs []string, options *Options) []byte {
+	var readers []*mbox.Reader
+	for _, s := range inputs {
+		readers = append(readers, mbox.NewReader(strings.NewReader(s)))
+	}
+
+	var buf bytes.Buffer
+	w := mbox.NewWriter(&buf)
+	if err := Merge(w, readers, options); err != nil {
+		t.Fatalf("Merge() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestMerge(t *testing.T) {
+	inputs := []string{
+		testMbox([]int{5, 1, 3}, "a"),
+		testMbox([]int{4, 2, 3}, "b"),
+	}
+	want := []string{"a-1", "b-2", "a-3", "b-3", "b-4", "a-5"}
+
+	for _, maxMemory := range []int64{0, 1, 400} {
+		t.Run(fmt.Sprintf("MaxMemory=%v", maxMemory), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "merge-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			b := testMerge(t, inputs, &Options{MaxMemory: maxMemory, TempDir: dir})
+			if got := subjects(t, b); !reflect.DeepEqual(got, want) {
+				t.Errorf("Merge() order = %v, want %v", got, want)
+			}
+
+			// Temporary files are removed
+			if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+				t.Errorf("%v temporary files left", len(names))
+			}
+		})
+	}
+}
+
+func TestMerge_preserve(t *testing.T) {
+	in := testMbox([]int{2, 1}, "a")
+	b := testMerge(t, []string{in}, nil)
+
+	msgs := strings.SplitAfter(in, ">From the body.\n\n")
+	want := msgs[1] + msgs[0]
+	if string(b) != want {
+		t.Errorf("Merge() = %q, want %q", b, want)
+	}
+}
+
+func TestMerge_headerDate(t *testing.T) {
+	inputs := []string{
+		testMbox([]int{1, 3}, "a"),
+		testMbox([]int{2}, "b"),
+	}
+	b := testMerge(t, inputs, &Options{Key: KeyHeaderDate})
+	want := []string{"a-3", "b-2", "a-1"}
+	if got := subjects(t, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge() order = %v, want %v", got, want)
+	}
+}
+
+func TestMerge_sorted(t *testing.T) {
+	inputs := []string{
+		testMbox([]int{1, 3, 5}, "a"),
+		testMbox([]int{2, 3, 4}, "b"),
+		testMbox(nil, "c"),
+	}
+	b := testMerge(t, inputs, &Options{Sorted: true})
+	want := []string{"a-1", "b-2", "a-3", "b-3", "b-4", "a-5"}
+	if got := subjects(t, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge() order = %v, want %v", got, want)
+	}
+}
+
+func TestMerge_farDates(t *testing.T) {
+	var sb strings.Builder
+	for _, year := range []int{2300, 1600, 2015} {
+		d := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		fmt.Fprintf(&sb, "From herp.derp@example.com %v\n", d.Format(time.ANSIC))
+		fmt.Fprintf(&sb, "Subject: %v\n\n", year)
+	}
+	fmt.Fprintf(&sb, "From herp.derp@example.com\nSubject: undated\n\n")
+	want := []string{"undated", "1600", "2015", "2300"}
+
+	for _, maxMemory := range []int64{0, 1} {
+		b := testMerge(t, []string{sb.String()}, &Options{MaxMemory: maxMemory})
+		if got := subjects(t, b); !reflect.DeepEqual(got, want) {
+			t.Errorf("Merge(MaxMemory=%v) order = %v, want %v", maxMemory, got, want)
+		}
+	}
+}
+
+func TestMerge_fanIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// One run per message, merged two at a time
+	s := &sorter{options: &Options{MaxMemory: 1, TempDir: dir}, fanIn: 2}
+	defer s.cleanup()
+	var seq uint64
+	for _, in := range []string{testMbox([]int{5, 1, 3, 7}, "a"), testMbox([]int{4, 2, 6}, "b")} {
+		src := &readerSource{r: mbox.NewReader(strings.NewReader(in)), seq: &seq}
+		for {
+			rec, err := src.next()
+			if err != nil {
+				break
+			}
+			if err := s.add(rec); err != nil {
+				t.Fatalf("add() = %v", err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	w := mbox.NewWriter(&buf)
+	if err := s.finish(w); err != nil {
+		t.Fatalf("finish() = %v", err)
+	}
+	w.Close()
+	want := []string{"a-1", "b-2", "a-3", "b-4", "a-5", "b-6", "a-7"}
+	if got := subjects(t, buf.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge() order = %v, want %v", got, want)
+	}
+	if len(s.runs) > 2 {
+		t.Errorf("%v runs left, want at most 2", len(s.runs))
+	}
+}
+
+func TestMerge_lineEndings(t *testing.T) {
+	in := "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: CRLF\r\n\r\nHi.\r\n\n"
+
+	// CRLF line endings aren't preserved
+	b := testMerge(t, []string{in}, nil)
+	want := "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: CRLF\n\nHi.\n\n"
+	if string(b) != want {
+		t.Errorf("Merge() = %q, want %q", b, want)
+	}
+}
@@ -0,0 +1,360 @@
+// Package mh converts between mbox archives and MH mail folders, as used by
+// nmh.
+//
+// An MH folder is a directory containing one file per message, named after
+// the message number, and a .mh_sequences file listing named sequences of
+// messages. The "unseen", "flagged" and "replied" sequences are mapped to the
+// Status and X-Status header fields and back.
+package mh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+// SequencesFile is the name of the file storing sequences in an MH folder.
+const SequencesFile = ".mh_sequences"
+
+// Sequence names mapped to message flags.
+const (
+	SequenceUnseen  = "unseen"
+	SequenceFlagged = "flagged"
+	SequenceReplied = "replied"
+)
+
+// Range is an inclusive range of message numbers.
+type Range struct {
+	First, Last int
+}
+
+// Sequence is a list of message number ranges. Ranges are stored as is, so
+// that large ranges don't need to be expanded.
+type Sequence []Range
+
+// Add appends the message number n to the sequence.
+func (seq Sequence) Add(n int) Sequence {
+	if len(seq) > 0 && seq[len(seq)-1].Last == n-1 {
+		seq[len(seq)-1].Last = n
+		return seq
+	}
+	return append(seq, Range{n, n})
+}
+
+// normalize returns the ranges of seq sorted, with overlapping and adjacent
+// ranges merged.
+func (seq Sequence) normalize() Sequence {
+	ranges := append(Sequence(nil), seq...)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].First < ranges[j].First
+	})
+
+	var merged Sequence
+	for _, r := range ranges {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if r.First <= last.Last || r.First-1 == last.Last {
+				if r.Last > last.Last {
+					last.Last = r.Last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Contains reports whether the message number n is in the sequence.
+func (seq Sequence) Contains(n int) bool {
+	for _, r := range seq {
+		if r.First <= n && n <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// Sequences maps sequence names to message numbers.
+type Sequences map[string]Sequence
+
+// ReadSequences reads the sequences of the MH folder at dir. A missing
+// sequences file is treated as empty.
+func ReadSequences(dir string) (Sequences, error) {
+	f, err := os.Open(filepath.Join(dir, SequencesFile))
+	if os.IsNotExist(err) {
+		return make(Sequences), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seqs := make(Sequences)
+	scanner := bufio.NewScanner(f)
+	var name string
+	for scanner.Scan() {
+		l := scanner.Text()
+		if l == "" {
+			continue
+		}
+		// Long sequences may be continued on lines starting with whitespace
+		if l[0] != ' ' && l[0] != '\t' {
+			i := strings.IndexByte(l, ':')
+			if i < 0 {
+				return nil, fmt.Errorf("mh: malformed sequence line %q", l)
+			}
+			name, l = l[:i], l[i+1:]
+		}
+
+		for _, r := range strings.Fields(l) {
+			start, end := r, r
+			if i := strings.IndexByte(r, '-'); i >= 0 {
+				start, end = r[:i], r[i+1:]
+			}
+			first, err := strconv.Atoi(start)
+			if err != nil {
+				return nil, fmt.Errorf("mh: malformed sequence range %q", r)
+			}
+			last, err := strconv.Atoi(end)
+			if err != nil || last < first {
+				return nil, fmt.Errorf("mh: malformed sequence range %q", r)
+			}
+			seqs[name] = append(seqs[name], Range{first, last})
+		}
+	}
+	return seqs, scanner.Err()
+}
+
+// WriteSequences replaces the sequences file of the MH folder at dir.
+func WriteSequences(dir string, seqs Sequences) error {
+	var names []string
+	for name := range seqs {
+		if len(seqs[name]) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		b.WriteString(name + ":")
+		for _, r := range seqs[name].normalize() {
+			if r.First == r.Last {
+				fmt.Fprintf(&b, " %d", r.First)
+			} else {
+				fmt.Fprintf(&b, " %d-%d", r.First, r.Last)
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	f, err := ioutil.TempFile(dir, SequencesFile+".")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteTo(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, SequencesFile))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// messageNumbers returns the sorted message numbers of the MH folder at dir.
+func messageNumbers(dir string) ([]int, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, fi := range infos {
+		n, err := strconv.Atoi(fi.Name())
+		if err != nil || n <= 0 || !fi.Mode().IsRegular() {
+			continue
+		}
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+// FromMbox writes each message read from r to the MH folder at dir, creating
+// it if needed. Messages are numbered after the existing ones. Messages
+// without the FlagRead flag are added to the unseen sequence, and flagged and
+// answered messages to the flagged and replied sequences. The envelope sender
+// is stored in a Return-Path header field if the message doesn't have one.
+func FromMbox(dir string, r *mbox.Reader) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	nums, err := messageNumbers(dir)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(nums) > 0 {
+		next = nums[len(nums)-1] + 1
+	}
+
+	seqs, err := ReadSequences(dir)
+	if err != nil {
+		return err
+	}
+
+	for {
+		mr, err := r.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		sender, _, _ := mbox.ParseFromLine(r.FromLine())
+		flags, err := writeMessage(filepath.Join(dir, strconv.Itoa(next)), mr, sender)
+		if err != nil {
+			return err
+		}
+
+		if flags&mbox.FlagRead == 0 {
+			seqs[SequenceUnseen] = seqs[SequenceUnseen].Add(next)
+		}
+		if flags&mbox.FlagFlagged != 0 {
+			seqs[SequenceFlagged] = seqs[SequenceFlagged].Add(next)
+		}
+		if flags&mbox.FlagAnswered != 0 {
+			seqs[SequenceReplied] = seqs[SequenceReplied].Add(next)
+		}
+		next++
+	}
+
+	return WriteSequences(dir, seqs)
+}
+
+func writeMessage(path string, r io.Reader, sender string) (mbox.Flags, error) {
+	br := bufio.NewReader(r)
+	hdr, err := msgutil.ReadHeader(br)
+	if err != nil {
+		return 0, err
+	}
+	var flags mbox.Flags
+	if m, err := mail.ReadMessage(bytes.NewReader(hdr)); err == nil {
+		flags = mbox.ParseFlags(m.Header)
+		if m.Header.Get("Return-Path") == "" {
+			hdr = append([]byte(msgutil.ReturnPathField(sender)), hdr...)
+		}
+	}
+	hdr = msgutil.StripFields(hdr, "Status", "X-Status")
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	// MH messages are stored with LF line endings
+	w := msgutil.NewLFWriter(f)
+	_, err = w.Write(hdr)
+	if err == nil {
+		_, err = io.Copy(w, br)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return flags, err
+}
+
+// ToMbox writes the messages of the MH folder at dir to w, in message number
+// order. Sequences are mapped to the Status and X-Status header fields: all
+// messages are marked as old, and messages not in the unseen sequence as
+// read. The envelope sender and date are derived from the message header, as
+// in mbox.Writer.WriteMessage.
+func ToMbox(w *mbox.Writer, dir string) error {
+	nums, err := messageNumbers(dir)
+	if err != nil {
+		return err
+	}
+	seqs, err := ReadSequences(dir)
+	if err != nil {
+		return err
+	}
+
+	unseen := members(seqs[SequenceUnseen], nums)
+	flagged := members(seqs[SequenceFlagged], nums)
+	replied := members(seqs[SequenceReplied], nums)
+
+	for _, n := range nums {
+		flags := mbox.FlagOld
+		if !unseen[n] {
+			flags |= mbox.FlagRead
+		}
+		if flagged[n] {
+			flags |= mbox.FlagFlagged
+		}
+		if replied[n] {
+			flags |= mbox.FlagAnswered
+		}
+
+		if err := readMessage(w, filepath.Join(dir, strconv.Itoa(n)), flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// members returns the set of the sorted message numbers nums which are in
+// seq.
+func members(seq Sequence, nums []int) map[int]bool {
+	set := make(map[int]bool)
+	i := 0
+	for _, r := range seq.normalize() {
+		for i < len(nums) && nums[i] < r.First {
+			i++
+		}
+		for i < len(nums) && nums[i] <= r.Last {
+			set[nums[i]] = true
+			i++
+		}
+	}
+	return set
+}
+
+func readMessage(w *mbox.Writer, path string, flags mbox.Flags) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	hdr, err := msgutil.ReadHeader(br)
+	if err != nil {
+		return err
+	}
+
+	hdr = msgutil.SetStatus(hdr, flags.Status(), flags.XStatus())
+
+	return w.WriteMessage("", time.Time{}, io.MultiReader(bytes.NewReader(hdr), br))
+}
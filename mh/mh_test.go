@@ -0,0 +1,174 @@
+package mh
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-mbox"
+)
+
+const mboxWithFlags = `From herp.derp@example.com Thu Jan  1 00:00:01 2015
+Return-Path: <herp.derp@example.com>
+From: herp.derp@example.com (Herp Derp)
+Date: Thu, 01 Jan 2015 00:00:01 +0000
+Subject: Unread
+
+New message.
+
+From derp.herp@example.com Fri Jan  2 00:00:01 2015
+Return-Path: <derp.herp@example.com>
+From: derp.herp@example.com (Derp Herp)
+Date: Fri, 02 Jan 2015 00:00:01 +0000
+Subject: Read, flagged and answered
+Status: RO
+X-Status: AF
+
+Old message.
+
+`
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mh-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An existing message, read
+	if err := ioutil.WriteFile(filepath.Join(dir, "1"), []byte("From: bernd.lauert@example.com\nDate: Wed, 31 Dec 2014 00:00:01 +0000\nSubject: Existing\n\nHi.\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := FromMbox(dir, mbox.NewReader(strings.NewReader(mboxWithFlags))); err != nil {
+		t.Fatalf("FromMbox() = %v", err)
+	}
+
+	seqs, err := ReadSequences(dir)
+	if err != nil {
+		t.Fatalf("ReadSequences() = %v", err)
+	}
+	wantSeqs := Sequences{
+		SequenceUnseen:  {{2, 2}},
+		SequenceFlagged: {{3, 3}},
+		SequenceReplied: {{3, 3}},
+	}
+	if !reflect.DeepEqual(seqs, wantSeqs) {
+		t.Errorf("ReadSequences() = %v, want %v", seqs, wantSeqs)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Return-Path: <derp.herp@example.com>\n" +
+		"From: derp.herp@example.com (Derp Herp)\n" +
+		"Date: Fri, 02 Jan 2015 00:00:01 +0000\n" +
+		"Subject: Read, flagged and answered\n" +
+		"\n" +
+		"Old message.\n"
+	if string(b) != want {
+		t.Errorf("MH message:\n%q\nexpected:\n%q", string(b), want)
+	}
+
+	var out bytes.Buffer
+	w := mbox.NewWriter(&out)
+	if err := ToMbox(w, dir); err != nil {
+		t.Fatalf("ToMbox() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want = "From bernd.lauert@example.com Wed Dec 31 00:00:01 2014\n" +
+		"From: bernd.lauert@example.com\n" +
+		"Date: Wed, 31 Dec 2014 00:00:01 +0000\n" +
+		"Subject: Existing\n" +
+		"Status: RO\n" +
+		"\n" +
+		"Hi.\n" +
+		"\n" +
+		strings.Replace(mboxWithFlags, "Subject: Unread\n", "Subject: Unread\nStatus: O\n", 1)
+	if out.String() != want {
+		t.Errorf("Mbox after round-trip:\n%q\nexpected:\n%q", out.String(), want)
+	}
+}
+
+func TestWriteSequences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mh-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	seqs := Sequences{
+		SequenceUnseen: {{5, 5}, {1, 2}, {2, 3}, {7, 7}, {8, 8}},
+		"cur":          {{8, 8}},
+	}
+	if err := WriteSequences(dir, seqs); err != nil {
+		t.Fatalf("WriteSequences() = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, SequencesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "cur: 8\nunseen: 1-3 5 7-8\n"
+	if string(b) != want {
+		t.Errorf("Sequences file:\n%q\nexpected:\n%q", string(b), want)
+	}
+}
+
+func TestReadSequences_largeRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mh-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, SequencesFile), []byte("unseen: 2-2000000000\nflagged: 1\n 3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"1", "2", "3"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("Subject: "+name+"\n\nHi.\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seqs, err := ReadSequences(dir)
+	if err != nil {
+		t.Fatalf("ReadSequences() = %v", err)
+	}
+	wantSeqs := Sequences{
+		SequenceUnseen:  {{2, 2000000000}},
+		SequenceFlagged: {{1, 1}, {3, 3}},
+	}
+	if !reflect.DeepEqual(seqs, wantSeqs) {
+		t.Errorf("ReadSequences() = %v, want %v", seqs, wantSeqs)
+	}
+	if !seqs[SequenceUnseen].Contains(1999999999) || seqs[SequenceUnseen].Contains(1) {
+		t.Errorf("Contains() returned unexpected results for %v", seqs[SequenceUnseen])
+	}
+
+	var out bytes.Buffer
+	w := mbox.NewWriter(&out)
+	if err := ToMbox(w, dir); err != nil {
+		t.Fatalf("ToMbox() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []string{
+		"Subject: 1\nStatus: RO\nX-Status: F\n",
+		"Subject: 2\nStatus: O\n",
+		"Subject: 3\nStatus: O\nX-Status: F\n",
+	} {
+		if !strings.Contains(out.String(), status) {
+			t.Errorf("Mbox doesn't contain %q:\n%v", status, out.String())
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package mbox
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// MozillaFlags is a set of message flags stored by Thunderbird in the
+// X-Mozilla-Status and X-Mozilla-Status2 header fields. The low 16 bits are
+// stored in X-Mozilla-Status, the high 16 bits in X-Mozilla-Status2.
+type MozillaFlags uint32
+
+const (
+	// MozillaRead is set on messages which have been read.
+	MozillaRead MozillaFlags = 0x00000001
+	// MozillaReplied is set on messages which have been replied to.
+	MozillaReplied MozillaFlags = 0x00000002
+	// MozillaMarked is set on starred messages.
+	MozillaMarked MozillaFlags = 0x00000004
+	// MozillaExpunged is set on deleted messages, which are removed when the
+	// folder is compacted.
+	MozillaExpunged MozillaFlags = 0x00000008
+	// MozillaHasRe is set on messages whose subject started with "Re:",
+	// which Thunderbird strips from the stored subject.
+	MozillaHasRe MozillaFlags = 0x00000010
+	// MozillaElided is set on collapsed threads.
+	MozillaElided MozillaFlags = 0x00000020
+	// MozillaOffline is set on messages of remote folders available offline.
+	MozillaOffline MozillaFlags = 0x00000080
+	// MozillaWatched is set on watched threads.
+	MozillaWatched MozillaFlags = 0x00000100
+	// MozillaSenderAuthed is set on messages whose sender is authenticated.
+	MozillaSenderAuthed MozillaFlags = 0x00000200
+	// MozillaPartial is set on messages which have only been partially
+	// downloaded.
+	MozillaPartial MozillaFlags = 0x00000400
+	// MozillaQueued is set on messages queued for sending.
+	MozillaQueued MozillaFlags = 0x00000800
+	// MozillaForwarded is set on messages which have been forwarded.
+	MozillaForwarded MozillaFlags = 0x00001000
+	// MozillaPriorities is the mask of the 3-bit message priority.
+	MozillaPriorities MozillaFlags = 0x0000E000
+
+	// MozillaNew is set on messages which are new since the folder was last
+	// opened.
+	MozillaNew MozillaFlags = 0x00010000
+	// MozillaIgnored is set on ignored threads.
+	MozillaIgnored MozillaFlags = 0x00040000
+	// MozillaIMAPDeleted is set on messages marked as deleted on the IMAP
+	// server.
+	MozillaIMAPDeleted MozillaFlags = 0x00200000
+	// MozillaMDNReportNeeded is set on messages requesting a read receipt
+	// which hasn't been sent yet.
+	MozillaMDNReportNeeded MozillaFlags = 0x00400000
+	// MozillaMDNReportSent is set on messages whose read receipt has been
+	// sent.
+	MozillaMDNReportSent MozillaFlags = 0x00800000
+	// MozillaTemplate is set on templates.
+	MozillaTemplate MozillaFlags = 0x01000000
+	// MozillaLabels is the mask of the 3-bit label, superseded by keywords.
+	MozillaLabels MozillaFlags = 0x0E000000
+	// MozillaAttachment is set on messages with attachments.
+	MozillaAttachment MozillaFlags = 0x10000000
+)
+
+// mozillaKeysLen is the length Thunderbird pads X-Mozilla-Keys to, so that
+// keywords can be added in place.
+const mozillaKeysLen = 80
+
+// Flags returns the equivalent Status and X-Status flags.
+func (f MozillaFlags) Flags() Flags {
+	var flags Flags
+	if f&MozillaRead != 0 {
+		flags |= FlagRead
+	}
+	if f&MozillaNew == 0 {
+		flags |= FlagOld
+	}
+	if f&MozillaReplied != 0 {
+		flags |= FlagAnswered
+	}
+	if f&MozillaMarked != 0 {
+		flags |= FlagFlagged
+	}
+	if f&MozillaExpunged != 0 {
+		flags |= FlagDeleted
+	}
+	return flags
+}
+
+// MozillaStatus is the message state stored by Thunderbird in the
+// X-Mozilla-Status, X-Mozilla-Status2 and X-Mozilla-Keys header fields.
+type MozillaStatus struct {
+	Flags MozillaFlags
+	// Keywords contains the message tags, for instance "$label1" or
+	// "nonjunk".
+	Keywords []string
+}
+
+// ParseMozillaStatus parses the Thunderbird message state in a message header.
+// Missing fields are treated as empty.
+func ParseMozillaStatus(h mail.Header) (*MozillaStatus, error) {
+	var status MozillaStatus
+	for _, k := range []string{"X-Mozilla-Status", "X-Mozilla-Status2"} {
+		v := strings.TrimSpace(h.Get(k))
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseUint(v, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("mbox: malformed %v field: %v", k, err)
+		}
+		status.Flags |= MozillaFlags(f)
+	}
+	status.Keywords = strings.Fields(h.Get("X-Mozilla-Keys"))
+	return &status, nil
+}
+
+// Status returns the value of the X-Mozilla-Status field.
+func (status *MozillaStatus) Status() string {
+	return fmt.Sprintf("%04x", uint32(status.Flags&0xFFFF))
+}
+
+// Status2 returns the value of the X-Mozilla-Status2 field.
+func (status *MozillaStatus) Status2() string {
+	return fmt.Sprintf("%08x", uint32(status.Flags&^0xFFFF))
+}
+
+// Keys returns the value of the X-Mozilla-Keys field, without padding.
+func (status *MozillaStatus) Keys() string {
+	return strings.Join(status.Keywords, " ")
+}
+
+func (status *MozillaStatus) fieldUpdates() []fieldUpdate {
+	return []fieldUpdate{
+		{key: "X-Mozilla-Status", value: status.Status()},
+		{key: "X-Mozilla-Status2", value: status.Status2()},
+		{key: "X-Mozilla-Keys", value: status.Keys(), pad: mozillaKeysLen},
+	}
+}
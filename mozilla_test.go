@@ -0,0 +1,111 @@
+package mbox
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const mboxThunderbird = `From - Thu Jan  1 00:00:01 2015
+X-Mozilla-Status: 0001
+X-Mozilla-Status2: 00000000
+X-Mozilla-Keys:                                                                                 
+From: herp.derp@example.com (Herp Derp)
+Subject: Test
+
+This is a simple test.
+
+From - Thu Jan  1 00:00:01 2015
+X-Mozilla-Status: 0000
+X-Mozilla-Status2: 00010000
+From: derp.herp@example.com (Derp Herp)
+Subject: Another test
+
+This is another simple test.
+`
+
+func TestParseMozillaStatus(t *testing.T) {
+	h := mail.Header{
+		"X-Mozilla-Status":  {"0005"},
+		"X-Mozilla-Status2": {"10010000"},
+		"X-Mozilla-Keys":    {"$label1 nonjunk                "},
+	}
+	status, err := ParseMozillaStatus(h)
+	if err != nil {
+		t.Fatalf("ParseMozillaStatus() = %v", err)
+	}
+
+	want := &MozillaStatus{
+		Flags:    MozillaRead | MozillaMarked | MozillaNew | MozillaAttachment,
+		Keywords: []string{"$label1", "nonjunk"},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("ParseMozillaStatus() = %#v, want %#v", status, want)
+	}
+
+	if s := status.Status(); s != "0005" {
+		t.Errorf("Status() = %q", s)
+	}
+	if s := status.Status2(); s != "10010000" {
+		t.Errorf("Status2() = %q", s)
+	}
+	if flags := status.Flags.Flags(); flags != FlagRead|FlagFlagged {
+		t.Errorf("Flags() = %v", flags)
+	}
+
+	if _, err := ParseMozillaStatus(mail.Header{"X-Mozilla-Status": {"zzzz"}}); err == nil {
+		t.Errorf("ParseMozillaStatus() succeeded on malformed field")
+	}
+}
+
+func TestMailbox_SetMozillaStatus(t *testing.T) {
+	name, cleanup := tempMailbox(t, mboxThunderbird)
+	defer cleanup()
+
+	mb, err := OpenMailbox(name, nil)
+	if err != nil {
+		t.Fatalf("OpenMailbox() = %v", err)
+	}
+	defer mb.Close()
+
+	status, err := mb.MozillaStatus(0)
+	if err != nil {
+		t.Fatalf("MozillaStatus() = %v", err)
+	}
+	status.Flags |= MozillaMarked
+	status.Keywords = append(status.Keywords, "$label1")
+	if err := mb.SetMozillaStatus(0, status); err != nil {
+		t.Fatalf("SetMozillaStatus() = %v", err)
+	}
+	if mb.msgs[0].pending != nil {
+		t.Errorf("SetMozillaStatus() wasn't done in place")
+	}
+
+	want := strings.Replace(mboxThunderbird, "X-Mozilla-Status: 0001", "X-Mozilla-Status: 0005", 1)
+	want = strings.Replace(want, "X-Mozilla-Keys:        ", "X-Mozilla-Keys: $label1", 1)
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("Mailbox after SetMozillaStatus():\n%q\nexpected:\n%q", string(b), want)
+	}
+
+	// The second message has no X-Mozilla-Keys field
+	status = &MozillaStatus{Flags: MozillaRead, Keywords: []string{"$label2"}}
+	if err := mb.SetMozillaStatus(1, status); err != nil {
+		t.Fatalf("SetMozillaStatus() = %v", err)
+	}
+	if err := mb.Flush(); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+	got, err := mb.MozillaStatus(1)
+	if err != nil {
+		t.Fatalf("MozillaStatus() = %v", err)
+	}
+	if !reflect.DeepEqual(got, status) {
+		t.Errorf("MozillaStatus() = %#v, want %#v", got, status)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package mbox
+
+import (
+	"os"
+)
+
+// copyOwner is a no-op: file ownership isn't supported on this platform.
+func copyOwner(f *os.File, fi os.FileInfo) error {
+	return nil
+}
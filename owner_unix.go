@@ -0,0 +1,30 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package mbox
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// copyOwner sets the owner and group of f to the ones described by fi, if
+// they differ.
+func copyOwner(f *os.File, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	cur, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if curSt, ok := cur.Sys().(*syscall.Stat_t); ok && curSt.Uid == st.Uid && curSt.Gid == st.Gid {
+		return nil
+	}
+	if err := f.Chown(int(st.Uid), int(st.Gid)); err != nil {
+		return fmt.Errorf("mbox: failed to preserve mailbox ownership: %v", err)
+	}
+	return nil
+}
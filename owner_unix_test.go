@@ -0,0 +1,45 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package mbox
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestMailbox_expungeOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing file ownership requires root")
+	}
+
+	name, cleanup := tempMailbox(t, mboxWithThreeMessages)
+	defer cleanup()
+
+	const uid, gid = 1234, 5678
+	if err := os.Chown(name, uid, gid); err != nil {
+		t.Fatal(err)
+	}
+
+	mb, err := OpenMailbox(name, nil)
+	if err != nil {
+		t.Fatalf("OpenMailbox() = %v", err)
+	}
+	defer mb.Close()
+	if err := mb.Delete(0); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	if err := mb.Expunge(); err != nil {
+		t.Fatalf("Expunge() = %v", err)
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if st.Uid != uid || st.Gid != gid {
+		t.Errorf("owner after Expunge() = %v:%v, want %v:%v", st.Uid, st.Gid, uid, gid)
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+
+	"github.com/emersion/go-mbox/internal/msgutil"
 )
 
 // ErrInvalidFormat is the error returned by the NextMessage method of Reader if
@@ -24,6 +26,54 @@ type messageReader struct {
 	next               bytes.Buffer
 	atEOF, atSeparator bool
 	atMiddleOfLine     bool
+	// raw disables unescaping and line ending conversion
+	raw bool
+	// rd enables mboxrd unescaping
+	rd bool
+
+	// offset returns the current offset in the mbox stream
+	offset func() int64
+	// The offset and the From line of the next message, set when atSeparator
+	// is true. sepBlank is true if the From line was preceded by a blank line.
+	sepOffset int64
+	fromLine  []byte
+	sepBlank  bool
+}
+
+var crlf = []byte("\r\n")
+
+// readLine reads a line and returns it along with its line ending. In raw
+// mode, the original line ending is returned, otherwise the line ending is
+// CRLF.
+func (mr *messageReader) readLine() (line, eol []byte, isPrefix bool, err error) {
+	if !mr.raw {
+		line, isPrefix, err = mr.r.ReadLine()
+		if !isPrefix {
+			eol = crlf
+		}
+		return line, eol, isPrefix, err
+	}
+	return readRawLine(mr.r)
+}
+
+// readRawLine reads a line and returns it along with its original line
+// ending.
+func readRawLine(r *bufio.Reader) (line, eol []byte, isPrefix bool, err error) {
+	line, err = r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return line, nil, true, nil
+	} else if err == io.EOF && len(line) > 0 {
+		// The last line has no line ending, the next call will return io.EOF
+		return line, nil, false, nil
+	} else if err != nil {
+		return nil, nil, false, err
+	}
+
+	n := 1
+	if len(line) > 1 && line[len(line)-2] == '\r' {
+		n = 2
+	}
+	return line[:len(line)-n], line[len(line)-n:], false, nil
 }
 
 func (mr *messageReader) Read(p []byte) (int, error) {
@@ -32,7 +82,8 @@ func (mr *messageReader) Read(p []byte) (int, error) {
 	}
 
 	if mr.next.Len() == 0 {
-		b, isPrefix, err := mr.r.ReadLine()
+		offset := mr.offset()
+		b, eol, isPrefix, err := mr.readLine()
 		if err != nil {
 			mr.atEOF = true
 			return 0, err
@@ -40,34 +91,137 @@ func (mr *messageReader) Read(p []byte) (int, error) {
 
 		if !mr.atMiddleOfLine {
 			if bytes.HasPrefix(b, header) {
-				mr.atSeparator = true
-				return 0, io.EOF
+				return 0, mr.separator(offset, b, isPrefix, false)
 			} else if len(b) == 0 {
 				// Check if the next line is separator. In such case the new
 				// line should not be written to not have double new line.
-				b, isPrefix, err = mr.r.ReadLine()
+				mr.next.Write(eol)
+				offset = mr.offset()
+				b, eol, isPrefix, err = mr.readLine()
 				if err != nil {
 					mr.atEOF = true
 					return 0, err
 				}
 
 				if bytes.HasPrefix(b, header) {
-					mr.atSeparator = true
-					return 0, io.EOF
+					mr.next.Reset()
+					return 0, mr.separator(offset, b, isPrefix, true)
 				}
-
-				mr.next.Write([]byte("\r\n"))
 			}
 
-			if bytes.HasPrefix(b, escapedHeader) {
+			if !mr.raw && isEscapedHeader(b, mr.rd) {
 				b = b[1:]
 			}
 		}
 
 		mr.next.Write(b)
-		if !isPrefix {
-			mr.next.Write([]byte("\r\n"))
+		mr.next.Write(eol)
+		mr.atMiddleOfLine = isPrefix
+	}
+
+	return mr.next.Read(p)
+}
+
+// isEscapedHeader checks whether a line is an escaped From line. In mboxrd, any
+// line matching ">+From " is escaped.
+func isEscapedHeader(b []byte, rd bool) bool {
+	if rd {
+		i := 0
+		for i < len(b) && b[i] == '>' {
+			i++
+		}
+		return i > 0 && bytes.HasPrefix(b[i:], header)
+	}
+	return bytes.HasPrefix(b, escapedHeader)
+}
+
+// separator records the From line of the next message, starting at offset.
+func (mr *messageReader) separator(offset int64, b []byte, isPrefix, blank bool) error {
+	mr.atSeparator = true
+	mr.sepOffset = offset
+	mr.fromLine = append([]byte(nil), b...)
+	mr.sepBlank = blank
+
+	// Discard the rest of the line.
+	for isPrefix {
+		var err error
+		_, _, isPrefix, err = mr.readLine()
+		if err != nil {
+			mr.atEOF = true
+			return err
 		}
+	}
+	return io.EOF
+}
+
+// clMessageReader reads a message whose body size is given by its
+// Content-Length header field.
+type clMessageReader struct {
+	hdr  *bytes.Reader
+	body *io.LimitedReader
+}
+
+func (mr *clMessageReader) Read(p []byte) (int, error) {
+	if mr.hdr.Len() > 0 {
+		return mr.hdr.Read(p)
+	}
+
+	n, err := mr.body.Read(p)
+	if err == io.EOF && mr.body.N > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// mmdfMessageReader reads an MMDF message, up to its closing delimiter.
+type mmdfMessageReader struct {
+	r              *bufio.Reader
+	next           bytes.Buffer
+	atEnd          bool
+	atMiddleOfLine bool
+	// untilEOF reads a single message up to EOF, without delimiter
+	untilEOF bool
+	// raw disables line ending conversion
+	raw bool
+}
+
+func (mr *mmdfMessageReader) Read(p []byte) (int, error) {
+	if mr.next.Len() == 0 {
+		if mr.atEnd {
+			return 0, io.EOF
+		}
+
+		var (
+			b, eol   []byte
+			isPrefix bool
+			err      error
+		)
+		if mr.raw {
+			b, eol, isPrefix, err = readRawLine(mr.r)
+		} else {
+			b, isPrefix, err = mr.r.ReadLine()
+			if !isPrefix {
+				eol = crlf
+			}
+		}
+		if err == io.EOF && mr.untilEOF {
+			mr.atEnd = true
+			return 0, io.EOF
+		} else if err == io.EOF {
+			// Missing closing delimiter
+			mr.atEnd = true
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+
+		if !mr.untilEOF && !mr.atMiddleOfLine && bytes.Equal(b, mmdfDelimiter) {
+			mr.atEnd = true
+			return 0, io.EOF
+		}
+
+		mr.next.Write(b)
+		mr.next.Write(eol)
 		mr.atMiddleOfLine = isPrefix
 	}
 
@@ -76,52 +230,202 @@ func (mr *messageReader) Read(p []byte) (int, error) {
 
 // Reader reads an mbox archive.
 type Reader struct {
-	r  *bufio.Reader
-	mr *messageReader
+	// Format is the mbox format variant of the archive. It must be set before
+	// the first call to NextMessage. Defaults to FormatMboxo.
+	//
+	// With FormatMboxcl2, messages are returned as they are stored, without
+	// line ending conversion. Messages without a valid Content-Length header
+	// field end at the next line starting with "From ".
+	//
+	// With FormatMMDF, the From line following the opening delimiter, if any,
+	// is returned by FromLine.
+	//
+	// With FormatMessage, the whole data is returned as a single message.
+	Format Format
+
+	r   *bufio.Reader
+	cr  *countingReader
+	mr  *messageReader
+	cur io.Reader
+
+	// The offset and the From line of the current message
+	msgOffset int64
+	fromLine  []byte
+
+	// The following fields are used by Validate. raw disables unescaping and
+	// line ending conversion. contentOffset is the offset of the message
+	// text, after its From line, and sepBlank is true if its From line was
+	// preceded by a blank line. invalidOffset and invalidLine are set when
+	// NextMessage returns ErrInvalidFormat.
+	raw           bool
+	contentOffset int64
+	sepBlank      bool
+	invalidOffset int64
+	invalidLine   []byte
+}
+
+// countingReader counts the bytes read from an io.Reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
 }
 
 // NewReader returns a new Reader to read messages from mbox file format data
 // provided by io.Reader r.
 func NewReader(r io.Reader) *Reader {
-	return &Reader{r: bufio.NewReader(r)}
+	cr := &countingReader{r: r}
+	return &Reader{r: bufio.NewReader(cr), cr: cr}
+}
+
+// offset returns the offset of the next byte to be read from the mbox stream.
+func (r *Reader) offset() int64 {
+	return r.cr.n - int64(r.r.Buffered())
 }
 
 // NextMessage returns the next message text (containing both the header and the
 // body). It will return io.EOF if there are no messages left.
 func (r *Reader) NextMessage() (io.Reader, error) {
-	if r.mr == nil {
-		for {
-			b, isPrefix, err := r.r.ReadLine()
-			if err != nil {
-				return nil, err
+	if r.Format == FormatMessage {
+		if r.cur != nil {
+			return nil, io.EOF
+		}
+		if _, err := r.r.Peek(1); err != nil {
+			return nil, err
+		}
+		r.cur = &mmdfMessageReader{r: r.r, untilEOF: true}
+		return r.cur, nil
+	}
+
+	atSeparator := false
+	if r.cur != nil {
+		if _, err := io.Copy(ioutil.Discard, r.cur); err != nil {
+			return nil, err
+		}
+		if r.mr != nil {
+			if r.mr.atEOF {
+				return nil, io.EOF
 			}
+			atSeparator = r.mr.atSeparator
+			r.msgOffset, r.fromLine = r.mr.sepOffset, r.mr.fromLine
+			r.sepBlank = r.mr.sepBlank
+		}
+	}
 
-			isFromLine := bytes.HasPrefix(b, header)
+	if !atSeparator {
+		if err := r.skipToSeparator(); err != nil {
+			return nil, err
+		}
+	}
 
-			// Discard the rest of the line.
-			for isPrefix {
-				_, isPrefix, err = r.r.ReadLine()
-				if err != nil {
-					return nil, err
-				}
-			}
-			if len(b) == 0 {
-				continue
+	r.mr = nil
+	r.contentOffset = r.offset()
+	switch r.Format {
+	case FormatMMDF:
+		r.fromLine = nil
+		if b, err := r.r.Peek(len(header)); err == nil && bytes.Equal(b, header) {
+			l, err := r.readLine()
+			if err != nil {
+				return nil, err
 			}
-			if isFromLine {
-				break
-			} else {
-				return nil, ErrInvalidFormat
+			r.fromLine = l
+			r.contentOffset = r.offset()
+		}
+		r.cur = &mmdfMessageReader{r: r.r, raw: r.raw}
+	case FormatMboxcl2:
+		hdr, err := msgutil.ReadHeader(r.r)
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := contentLength(hdr); ok {
+			r.cur = &clMessageReader{
+				hdr:  bytes.NewReader(hdr),
+				body: &io.LimitedReader{R: r.r, N: n},
 			}
+		} else {
+			r.mr = &messageReader{r: r.r, raw: true, offset: r.offset}
+			r.cur = io.MultiReader(bytes.NewReader(hdr), r.mr)
 		}
-	} else {
-		if _, err := io.Copy(ioutil.Discard, r.mr); err != nil {
+	default:
+		r.mr = &messageReader{r: r.r, raw: r.raw, offset: r.offset, rd: r.Format == FormatMboxrd}
+		r.cur = r.mr
+	}
+	return r.cur, nil
+}
+
+// FromLine returns the From line of the message last returned by NextMessage,
+// without its line ending. It can be parsed with ParseFromLine.
+func (r *Reader) FromLine() string {
+	return string(r.fromLine)
+}
+
+// Offset returns the offset in the mbox stream of the message last returned by
+// NextMessage, i.e. the offset of its From line or of its opening delimiter
+// for MMDF.
+func (r *Reader) Offset() int64 {
+	return r.msgOffset
+}
+
+// readLine reads a whole line, without its line ending.
+func (r *Reader) readLine() ([]byte, error) {
+	var l []byte
+	for {
+		b, isPrefix, err := r.r.ReadLine()
+		if err != nil {
 			return nil, err
 		}
-		if r.mr.atEOF {
-			return nil, io.EOF
+		l = append(l, b...)
+		if !isPrefix {
+			return l, nil
+		}
+	}
+}
+
+// skipToSeparator consumes blank lines up to and including the next From line,
+// or the next opening delimiter for MMDF.
+func (r *Reader) skipToSeparator() error {
+	r.sepBlank = false
+	for {
+		offset := r.offset()
+		b, isPrefix, err := r.r.ReadLine()
+		if err != nil {
+			return err
+		}
+
+		var isFromLine bool
+		if r.Format == FormatMMDF {
+			isFromLine = !isPrefix && bytes.Equal(b, mmdfDelimiter)
+		} else {
+			isFromLine = bytes.HasPrefix(b, header)
+		}
+		if isFromLine {
+			r.msgOffset = offset
+			r.fromLine = append([]byte(nil), b...)
+		} else if len(b) > 0 {
+			r.invalidOffset = offset
+			r.invalidLine = append([]byte(nil), b...)
+		}
+
+		// Discard the rest of the line.
+		for isPrefix {
+			_, isPrefix, err = r.r.ReadLine()
+			if err != nil {
+				return err
+			}
+		}
+		if len(b) == 0 {
+			r.sepBlank = true
+			continue
+		}
+		if isFromLine {
+			return nil
+		} else {
+			return ErrInvalidFormat
 		}
 	}
-	r.mr = &messageReader{r: r.r}
-	return r.mr, nil
 }
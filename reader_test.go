@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/mail"
 	"strings"
 	"testing"
@@ -507,3 +508,90 @@ Bye.
 	// Message from herp.derp@example.com (Herp Derp)
 	// Message from derp.herp@example.com (Derp Herp)
 }
+
+func TestReaderMboxcl2(t *testing.T) {
+	mbox := "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: Test\n" +
+		"Content-Length: 16\n" +
+		"\n" +
+		"From the body.\n" +
+		"\n" +
+		"\n" +
+		"From derp.herp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: No Content-Length\n" +
+		"\n" +
+		">From is kept.\n" +
+		"\n" +
+		"From bernd.lauert@example.com Thu Jan  3 00:00:01 2015\n" +
+		"Subject: Truncated\n" +
+		"Content-Length: 100\n" +
+		"\n" +
+		"Bye.\n"
+
+	want := []string{
+		"Subject: Test\nContent-Length: 16\n\nFrom the body.\n\n",
+		"Subject: No Content-Length\n\n>From is kept.\n",
+	}
+
+	mr := NewReader(strings.NewReader(mbox))
+	mr.Format = FormatMboxcl2
+	for i, w := range want {
+		r, err := mr.NextMessage()
+		if err != nil {
+			t.Fatalf("NextMessage() = %v", err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll() = %v", err)
+		}
+		if string(b) != w {
+			t.Errorf("Message %v:\n%q\nexpected:\n%q", i, string(b), w)
+		}
+	}
+
+	r, err := mr.NextMessage()
+	if err != nil {
+		t.Fatalf("NextMessage() = %v", err)
+	}
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadAll() = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestReader_FromLine(t *testing.T) {
+	want := []string{
+		"From herp.derp@example.com Thu Jan  1 00:00:01 2015",
+		"From derp.herp@example.com Thu Jan  1 00:00:01 2015",
+		"From bernd.lauert@example.com Thu Jan  3 00:00:01 2015",
+	}
+
+	mr := NewReader(strings.NewReader(mboxWithStartingLF))
+	for _, w := range want {
+		if _, err := mr.NextMessage(); err != nil {
+			t.Fatalf("NextMessage() = %v", err)
+		}
+		if l := mr.FromLine(); l != w {
+			t.Errorf("FromLine() = %q, want %q", l, w)
+		}
+	}
+}
+
+func TestReader_Offset(t *testing.T) {
+	msgs := []string{
+		"From herp.derp@example.com Thu Jan  1 00:00:01 2015\nSubject: 1\n\nHi.\n\n",
+		"From derp.herp@example.com Thu Jan  1 00:00:01 2015\nSubject: 2\n\n\nBye.\n\n",
+		"From bernd.lauert@example.com Thu Jan  3 00:00:01 2015\nSubject: 3\n\nYo.\n",
+	}
+
+	mr := NewReader(strings.NewReader(strings.Join(msgs, "")))
+	var want int64
+	for _, msg := range msgs {
+		if _, err := mr.NextMessage(); err != nil {
+			t.Fatalf("NextMessage() = %v", err)
+		}
+		if off := mr.Offset(); off != want {
+			t.Errorf("Offset() = %v, want %v", off, want)
+		}
+		want += int64(len(msg))
+	}
+}
@@ -0,0 +1,316 @@
+package mbox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// ErrNoIndex is returned by NewSeekableReader if the file doesn't end with a
+// block index.
+var ErrNoIndex = errors.New("mbox: no seekable index")
+
+// A seekable mbox file is a gzip file made of independent members, each
+// containing whole messages, followed by empty members whose Extra field
+// holds the block index:
+//
+//	block member...
+//	index member... ("MI" subfield, a list of seekBlock)
+//	trailer member  ("MX" subfield, index offset and message count)
+//
+// Empty members don't produce any output, so gunzip decompresses the file
+// to a plain mbox file.
+const (
+	defaultBlockSize  = 1024 * 1024
+	seekBlockLen      = 24
+	seekMaxBlocks     = (0xffff - 4) / seekBlockLen
+	seekTrailerExtLen = 16
+	seekTrailerLen    = 10 + 2 + 4 + seekTrailerExtLen + 2 + 8
+)
+
+// seekBlock is an entry of the block index.
+type seekBlock struct {
+	offset  int64  // offset of the gzip member in the file
+	uoffset int64  // uncompressed offset of the block
+	first   uint64 // number of the first message of the block
+}
+
+// SeekableWriter writes a gzip-compressed mbox file which can be read at
+// random with SeekableReader. Messages are written with the embedded Writer.
+// The Close method must be called to write the block index.
+//
+// Messages are grouped in blocks which are compressed independently. The
+// file can still be decompressed by gunzip and read by OpenReader.
+type SeekableWriter struct {
+	*Writer
+
+	// BlockSize is the uncompressed size after which a new block is started.
+	// Smaller blocks make random access faster but compress worse. Zero means
+	// a default of 1 MiB.
+	BlockSize int64
+
+	cw     *countingWriter
+	zw     *gzip.Writer
+	uw     *countingWriter
+	blocks []seekBlock
+	count  uint64
+}
+
+// countingWriter counts the bytes written to an io.Writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// NewSeekableWriter creates a new SeekableWriter that writes a seekable mbox
+// file to w.
+func NewSeekableWriter(w io.Writer) *SeekableWriter {
+	sw := &SeekableWriter{cw: &countingWriter{w: w}}
+	sw.uw = &countingWriter{w: writerFunc(sw.write)}
+	sw.Writer = NewWriter(sw.uw)
+	sw.Writer.beforeMessage = sw.beforeMessage
+	return sw
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (sw *SeekableWriter) write(p []byte) (int, error) {
+	return sw.zw.Write(p)
+}
+
+func (sw *SeekableWriter) blockSize() int64 {
+	if sw.BlockSize > 0 {
+		return sw.BlockSize
+	}
+	return defaultBlockSize
+}
+
+// beforeMessage starts a new block if the current one is full.
+func (sw *SeekableWriter) beforeMessage() error {
+	if sw.zw == nil || sw.uw.n-sw.blocks[len(sw.blocks)-1].uoffset >= sw.blockSize() {
+		if err := sw.closeBlock(); err != nil {
+			return err
+		}
+		if sw.zw == nil {
+			sw.zw = gzip.NewWriter(sw.cw)
+		} else {
+			sw.zw.Reset(sw.cw)
+		}
+		sw.blocks = append(sw.blocks, seekBlock{
+			offset:  sw.cw.n,
+			uoffset: sw.uw.n,
+			first:   sw.count,
+		})
+	}
+	sw.count++
+	return nil
+}
+
+func (sw *SeekableWriter) closeBlock() error {
+	if sw.zw == nil {
+		return nil
+	}
+	return sw.zw.Close()
+}
+
+// Close finishes the last message and block, and writes the block index.
+func (sw *SeekableWriter) Close() error {
+	if err := sw.Writer.Close(); err != nil {
+		return err
+	}
+	if err := sw.closeBlock(); err != nil {
+		return err
+	}
+
+	indexOffset := sw.cw.n
+	blocks := sw.blocks
+	for len(blocks) > 0 {
+		n := len(blocks)
+		if n > seekMaxBlocks {
+			n = seekMaxBlocks
+		}
+		b := make([]byte, 0, n*seekBlockLen)
+		for _, blk := range blocks[:n] {
+			b = appendUint64(b, uint64(blk.offset))
+			b = appendUint64(b, uint64(blk.uoffset))
+			b = appendUint64(b, blk.first)
+		}
+		if err := writeEmptyMember(sw.cw, "MI", b); err != nil {
+			return err
+		}
+		blocks = blocks[n:]
+	}
+
+	b := make([]byte, 0, seekTrailerExtLen)
+	b = appendUint64(b, uint64(indexOffset))
+	b = appendUint64(b, sw.count)
+	return writeEmptyMember(sw.cw, "MX", b)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// writeEmptyMember writes a gzip member without any data, with an Extra field
+// containing a single subfield.
+func writeEmptyMember(w io.Writer, id string, data []byte) error {
+	b := []byte{
+		0x1f, 0x8b, // magic
+		8,          // CM: deflate
+		1 << 2,     // FLG: FEXTRA
+		0, 0, 0, 0, // MTIME
+		0,    // XFL
+		0xff, // OS: unknown
+	}
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], uint16(4+len(data)))
+	b = append(b, buf[:]...)
+	b = append(b, id...)
+	binary.LittleEndian.PutUint16(buf[:], uint16(len(data)))
+	b = append(b, buf[:]...)
+	b = append(b, data...)
+	b = append(b, 0x03, 0x00) // empty final deflate block
+	b = append(b, 0, 0, 0, 0) // CRC-32
+	b = append(b, 0, 0, 0, 0) // ISIZE
+	_, err := w.Write(b)
+	return err
+}
+
+// readEmptyMember reads a gzip member without any data written by
+// writeEmptyMember.
+func readEmptyMember(b []byte, id string) (data []byte, ok bool) {
+	if len(b) < 16 || b[0] != 0x1f || b[1] != 0x8b || b[2] != 8 || b[3] != 1<<2 {
+		return nil, false
+	}
+	xlen := int(binary.LittleEndian.Uint16(b[10:12]))
+	if len(b) < 12+xlen+10 || xlen < 4 || string(b[12:14]) != id {
+		return nil, false
+	}
+	n := int(binary.LittleEndian.Uint16(b[14:16]))
+	if 4+n != xlen {
+		return nil, false
+	}
+	data = b[16 : 16+n]
+	tail := b[12+xlen:]
+	if !bytes.Equal(tail[:10], []byte{0x03, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}) {
+		return nil, false
+	}
+	return data, true
+}
+
+// SeekableReader reads messages at random from a seekable mbox file written
+// by SeekableWriter. Only the block containing a message is decompressed to
+// read it.
+type SeekableReader struct {
+	// Format is the mbox format variant of the file, see Reader.Format.
+	Format Format
+
+	r           io.ReaderAt
+	indexOffset int64
+	blocks      []seekBlock
+	count       int
+}
+
+// NewSeekableReader reads the block index of a seekable mbox file of the given
+// size. If the file doesn't have a block index, ErrNoIndex is returned.
+func NewSeekableReader(r io.ReaderAt, size int64) (*SeekableReader, error) {
+	if size < seekTrailerLen {
+		return nil, ErrNoIndex
+	}
+	b := make([]byte, seekTrailerLen)
+	if _, err := r.ReadAt(b, size-seekTrailerLen); err != nil {
+		return nil, err
+	}
+	data, ok := readEmptyMember(b, "MX")
+	if !ok || len(data) != seekTrailerExtLen {
+		return nil, ErrNoIndex
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(data[0:8]))
+	count := binary.LittleEndian.Uint64(data[8:16])
+	if indexOffset < 0 || indexOffset > size-seekTrailerLen {
+		return nil, ErrInvalidFormat
+	}
+
+	b = make([]byte, size-seekTrailerLen-indexOffset)
+	if _, err := r.ReadAt(b, indexOffset); err != nil {
+		return nil, err
+	}
+	sr := &SeekableReader{r: r, indexOffset: indexOffset, count: int(count)}
+	for len(b) > 0 {
+		data, ok := readEmptyMember(b, "MI")
+		if !ok || len(data)%seekBlockLen != 0 {
+			return nil, ErrInvalidFormat
+		}
+		b = b[16+len(data)+10:]
+		for ; len(data) > 0; data = data[seekBlockLen:] {
+			sr.blocks = append(sr.blocks, seekBlock{
+				offset:  int64(binary.LittleEndian.Uint64(data[0:8])),
+				uoffset: int64(binary.LittleEndian.Uint64(data[8:16])),
+				first:   binary.LittleEndian.Uint64(data[16:24]),
+			})
+		}
+	}
+	return sr, nil
+}
+
+// Len returns the number of messages in the file.
+func (sr *SeekableReader) Len() int {
+	return sr.count
+}
+
+// Reader returns a Reader whose first message is the message i. The Reader
+// continues with the following messages until the end of the file. Only the
+// blocks which are read are decompressed.
+func (sr *SeekableReader) Reader(i int) (*Reader, error) {
+	if i < 0 || i >= sr.count {
+		return nil, errors.New("mbox: message index out of range")
+	}
+	k := sort.Search(len(sr.blocks), func(k int) bool {
+		return sr.blocks[k].first > uint64(i)
+	}) - 1
+	if k < 0 {
+		return nil, ErrInvalidFormat
+	}
+	blk := sr.blocks[k]
+
+	section := io.NewSectionReader(sr.r, blk.offset, sr.indexOffset-blk.offset)
+	zr, err := gzip.NewReader(section)
+	if err != nil {
+		return nil, err
+	}
+	r := NewReader(zr)
+	r.Format = sr.Format
+	for n := blk.first; n < uint64(i); n++ {
+		if _, err := r.NextMessage(); err != nil {
+			if err == io.EOF {
+				err = ErrInvalidFormat
+			}
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Message returns a reader for the message i.
+func (sr *SeekableReader) Message(i int) (io.Reader, error) {
+	r, err := sr.Reader(i)
+	if err != nil {
+		return nil, err
+	}
+	return r.NextMessage()
+}
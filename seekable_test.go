@@ -0,0 +1,100 @@
+package mbox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeSeekable(t *testing.T, n int, blockSize int64) []byte {
+	var buf bytes.Buffer
+	sw := NewSeekableWriter(&buf)
+	sw.BlockSize = blockSize
+	date := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		body := fmt.Sprintf("Subject: Message %v\n\nFrom the body.\n", i)
+		if err := sw.WriteMessage("herp.derp@example.com", date, strings.NewReader(body)); err != nil {
+			t.Fatalf("WriteMessage() = %v", err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSeekableReader(t *testing.T) {
+	const n = 50
+	b := writeSeekable(t, n, 200)
+
+	sr, err := NewSeekableReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("NewSeekableReader() = %v", err)
+	}
+	if sr.Len() != n {
+		t.Fatalf("Len() = %v, want %v", sr.Len(), n)
+	}
+	if len(sr.blocks) < 2 {
+		t.Errorf("got %v blocks, want more than one", len(sr.blocks))
+	}
+
+	for _, i := range []int{0, 1, 17, 30, n - 1} {
+		r, err := sr.Message(i)
+		if err != nil {
+			t.Fatalf("Message(%v) = %v", i, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf("Subject: Message %v\r\n\r\nFrom the body.\r\n", i)
+		if string(got) != want {
+			t.Errorf("Message(%v) = %q, want %q", i, got, want)
+		}
+	}
+
+	if _, err := sr.Message(n); err == nil {
+		t.Errorf("Message(%v) = nil error", n)
+	}
+}
+
+func TestSeekableWriter_gunzip(t *testing.T) {
+	b := writeSeekable(t, 10, 100)
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+
+	r := NewReader(bytes.NewReader(plain))
+	count := 0
+	for {
+		if _, err := r.NextMessage(); err != nil {
+			break
+		}
+		count++
+	}
+	if count != 10 {
+		t.Errorf("got %v messages, want 10", count)
+	}
+}
+
+func TestNewSeekableReader_noIndex(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("From foo@example.com Thu Jan  1 00:00:01 2015\n\nHi.\n\n"))
+	zw.Close()
+
+	b := buf.Bytes()
+	if _, err := NewSeekableReader(bytes.NewReader(b), int64(len(b))); err != ErrNoIndex {
+		t.Errorf("NewSeekableReader() = %v, want ErrNoIndex", err)
+	}
+}
@@ -0,0 +1,303 @@
+// Package split splits mbox archives into several files.
+//
+// Output files are rotated according to a policy: a maximum size, a maximum
+// number of messages or one file per month. A message is never split across
+// files.
+package split
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+// NameData is the data passed to the naming template of output files.
+type NameData struct {
+	// Index is the index of the output file, starting at 1.
+	Index int
+	// Part is the index of the output file within the month of its first
+	// message, starting at 1.
+	Part int
+	// Date is the envelope date of the first message of the file.
+	Date time.Time
+	// Month is Date formatted as "2006-01".
+	Month string
+}
+
+// Splitter writes messages to a sequence of mbox files. Output files are
+// named by executing a text/template with a NameData. Existing files are
+// never overwritten.
+//
+// With ByMonth, messages should be sorted by date, otherwise a month can span
+// several files.
+type Splitter struct {
+	// Format is the mbox format variant of output files.
+	Format mbox.Format
+	// MaxSize is the maximum size of an output file in bytes. A message larger
+	// than MaxSize is written alone to a file. Zero means no limit.
+	MaxSize int64
+	// MaxMessages is the maximum number of messages of an output file. Zero
+	// means no limit.
+	MaxMessages int
+	// ByMonth starts a new output file when the month of the envelope date
+	// changes.
+	ByMonth bool
+
+	tmpl      *template.Template
+	cur       *output
+	index     int
+	part      int
+	lastMonth string
+	files     []string
+}
+
+// output is an output file.
+type output struct {
+	f     *os.File
+	bw    *bufio.Writer
+	cw    *countingWriter // counts the bytes written to bw
+	w     *mbox.Writer
+	month string
+	count int
+}
+
+// countingWriter counts the bytes written to an io.Writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// New creates a new Splitter. name is the naming template of output files,
+// for instance:
+//
+//	archive-{{printf "%04d" .Index}}.mbox
+//	{{.Month}}/part{{.Part}}.mbox
+func New(name string) (*Splitter, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Splitter{tmpl: tmpl}, nil
+}
+
+// Files returns the names of the output files created so far.
+func (s *Splitter) Files() []string {
+	return s.files
+}
+
+// WriteMessage writes a message read from r. r must contain the whole message
+// text (including both the header and the body), with LF line endings.
+//
+// If from is empty or t is zero, they are derived from the message header, as
+// done by mbox.Writer.WriteMessage.
+func (s *Splitter) WriteMessage(from string, t time.Time, r io.Reader) error {
+	return s.writeMessage("", from, t, r, false)
+}
+
+// Split writes all messages read from r. Their From line is kept as is; if
+// its date can't be parsed, the output file is picked with the date derived
+// from the header.
+func (s *Splitter) Split(r *mbox.Reader) error {
+	for {
+		msg, err := r.NextMessage()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Messages are read with CRLF line endings, except mboxcl2 messages
+		// which are read as is
+		crlf := r.Format != mbox.FormatMboxcl2
+		if err := s.writeMessage(r.FromLine(), "", time.Time{}, msg, crlf); err != nil {
+			return err
+		}
+	}
+}
+
+// writeMessage writes a message. If fromLine isn't empty, it's written as is
+// and from is ignored.
+func (s *Splitter) writeMessage(fromLine, from string, t time.Time, r io.Reader, crlf bool) error {
+	if s.tmpl == nil {
+		return errors.New("split: Splitter not created with New")
+	}
+
+	if fromLine != "" {
+		_, t, _ = mbox.ParseFromLine(fromLine)
+	}
+	needFrom := fromLine == "" && from == ""
+
+	// The date is needed beforehand to pick the output file
+	if needFrom || t.IsZero() {
+		br := bufio.NewReader(r)
+		hdr, err := msgutil.ReadHeader(br)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if msg, err := mail.ReadMessage(bytes.NewReader(hdr)); err == nil {
+			sender, date := mbox.HeaderEnvelope(msg.Header)
+			if needFrom {
+				from = sender
+			}
+			if t.IsZero() {
+				t = date
+			}
+		}
+		r = io.MultiReader(bytes.NewReader(hdr), br)
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+	month := t.UTC().Format("2006-01")
+
+	if s.cur != nil {
+		full := s.MaxMessages > 0 && s.cur.count >= s.MaxMessages
+		if full || (s.ByMonth && s.cur.month != month) {
+			if err := s.closeOutput(); err != nil {
+				return err
+			}
+		}
+	}
+	if s.cur == nil {
+		if err := s.createOutput(t); err != nil {
+			return err
+		}
+	}
+
+	start := s.cur.cw.n
+	var mw io.WriteCloser
+	var err error
+	if fromLine != "" {
+		mw, err = s.cur.w.CreateMessageFromLine(fromLine)
+	} else {
+		mw, err = s.cur.w.CreateMessage(from, t)
+	}
+	if err != nil {
+		return err
+	}
+	var w io.Writer = mw
+	var lw *msgutil.LFWriter
+	if crlf {
+		lw = msgutil.NewLFWriter(mw)
+		w = lw
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if lw != nil {
+		if err := lw.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	if s.MaxSize > 0 && s.cur.cw.n > s.MaxSize && s.cur.count > 0 {
+		return s.moveLastMessage(start, t)
+	}
+	s.cur.count++
+	return nil
+}
+
+// moveLastMessage moves the last message written to the current output file,
+// starting at offset start, to a new output file.
+func (s *Splitter) moveLastMessage(start int64, t time.Time) error {
+	prev := s.cur
+	size := prev.cw.n - start
+	if err := prev.bw.Flush(); err != nil {
+		return err
+	}
+	s.cur = nil
+	if err := s.createOutput(t); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(s.cur.cw, io.NewSectionReader(prev.f, start, size)); err != nil {
+		return err
+	}
+	s.cur.count++
+
+	err := prev.f.Truncate(start)
+	if closeErr := prev.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *Splitter) createOutput(t time.Time) error {
+	month := t.UTC().Format("2006-01")
+	s.index++
+	if len(s.files) > 0 && s.lastMonth == month {
+		s.part++
+	} else {
+		s.part = 1
+	}
+
+	var buf bytes.Buffer
+	data := &NameData{Index: s.index, Part: s.part, Date: t, Month: month}
+	if err := s.tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+	name := buf.String()
+	if name == "" {
+		return fmt.Errorf("split: empty output file name for file #%v", s.index)
+	}
+
+	if dir := filepath.Dir(name); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	out := &output{f: f, month: month}
+	out.bw = bufio.NewWriter(f)
+	out.cw = &countingWriter{w: out.bw}
+	out.w = mbox.NewWriter(out.cw)
+	out.w.Format = s.Format
+	s.cur = out
+	s.files = append(s.files, name)
+	s.lastMonth = month
+	return nil
+}
+
+func (s *Splitter) closeOutput() error {
+	out := s.cur
+	s.cur = nil
+	err := out.w.Close()
+	if flushErr := out.bw.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := out.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close closes the current output file.
+func (s *Splitter) Close() error {
+	if s.cur == nil {
+		return nil
+	}
+	return s.closeOutput()
+}
@@ -0,0 +1,240 @@
+package split
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-mbox"
+)
+
+func testMbox(n int) string {
+	var sb strings.Builder
+	date := time.Date(2015, time.January, 30, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		t := date.Add(time.Duration(i) * 24 * time.Hour)
+		fmt.Fprintf(&sb, "From herp.derp@example.com %v\n", t.Format(time.ANSIC))
+		fmt.Fprintf(&sb, "Subject: Message %v\n\n>From the body.\n\n", i)
+	}
+	return sb.String()
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "split-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func countMessages(t *testing.T, name string) int {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r := mbox.NewReader(f)
+	n := 0
+	for {
+		if _, err := r.NextMessage(); err != nil {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+func split(t *testing.T, s *Splitter, n int) []int {
+	if err := s.Split(mbox.NewReader(strings.NewReader(testMbox(n)))); err != nil {
+		t.Fatalf("Split() = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	var counts []int
+	for _, name := range s.Files() {
+		counts = append(counts, countMessages(t, name))
+	}
+	return counts
+}
+
+func TestSplitter_maxMessages(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	s, err := New(filepath.Join(dir, `{{printf "%02d" .Index}}.mbox`))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	s.MaxMessages = 2
+	if got, want := split(t, s, 5), []int{2, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("message counts = %v, want %v", got, want)
+	}
+
+	wantFiles := []string{
+		filepath.Join(dir, "01.mbox"),
+		filepath.Join(dir, "02.mbox"),
+		filepath.Join(dir, "03.mbox"),
+	}
+	if !reflect.DeepEqual(s.Files(), wantFiles) {
+		t.Errorf("Files() = %v, want %v", s.Files(), wantFiles)
+	}
+
+	b, err := ioutil.ReadFile(wantFiles[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From herp.derp@example.com Tue Feb  3 00:00:00 2015\n" +
+		"Subject: Message 4\n\n>From the body.\n\n"
+	if string(b) != want {
+		t.Errorf("last file = %q, want %q", b, want)
+	}
+}
+
+func TestSplitter_maxSize(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	const msgSize = 89
+	s, err := New(filepath.Join(dir, "{{.Index}}.mbox"))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	s.MaxSize = 3*msgSize + 10
+	if got, want := split(t, s, 7), []int{3, 3, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("message counts = %v, want %v", got, want)
+	}
+	for _, name := range s.Files() {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > s.MaxSize {
+			t.Errorf("%v: size %v > %v", name, fi.Size(), s.MaxSize)
+		}
+	}
+
+	// A message larger than MaxSize is written alone
+	dir2, cleanup2 := tempDir(t)
+	defer cleanup2()
+	s, err = New(filepath.Join(dir2, "{{.Index}}.mbox"))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	s.MaxSize = 10
+	if got, want := split(t, s, 3), []int{1, 1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("message counts = %v, want %v", got, want)
+	}
+}
+
+func TestSplitter_byMonth(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	s, err := New(filepath.Join(dir, "{{.Month}}", "{{.Part}}.mbox"))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	s.ByMonth = true
+	s.MaxMessages = 3
+	// From 2015-01-30 to 2015-02-05
+	if got, want := split(t, s, 7), []int{2, 3, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("message counts = %v, want %v", got, want)
+	}
+
+	wantFiles := []string{
+		filepath.Join(dir, "2015-01", "1.mbox"),
+		filepath.Join(dir, "2015-02", "1.mbox"),
+		filepath.Join(dir, "2015-02", "2.mbox"),
+	}
+	if !reflect.DeepEqual(s.Files(), wantFiles) {
+		t.Errorf("Files() = %v, want %v", s.Files(), wantFiles)
+	}
+}
+
+func TestSplitter_noOverwrite(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	name := filepath.Join(dir, "archive.mbox")
+	if err := ioutil.WriteFile(name, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(name)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	err = s.WriteMessage("herp.derp@example.com", time.Now(), strings.NewReader("Subject: Hi\n\nHi.\n"))
+	if !os.IsExist(err) {
+		t.Errorf("WriteMessage() = %v, want an os.IsExist error", err)
+	}
+}
+
+func TestSplitter_preserve(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	in := "From herp.derp@example.com Fri Jan 30 00:00:00 2015 remote from example\n" +
+		"Subject: Remote\n\nHi.\n\n" +
+		"From herp.derp@example.com yesterday\n" +
+		"Date: Sat, 31 Jan 2015 00:00:00 +0000\n" +
+		"Subject: Bad date\n\nHi.\n\n"
+	s, err := New(filepath.Join(dir, `{{.Month}}.mbox`))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	s.ByMonth = true
+	if err := s.Split(mbox.NewReader(strings.NewReader(in))); err != nil {
+		t.Fatalf("Split() = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "2015-01.mbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != in {
+		t.Errorf("Split() wrote %q, want %q", b, in)
+	}
+}
+
+func TestSplitter_mboxcl2(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	in := "From herp.derp@example.com Fri Jan 30 00:00:00 2015\n" +
+		"Subject: CRLF\r\n" +
+		"Content-Length: 5\r\n\r\n" +
+		"Hi.\r\n\n"
+	s, err := New(filepath.Join(dir, "out.mbox"))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	s.Format = mbox.FormatMboxcl2
+	r := mbox.NewReader(strings.NewReader(in))
+	r.Format = mbox.FormatMboxcl2
+	if err := s.Split(r); err != nil {
+		t.Fatalf("Split() = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "out.mbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != in {
+		t.Errorf("Split() wrote %q, want %q", b, in)
+	}
+}
@@ -0,0 +1,91 @@
+package mbox
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// Flags is a set of message flags, as stored in the Status and X-Status header
+// fields by mutt, Pine, Thunderbird and Dovecot.
+type Flags int
+
+const (
+	// FlagRead is stored as "R" in the Status field.
+	FlagRead Flags = 1 << iota
+	// FlagOld is stored as "O" in the Status field. It is set on messages
+	// which have been seen by a mail client, but not necessarily read.
+	FlagOld
+	// FlagAnswered is stored as "A" in the X-Status field.
+	FlagAnswered
+	// FlagFlagged is stored as "F" in the X-Status field.
+	FlagFlagged
+	// FlagDraft is stored as "T" in the X-Status field.
+	FlagDraft
+	// FlagDeleted is stored as "D" in the X-Status field.
+	FlagDeleted
+)
+
+var (
+	statusFlags = []struct {
+		flag Flags
+		c    byte
+	}{
+		{FlagRead, 'R'},
+		{FlagOld, 'O'},
+	}
+	xStatusFlags = []struct {
+		flag Flags
+		c    byte
+	}{
+		{FlagAnswered, 'A'},
+		{FlagFlagged, 'F'},
+		{FlagDraft, 'T'},
+		{FlagDeleted, 'D'},
+	}
+)
+
+// The maximum length of the Status and X-Status field values.
+const (
+	statusLen  = 2
+	xStatusLen = 4
+)
+
+// ParseFlags returns the flags stored in the Status and X-Status fields of a
+// message header. Unknown flags are ignored.
+func ParseFlags(h mail.Header) Flags {
+	var flags Flags
+	status, xStatus := h.Get("Status"), h.Get("X-Status")
+	for _, f := range statusFlags {
+		if strings.IndexByte(status, f.c) >= 0 {
+			flags |= f.flag
+		}
+	}
+	for _, f := range xStatusFlags {
+		if strings.IndexByte(xStatus, f.c) >= 0 {
+			flags |= f.flag
+		}
+	}
+	return flags
+}
+
+// Status returns the value of the Status field for the flags.
+func (flags Flags) Status() string {
+	var b []byte
+	for _, f := range statusFlags {
+		if flags&f.flag != 0 {
+			b = append(b, f.c)
+		}
+	}
+	return string(b)
+}
+
+// XStatus returns the value of the X-Status field for the flags.
+func (flags Flags) XStatus() string {
+	var b []byte
+	for _, f := range xStatusFlags {
+		if flags&f.flag != 0 {
+			b = append(b, f.c)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,27 @@
+package mbox
+
+import (
+	"net/mail"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	h := mail.Header{
+		"Status":   {"RO"},
+		"X-Status": {"AF "},
+	}
+	want := FlagRead | FlagOld | FlagAnswered | FlagFlagged
+	if flags := ParseFlags(h); flags != want {
+		t.Errorf("ParseFlags() = %v, want %v", flags, want)
+	}
+
+	if s := want.Status(); s != "RO" {
+		t.Errorf("Status() = %q, want %q", s, "RO")
+	}
+	if s := want.XStatus(); s != "AF" {
+		t.Errorf("XStatus() = %q, want %q", s, "AF")
+	}
+	if s := (FlagDraft | FlagDeleted).XStatus(); s != "TD" {
+		t.Errorf("XStatus() = %q, want %q", s, "TD")
+	}
+}
@@ -0,0 +1,214 @@
+// Package takeout reads mbox archives exported by Google Takeout.
+//
+// Each message of a Takeout archive carries its Gmail message ID in the From
+// line (e.g. "From 1632461782359385342@xxx"), its thread ID in the X-GM-THRID
+// header field and its labels in the X-Gmail-Labels header field.
+package takeout
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+// Message is a message from a Takeout archive.
+type Message struct {
+	// ID is the Gmail message ID, or zero if missing.
+	ID uint64
+	// ThreadID is the Gmail thread ID, or zero if missing.
+	ThreadID uint64
+	// Labels contains the Gmail labels of the message, including system
+	// labels such as "Inbox", "Sent" or "Important".
+	Labels []string
+	// Date is the date of the From line.
+	Date time.Time
+
+	// Header is the message header. It's empty if the header is malformed, in
+	// which case ThreadID and Labels are taken from the fields which can
+	// still be parsed.
+	Header mail.Header
+	// Text contains the whole message text (including both the header and the
+	// body), as returned by mbox.Reader.NextMessage.
+	Text io.Reader
+}
+
+// Reader reads messages from a Takeout archive.
+type Reader struct {
+	mr *mbox.Reader
+}
+
+// NewReader returns a new Reader reading a Takeout archive from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{mr: mbox.NewReader(r)}
+}
+
+// NextMessage returns the next message. It returns io.EOF if there are no
+// messages left. A message with a malformed header is still returned, see
+// Message.Header.
+func (r *Reader) NextMessage() (*Message, error) {
+	mr, err := r.mr.NextMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(mr)
+	hdr, err := msgutil.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		Header: make(mail.Header),
+		Text:   io.MultiReader(bytes.NewReader(hdr), br),
+	}
+	var h mail.Header
+	if m, err := mail.ReadMessage(bytes.NewReader(hdr)); err == nil {
+		h = m.Header
+		msg.Header = h
+	} else {
+		h = parseFields(hdr)
+	}
+
+	sender, date, _ := mbox.ParseFromLine(r.mr.FromLine())
+	msg.Date = date
+	if i := strings.IndexByte(sender, '@'); i >= 0 {
+		msg.ID, _ = strconv.ParseUint(sender[:i], 10, 64)
+	}
+	msg.ThreadID, _ = strconv.ParseUint(strings.TrimSpace(h.Get("X-GM-THRID")), 10, 64)
+	msg.Labels = ParseLabels(h.Get("X-Gmail-Labels"))
+
+	return msg, nil
+}
+
+// parseFields parses the well-formed fields of a malformed header. Lines which
+// aren't fields, and their continuation lines, are skipped.
+func parseFields(hdr []byte) mail.Header {
+	h := make(mail.Header)
+	var key string
+	for _, l := range strings.Split(string(hdr), "\n") {
+		l = strings.TrimRight(l, "\r")
+		if l == "" {
+			break
+		}
+		if l[0] == ' ' || l[0] == '\t' {
+			if key != "" {
+				vs := h[key]
+				vs[len(vs)-1] += " " + strings.TrimSpace(l)
+			}
+			continue
+		}
+
+		key = ""
+		i := strings.IndexByte(l, ':')
+		if i <= 0 || strings.ContainsAny(l[:i], " \t") {
+			continue
+		}
+		key = textproto.CanonicalMIMEHeaderKey(l[:i])
+		h[key] = append(h[key], strings.TrimSpace(l[i+1:]))
+	}
+	return h
+}
+
+// ParseLabels parses the value of an X-Gmail-Labels header field. Labels are
+// separated by commas, labels containing commas are quoted, and labels
+// containing non-ASCII characters may be encoded words.
+func ParseLabels(v string) []string {
+	var labels []string
+	var label strings.Builder
+	quoted := false
+	flush := func() {
+		s := strings.TrimSpace(label.String())
+		label.Reset()
+		if s == "" {
+			return
+		}
+		if dec, err := new(mime.WordDecoder).DecodeHeader(s); err == nil {
+			s = dec
+		}
+		labels = append(labels, s)
+	}
+
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && quoted && i+1 < len(v):
+			i++
+			label.WriteByte(v[i])
+		case c == ',' && !quoted:
+			flush()
+		default:
+			label.WriteByte(c)
+		}
+	}
+	flush()
+
+	return labels
+}
+
+// SplitByLabel reads a Takeout archive from r and writes each message to one
+// mbox per label, preserving the Gmail message ID in the From line. A message
+// with several labels is written to several mboxes.
+//
+// create is called the first time a label is encountered and must return the
+// Writer for this label. Messages without labels are passed an empty label.
+// All Writers are closed before SplitByLabel returns.
+func SplitByLabel(r io.Reader, create func(label string) (*mbox.Writer, error)) error {
+	writers := make(map[string]*mbox.Writer)
+	err := splitByLabel(r, writers, create)
+	for _, w := range writers {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func splitByLabel(r io.Reader, writers map[string]*mbox.Writer, create func(label string) (*mbox.Writer, error)) error {
+	tr := NewReader(r)
+	for {
+		msg, err := tr.NextMessage()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		text, err := ioutil.ReadAll(msg.Text)
+		if err != nil {
+			return err
+		}
+
+		from := ""
+		if msg.ID != 0 {
+			from = strconv.FormatUint(msg.ID, 10) + "@xxx"
+		}
+
+		labels := msg.Labels
+		if len(labels) == 0 {
+			labels = []string{""}
+		}
+		for _, label := range labels {
+			w, ok := writers[label]
+			if !ok {
+				if w, err = create(label); err != nil {
+					return err
+				}
+				writers[label] = w
+			}
+
+			if err := w.WriteMessage(from, msg.Date, bytes.NewReader(text)); err != nil {
+				return err
+			}
+		}
+	}
+}
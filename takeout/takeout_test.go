@@ -0,0 +1,142 @@
+package takeout
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-mbox"
+)
+
+const archive = `From 1632461782359385342@xxx Sun Apr 28 10:32:11 +0000 2019
+X-GM-THRID: 1632461782359385342
+X-Gmail-Labels: Inbox,Important,"Travel, 2019",=?UTF-8?Q?R=C3=A9sum=C3=A9?=
+From: herp.derp@example.com (Herp Derp)
+Subject: Test
+
+This is a simple test.
+
+From 1632461782359385343@xxx Sun Apr 28 11:00:00 +0000 2019
+X-GM-THRID: 1632461782359385342
+X-Gmail-Labels: Sent
+From: derp.herp@example.com (Derp Herp)
+Subject: Re: Test
+
+This is a reply.
+`
+
+func TestReader(t *testing.T) {
+	r := NewReader(strings.NewReader(archive))
+
+	msg, err := r.NextMessage()
+	if err != nil {
+		t.Fatalf("NextMessage() = %v", err)
+	}
+	if msg.ID != 1632461782359385342 || msg.ThreadID != 1632461782359385342 {
+		t.Errorf("Got ID %v, thread ID %v", msg.ID, msg.ThreadID)
+	}
+	wantLabels := []string{"Inbox", "Important", "Travel, 2019", "Résumé"}
+	if !reflect.DeepEqual(msg.Labels, wantLabels) {
+		t.Errorf("Labels = %q, want %q", msg.Labels, wantLabels)
+	}
+	if s := msg.Header.Get("Subject"); s != "Test" {
+		t.Errorf("Subject = %q", s)
+	}
+	b, err := ioutil.ReadAll(msg.Text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(b, []byte("\r\nThis is a simple test.\r\n")) {
+		t.Errorf("Unexpected message text: %q", b)
+	}
+
+	msg, err = r.NextMessage()
+	if err != nil {
+		t.Fatalf("NextMessage() = %v", err)
+	}
+	if msg.ID != 1632461782359385343 || !reflect.DeepEqual(msg.Labels, []string{"Sent"}) {
+		t.Errorf("Got ID %v, labels %q", msg.ID, msg.Labels)
+	}
+
+	if _, err := r.NextMessage(); err != io.EOF {
+		t.Errorf("NextMessage() = %v, want io.EOF", err)
+	}
+}
+
+func TestSplitByLabel(t *testing.T) {
+	bufs := make(map[string]*bytes.Buffer)
+	err := SplitByLabel(strings.NewReader(archive), func(label string) (*mbox.Writer, error) {
+		var b bytes.Buffer
+		bufs[label] = &b
+		return mbox.NewWriter(&b), nil
+	})
+	if err != nil {
+		t.Fatalf("SplitByLabel() = %v", err)
+	}
+
+	if len(bufs) != 5 {
+		t.Errorf("Got %v mboxes, want 5", len(bufs))
+	}
+
+	sent := bufs["Sent"].String()
+	if !strings.HasPrefix(sent, "From 1632461782359385343@xxx Sun Apr 28 11:00:00 2019\n") {
+		t.Errorf("Unexpected Sent mbox: %q", sent)
+	}
+	if n := strings.Count(bufs["Travel, 2019"].String(), "\nSubject: Test\n"); n != 1 {
+		t.Errorf("Travel mbox contains %v messages", n)
+	}
+}
+
+func TestSplitByLabel_malformedHeader(t *testing.T) {
+	in := archive + `
+From 1632461782359385344@xxx Sun Apr 28 12:00:00 +0000 2019
+X-GM-THRID: 1632461782359385344
+this is not a header line
+X-Gmail-Labels: Spam,
+ Unread
+Subject: Malformed
+
+Buy now.
+
+From 1632461782359385345@xxx Sun Apr 28 13:00:00 +0000 2019
+X-Gmail-Labels: Sent
+Subject: After
+
+Still here.
+`
+	r := NewReader(strings.NewReader(in))
+	for i := 0; i < 2; i++ {
+		if _, err := r.NextMessage(); err != nil {
+			t.Fatalf("NextMessage() = %v", err)
+		}
+	}
+	msg, err := r.NextMessage()
+	if err != nil {
+		t.Fatalf("NextMessage() on malformed header = %v", err)
+	}
+	if len(msg.Header) != 0 {
+		t.Errorf("Header = %v, want empty", msg.Header)
+	}
+	if msg.ID != 1632461782359385344 || msg.ThreadID != 1632461782359385344 || !reflect.DeepEqual(msg.Labels, []string{"Spam", "Unread"}) {
+		t.Errorf("Got ID %v, thread ID %v, labels %q", msg.ID, msg.ThreadID, msg.Labels)
+	}
+
+	bufs := make(map[string]*bytes.Buffer)
+	err = SplitByLabel(strings.NewReader(in), func(label string) (*mbox.Writer, error) {
+		var b bytes.Buffer
+		bufs[label] = &b
+		return mbox.NewWriter(&b), nil
+	})
+	if err != nil {
+		t.Fatalf("SplitByLabel() = %v", err)
+	}
+	if !strings.Contains(bufs["Spam"].String(), "\nthis is not a header line\n") {
+		t.Errorf("Unexpected Spam mbox: %q", bufs["Spam"].String())
+	}
+	if n := strings.Count(bufs["Sent"].String(), "\nSubject: "); n != 2 {
+		t.Errorf("Sent mbox contains %v messages, want 2", n)
+	}
+}
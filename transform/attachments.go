@@ -0,0 +1,231 @@
+package transform
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// RemoveAttachments returns a transform replacing attachments with a short
+// text/plain part mentioning their file name and content type. Multipart
+// bodies are processed as they are streamed, including nested multiparts.
+// Parts with an "attachment" disposition or a file name are considered
+// attachments. Attachments of messages forwarded as message/rfc822 parts are
+// left as is, unless the forwarded message is itself an attachment.
+func RemoveAttachments() Transform {
+	return TransformFunc(func(msg *Message) error {
+		if boundary := multipartBoundary(msg.Header); boundary != "" {
+			msg.WrapBody(func(w io.Writer) io.WriteCloser {
+				return &attachmentRemover{w: w, bounds: []string{boundary}}
+			})
+		} else if isAttachment(msg.Header) {
+			text := replaceAttachment(msg.Header)
+			msg.WrapBody(func(w io.Writer) io.WriteCloser {
+				return &replaceWriter{w: w, text: text}
+			})
+		}
+		return nil
+	})
+}
+
+func multipartBoundary(h *Header) string {
+	t, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(t, "multipart/") {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// attachmentName returns the file name of a part, or an empty string.
+func attachmentName(h *Header) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil {
+			name = params["name"]
+		}
+	}
+	if s, err := wordDecoder.DecodeHeader(name); err == nil {
+		name = s
+	}
+	return name
+}
+
+func isAttachment(h *Header) bool {
+	if multipartBoundary(h) != "" {
+		return false
+	}
+	disp, _, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	return disp == "attachment" || attachmentName(h) != ""
+}
+
+// replaceAttachment replaces the Content-* fields of an attachment header
+// with the ones of a text/plain part, and returns the text of the part.
+func replaceAttachment(h *Header) string {
+	name := attachmentName(h)
+	if name == "" {
+		name = "unnamed"
+	}
+	t, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		t = "application/octet-stream"
+	}
+
+	h.Filter(func(f *Field) bool {
+		return !strings.HasPrefix(strings.ToLower(f.Key), "content-")
+	})
+	h.Add("Content-Type", "text/plain; charset=utf-8")
+	for _, c := range name {
+		if c >= 0x80 {
+			h.Add("Content-Transfer-Encoding", "8bit")
+			break
+		}
+	}
+	return fmt.Sprintf("Attachment removed: %v (%v)\n", name, t)
+}
+
+// replaceWriter discards the data written to it and writes a text instead
+// when closed.
+type replaceWriter struct {
+	w    io.Writer
+	text string
+}
+
+func (rw *replaceWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (rw *replaceWriter) Close() error {
+	_, err := io.WriteString(rw.w, rw.text)
+	return err
+}
+
+type removerMode int
+
+const (
+	// Copy lines: preambles, epilogues and parts which aren't attachments
+	modeCopy removerMode = iota
+	// Accumulate the lines of a part header
+	modeHeader
+	// Skip the lines of an attachment
+	modeSkip
+)
+
+// attachmentRemover removes attachments from a multipart body. It processes
+// the body line by line, keeping track of the boundaries of the enclosing
+// multiparts.
+type attachmentRemover struct {
+	w      io.Writer
+	bounds []string
+	mode   removerMode
+	buf    []byte
+	hdr    []byte
+}
+
+func (r *attachmentRemover) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	b := r.buf
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			break
+		}
+		if err := r.line(b[:i+1]); err != nil {
+			return 0, err
+		}
+		b = b[i+1:]
+	}
+	r.buf = append(r.buf[:0], b...)
+	return len(p), nil
+}
+
+// matchBoundary checks whether l is a delimiter line of one of the enclosing
+// multiparts. It returns the index of the multipart, or -1, and whether l is
+// a close delimiter.
+func (r *attachmentRemover) matchBoundary(l []byte) (int, bool) {
+	l = bytes.TrimRight(l, " \t\r\n")
+	if !bytes.HasPrefix(l, []byte("--")) {
+		return -1, false
+	}
+	for i := len(r.bounds) - 1; i >= 0; i-- {
+		b := "--" + r.bounds[i]
+		if string(l) == b {
+			return i, false
+		} else if string(l) == b+"--" {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+func (r *attachmentRemover) line(l []byte) error {
+	if r.mode == modeHeader {
+		r.hdr = append(r.hdr, l...)
+		if len(bytes.TrimRight(l, "\r\n")) == 0 {
+			return r.partHeader()
+		}
+		return nil
+	}
+
+	if i, closing := r.matchBoundary(l); i >= 0 {
+		// Unterminated nested multiparts are implicitly closed
+		r.bounds = r.bounds[:i+1]
+		if closing {
+			r.bounds = r.bounds[:i]
+			r.mode = modeCopy
+		} else {
+			r.mode = modeHeader
+			r.hdr = r.hdr[:0]
+		}
+		_, err := r.w.Write(l)
+		return err
+	}
+
+	if r.mode == modeSkip {
+		return nil
+	}
+	_, err := r.w.Write(l)
+	return err
+}
+
+// partHeader processes the header of a part, once fully read.
+func (r *attachmentRemover) partHeader() error {
+	h := parseHeader(r.hdr)
+	if boundary := multipartBoundary(h); boundary != "" {
+		r.bounds = append(r.bounds, boundary)
+		r.mode = modeCopy
+	} else if isAttachment(h) {
+		text := replaceAttachment(h)
+		var b bytes.Buffer
+		h.WriteTo(&b)
+		b.WriteString(text)
+		_, err := b.WriteTo(r.w)
+		r.mode = modeSkip
+		return err
+	} else {
+		r.mode = modeCopy
+	}
+	_, err := r.w.Write(r.hdr)
+	return err
+}
+
+func (r *attachmentRemover) Close() error {
+	if len(r.buf) > 0 {
+		l := r.buf
+		r.buf = nil
+		if err := r.line(l); err != nil {
+			return err
+		}
+	}
+	if r.mode == modeHeader {
+		// Truncated part header
+		r.mode = modeCopy
+		_, err := r.w.Write(r.hdr)
+		return err
+	}
+	return nil
+}
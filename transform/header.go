@@ -0,0 +1,177 @@
+package transform
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+)
+
+// maxLineLen is the length at which modified header fields are folded.
+const maxLineLen = 78
+
+var wordDecoder mime.WordDecoder
+
+// Field is a header field. Unmodified fields are written back as is, with
+// their original folding.
+type Field struct {
+	// Key is the field name, as written in the message.
+	Key string
+
+	// raw is the whole field, including the name and the continuation
+	// lines, with LF line endings
+	raw []byte
+}
+
+// Value returns the raw value of the field, unfolded and without leading and
+// trailing whitespace. Encoded words aren't decoded.
+func (f *Field) Value() string {
+	v := f.raw
+	if i := bytes.IndexByte(v, ':'); i >= 0 && f.Key != "" {
+		v = v[i+1:]
+	}
+	v = bytes.Replace(v, []byte("\r\n"), nil, -1)
+	v = bytes.Replace(v, []byte("\n"), nil, -1)
+	return strings.TrimSpace(string(v))
+}
+
+// SetValue sets the raw value of the field. v must already be encoded, see
+// SetText. The field is folded if it's too long.
+func (f *Field) SetValue(v string) {
+	f.raw = foldField(f.Key, v)
+}
+
+// Text returns the value of the field with encoded words decoded.
+func (f *Field) Text() (string, error) {
+	return wordDecoder.DecodeHeader(f.Value())
+}
+
+// SetText sets the value of the field, encoding it with encoded words if it
+// contains non-ASCII characters.
+func (f *Field) SetText(s string) {
+	f.SetValue(mime.QEncoding.Encode("utf-8", s))
+}
+
+// foldField formats a field, folding it at whitespace so that lines don't
+// exceed maxLineLen when possible.
+func foldField(k, v string) []byte {
+	var b bytes.Buffer
+	line := k + ":"
+	for _, word := range strings.Split(strings.TrimSpace(v), " ") {
+		word = " " + word
+		if len(line)+len(word) > maxLineLen && line != k+":" && strings.TrimSpace(line) != "" {
+			b.WriteString(line + "\n")
+			line = ""
+		}
+		line += word
+	}
+	b.WriteString(line + "\n")
+	return b.Bytes()
+}
+
+// Header is a message header. The order of fields is preserved.
+type Header struct {
+	fields []*Field
+}
+
+// parseHeader parses a raw header with LF line endings, up to and including
+// the blank line separating it from the body. Lines which aren't header
+// fields are kept as fields with an empty key.
+func parseHeader(b []byte) *Header {
+	h := &Header{}
+	var last *Field
+	for len(b) > 0 {
+		l := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			l = b[:i+1]
+		}
+		b = b[len(l):]
+
+		if len(bytes.TrimRight(l, "\r\n")) == 0 {
+			break
+		}
+		if (l[0] == ' ' || l[0] == '\t') && last != nil {
+			last.raw = append(last.raw, l...)
+			continue
+		}
+		if l[len(l)-1] != '\n' {
+			l = append(l[:len(l):len(l)], '\n')
+		}
+
+		last = &Field{raw: append([]byte(nil), l...)}
+		if i := bytes.IndexByte(l, ':'); i > 0 {
+			last.Key = strings.TrimRight(string(l[:i]), " \t")
+		}
+		h.fields = append(h.fields, last)
+	}
+	return h
+}
+
+// Fields returns the fields of the header. The returned fields can be
+// modified.
+func (h *Header) Fields() []*Field {
+	return h.fields
+}
+
+// Get returns the raw value of the first field with the key k, or an empty
+// string. Keys are case-insensitive.
+func (h *Header) Get(k string) string {
+	for _, f := range h.fields {
+		if f.Key != "" && strings.EqualFold(f.Key, k) {
+			return f.Value()
+		}
+	}
+	return ""
+}
+
+// Add appends a field with the raw value v to the header.
+func (h *Header) Add(k, v string) {
+	h.fields = append(h.fields, &Field{Key: k, raw: foldField(k, v)})
+}
+
+// Set replaces all the fields with the key k with a single one with the raw
+// value v. The field stays at the position of the first replaced one.
+func (h *Header) Set(k, v string) {
+	for _, f := range h.fields {
+		if f.Key != "" && strings.EqualFold(f.Key, k) {
+			f.SetValue(v)
+			h.Filter(func(other *Field) bool {
+				return other == f || !strings.EqualFold(other.Key, k)
+			})
+			return
+		}
+	}
+	h.Add(k, v)
+}
+
+// Del removes all the fields with the key k.
+func (h *Header) Del(k string) {
+	h.Filter(func(f *Field) bool {
+		return f.Key == "" || !strings.EqualFold(f.Key, k)
+	})
+}
+
+// Filter removes the fields for which keep returns false.
+func (h *Header) Filter(keep func(f *Field) bool) {
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if keep(f) {
+			fields = append(fields, f)
+		}
+	}
+	for i := len(fields); i < len(h.fields); i++ {
+		h.fields[i] = nil
+	}
+	h.fields = fields
+}
+
+// WriteTo writes the header, including the blank line separating it from the
+// body, with LF line endings.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	for _, f := range h.fields {
+		b.Write(f.raw)
+	}
+	b.WriteString("\n")
+	return b.WriteTo(w)
+}
@@ -0,0 +1,54 @@
+package transform
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testHeader = "Received: from mx.example.org\n" +
+	"\tby mx.example.com; Thu, 1 Jan 2015 00:00:01 +0000\n" +
+	"From: =?UTF-8?Q?Ren=C3=A9e?= <renee@example.com>\n" +
+	"Subject: =?UTF-8?Q?Caf=C3=A9?=\n" +
+	" =?UTF-8?Q?_cr=C3=A8me?=\n" +
+	"X-Empty:\n" +
+	"\n"
+
+func TestHeader(t *testing.T) {
+	h := parseHeader([]byte(testHeader))
+
+	var b bytes.Buffer
+	h.WriteTo(&b)
+	if b.String() != testHeader {
+		t.Errorf("WriteTo() = %q, want %q", b.String(), testHeader)
+	}
+
+	if v, want := h.Get("received"), "from mx.example.org\tby mx.example.com; Thu, 1 Jan 2015 00:00:01 +0000"; v != want {
+		t.Errorf("Get(Received) = %q, want %q", v, want)
+	}
+
+	fields := h.Fields()
+	if len(fields) != 4 {
+		t.Fatalf("len(Fields()) = %v, want 4", len(fields))
+	}
+	if s, err := fields[2].Text(); err != nil || s != "Café crème" {
+		t.Errorf("Text() = %q, %v, want %q", s, err, "Café crème")
+	}
+
+	fields[2].SetText("Thé")
+	h.Del("Received")
+	h.Set("X-Empty", "not anymore")
+	h.Add("X-Long", strings.Repeat("word ", 20))
+
+	want := "From: =?UTF-8?Q?Ren=C3=A9e?= <renee@example.com>\n" +
+		"Subject: =?utf-8?q?Th=C3=A9?=\n" +
+		"X-Empty: not anymore\n" +
+		"X-Long: word word word word word word word word word word word word word word\n" +
+		" word word word word word word\n" +
+		"\n"
+	b.Reset()
+	h.WriteTo(&b)
+	if b.String() != want {
+		t.Errorf("WriteTo() = \n%v\nwant:\n%v", b.String(), want)
+	}
+}
@@ -0,0 +1,122 @@
+package transform
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-mbox"
+)
+
+// DropFields returns a transform removing the header fields with the given
+// keys, including their continuation lines. For instance, DropFields("Received")
+// removes the Received chain.
+func DropFields(keys ...string) Transform {
+	return TransformFunc(func(msg *Message) error {
+		for _, k := range keys {
+			msg.Header.Del(k)
+		}
+		return nil
+	})
+}
+
+// AddressFields is the list of header fields containing addresses rewritten
+// by RewriteAddresses.
+var AddressFields = []string{
+	"From", "Sender", "Reply-To", "To", "Cc", "Bcc",
+	"Resent-From", "Resent-Sender", "Resent-To", "Resent-Cc", "Resent-Bcc",
+	"Return-Path", "Delivered-To", "X-Original-To", "Errors-To",
+	"Disposition-Notification-To",
+}
+
+var addressParser = mail.AddressParser{WordDecoder: &wordDecoder}
+
+// RewriteAddresses returns a transform calling f on the addresses of the
+// fields listed in AddressFields and on the envelope sender of the From line.
+// f can modify the address and the display name. Display names are decoded
+// before calling f and encoded again afterwards.
+//
+// Fields which can't be parsed as address lists are removed, so that no
+// address is left behind. A null Return-Path is kept as is.
+func RewriteAddresses(f func(addr *mail.Address)) Transform {
+	return TransformFunc(func(msg *Message) error {
+		removed := make(map[*Field]bool)
+		for _, k := range AddressFields {
+			for _, field := range msg.Header.Fields() {
+				if !strings.EqualFold(field.Key, k) {
+					continue
+				}
+				v := field.Value()
+				if v == "<>" && strings.EqualFold(k, "Return-Path") {
+					continue
+				}
+
+				addrs, err := addressParser.ParseList(v)
+				if err != nil || len(addrs) == 0 {
+					removed[field] = true
+					continue
+				}
+				l := make([]string, len(addrs))
+				for i, addr := range addrs {
+					f(addr)
+					l[i] = addr.String()
+				}
+				field.SetValue(strings.Join(l, ", "))
+			}
+		}
+		msg.Header.Filter(func(field *Field) bool {
+			return !removed[field]
+		})
+
+		// The sender is rewritten even if the date can't be parsed
+		sender, _, _ := mbox.ParseFromLine(msg.FromLine)
+		if strings.Contains(sender, "@") {
+			addr := &mail.Address{Address: sender}
+			f(addr)
+			rest := strings.TrimLeft(strings.TrimPrefix(msg.FromLine, "From "), " ")
+			start := len(msg.FromLine) - len(rest)
+			msg.FromLine = msg.FromLine[:start] + addr.Address + msg.FromLine[start+len(sender):]
+		}
+		return nil
+	})
+}
+
+// redactedDomain is the domain of redacted addresses. The .invalid top-level
+// domain is reserved by RFC 2606.
+const redactedDomain = "redacted.invalid"
+
+// StripAddresses returns a transform replacing all addresses with
+// "redacted@redacted.invalid" and removing display names, see
+// RewriteAddresses.
+func StripAddresses() Transform {
+	return RewriteAddresses(func(addr *mail.Address) {
+		addr.Name = ""
+		addr.Address = "redacted@" + redactedDomain
+	})
+}
+
+// HashAddresses returns a transform replacing addresses with pseudonyms and
+// removing display names, see RewriteAddresses. The whole address and the
+// domain are hashed separately with HMAC-SHA256 and key to form the local part
+// and the domain of the pseudonym, so that messages from the same address or
+// domain can still be correlated. Addresses are compared case-insensitively.
+//
+// For instance, "alice@example.com" becomes something like
+// "3f8a1c2b9d0e4f5a@6b7c8d9e0f1a2b3c.redacted.invalid".
+func HashAddresses(key []byte) Transform {
+	hash := func(s string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(strings.ToLower(s)))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return RewriteAddresses(func(addr *mail.Address) {
+		var domain string
+		if i := strings.LastIndexByte(addr.Address, '@'); i >= 0 {
+			domain = addr.Address[i+1:]
+		}
+		addr.Name = ""
+		addr.Address = hash(addr.Address) + "@" + hash(domain) + "." + redactedDomain
+	})
+}
@@ -0,0 +1,130 @@
+// Package transform rewrites the messages of mbox archives.
+//
+// Transforms edit the header of messages and can wrap their body to edit it
+// while it's streamed. Headers are kept as is unless modified, including the
+// folding of fields. Built-in transforms redact addresses, drop header fields
+// and remove attachments.
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/mail"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+// Message is a message being transformed.
+type Message struct {
+	// Index is the index of the message in the mbox stream.
+	Index int
+	// FromLine is the From line of the message. It can be modified; if it's
+	// empty, the envelope is derived from the header when writing the
+	// message.
+	FromLine string
+	Header   *Header
+
+	wrappers []func(w io.Writer) io.WriteCloser
+}
+
+// WrapBody adds a body transform. The body, with LF line endings, is written
+// to the io.WriteCloser returned by wrap, which must write the transformed
+// body to w. Closing it must flush any buffered data, but must not close w.
+// Body transforms are applied in the order they are added.
+func (msg *Message) WrapBody(wrap func(w io.Writer) io.WriteCloser) {
+	msg.wrappers = append(msg.wrappers, wrap)
+}
+
+// Transform transforms a message. The header is written once all transforms
+// have been applied, and the body is then streamed through the body
+// transforms.
+type Transform interface {
+	Transform(msg *Message) error
+}
+
+// TransformFunc is a Transform implemented by a function.
+type TransformFunc func(msg *Message) error
+
+// Transform implements Transform.
+func (f TransformFunc) Transform(msg *Message) error {
+	return f(msg)
+}
+
+// Apply copies the messages read from r to w, applying transforms to each
+// message in order. It returns the number of messages written.
+func Apply(w *mbox.Writer, r *mbox.Reader, transforms ...Transform) (int, error) {
+	for i := 0; ; i++ {
+		text, err := r.NextMessage()
+		if err == io.EOF {
+			return i, nil
+		} else if err != nil {
+			return i, err
+		}
+
+		br := bufio.NewReader(msgutil.NewLFReader(text))
+		hdr, err := msgutil.ReadHeader(br)
+		if err != nil {
+			return i, err
+		}
+		msg := &Message{
+			Index:    i,
+			FromLine: r.FromLine(),
+			Header:   parseHeader(hdr),
+		}
+		for _, t := range transforms {
+			if err := t.Transform(msg); err != nil {
+				return i, err
+			}
+		}
+
+		if err := writeMessage(w, msg, br); err != nil {
+			return i, err
+		}
+	}
+}
+
+func writeMessage(w *mbox.Writer, msg *Message, body io.Reader) error {
+	var b bytes.Buffer
+	if _, err := msg.Header.WriteTo(&b); err != nil {
+		return err
+	}
+
+	var (
+		mw  io.WriteCloser
+		err error
+	)
+	if msg.FromLine != "" {
+		mw, err = w.CreateMessageFromLine(msg.FromLine)
+	} else {
+		var h mail.Header
+		if m, err := mail.ReadMessage(bytes.NewReader(b.Bytes())); err == nil {
+			h = m.Header
+		}
+		mw, err = w.CreateMessage(mbox.HeaderEnvelope(h))
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := b.WriteTo(mw); err != nil {
+		return err
+	}
+
+	// Chain body transforms: the first one receives the original body
+	closers := make([]io.WriteCloser, len(msg.wrappers))
+	var bw io.Writer = mw
+	for i := len(msg.wrappers) - 1; i >= 0; i-- {
+		closers[i] = msg.wrappers[i](bw)
+		bw = closers[i]
+	}
+	if _, err := io.Copy(bw, body); err != nil {
+		return err
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
@@ -0,0 +1,225 @@
+package transform
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-mbox"
+)
+
+func applyString(t *testing.T, in string, transforms ...Transform) string {
+	var buf bytes.Buffer
+	w := mbox.NewWriter(&buf)
+	if _, err := Apply(w, mbox.NewReader(strings.NewReader(in)), transforms...); err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	return buf.String()
+}
+
+func TestApply(t *testing.T) {
+	in := "From alice@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: Hello\n" +
+		"\n" +
+		">From the top.\n" +
+		"\n"
+
+	if out := applyString(t, in); out != in {
+		t.Errorf("Apply() without transforms = %q, want %q", out, in)
+	}
+
+	replace := TransformFunc(func(msg *Message) error {
+		msg.Header.Set("Subject", "Goodbye")
+		msg.WrapBody(func(w io.Writer) io.WriteCloser {
+			return nopCloser{replaceTopWriter{w}}
+		})
+		return nil
+	})
+	want := "From alice@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: Goodbye\n" +
+		"\n" +
+		">From the bottom.\n" +
+		"\n"
+	if out := applyString(t, in, replace); out != want {
+		t.Errorf("Apply() = %q, want %q", out, want)
+	}
+}
+
+// replaceTopWriter replaces "top" with "bottom". It assumes words aren't
+// split across writes.
+type replaceTopWriter struct {
+	w io.Writer
+}
+
+func (w replaceTopWriter) Write(p []byte) (int, error) {
+	if _, err := w.w.Write(bytes.Replace(p, []byte("top"), []byte("bottom"), -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+const testRedactMbox = "From alice@example.com Thu Jan  1 00:00:01 2015\n" +
+	"Return-Path: <alice@example.com>\n" +
+	"Received: from mx.example.org\n" +
+	"\tby mx.example.com; Thu, 1 Jan 2015 00:00:01 +0000\n" +
+	"Received: from localhost by mx.example.org\n" +
+	"From: =?UTF-8?Q?Ren=C3=A9e?= <alice@example.com>\n" +
+	"To: Bob <bob@example.com>,\n" +
+	" carol@example.org\n" +
+	"Cc: not an address\n" +
+	"Subject: Hello\n" +
+	"\n" +
+	"Hi.\n" +
+	"\n"
+
+func TestRedact(t *testing.T) {
+	out := applyString(t, testRedactMbox, DropFields("received"), StripAddresses())
+	want := "From redacted@redacted.invalid Thu Jan  1 00:00:01 2015\n" +
+		"Return-Path: <redacted@redacted.invalid>\n" +
+		"From: <redacted@redacted.invalid>\n" +
+		"To: <redacted@redacted.invalid>, <redacted@redacted.invalid>\n" +
+		"Subject: Hello\n" +
+		"\n" +
+		"Hi.\n" +
+		"\n"
+	if out != want {
+		t.Errorf("Apply() = \n%v\nwant:\n%v", out, want)
+	}
+}
+
+func TestRedact_invalidFromLine(t *testing.T) {
+	in := "From  alice@example.com  yesterday\n" +
+		"Subject: Hello\n" +
+		"\n" +
+		"Hi.\n" +
+		"\n"
+	out := applyString(t, in, StripAddresses())
+	want := "From  redacted@redacted.invalid  yesterday\n" +
+		"Subject: Hello\n" +
+		"\n" +
+		"Hi.\n" +
+		"\n"
+	if out != want {
+		t.Errorf("Apply() = %q, want %q", out, want)
+	}
+}
+
+func TestHashAddresses(t *testing.T) {
+	out := applyString(t, testRedactMbox, DropFields("Received"), HashAddresses([]byte("secret")))
+	r := mbox.NewReader(strings.NewReader(out))
+	text, err := r.NextMessage()
+	if err != nil {
+		t.Fatalf("NextMessage() = %v", err)
+	}
+	m, err := mail.ReadMessage(text)
+	if err != nil {
+		t.Fatalf("ReadMessage() = %v", err)
+	}
+
+	if strings.Contains(out, "example") || strings.Contains(out, "Bob") {
+		t.Errorf("addresses not redacted:\n%v", out)
+	}
+	from, _ := m.Header.AddressList("From")
+	to, _ := m.Header.AddressList("To")
+	if len(from) != 1 || len(to) != 2 {
+		t.Fatalf("From = %v, To = %v", from, to)
+	}
+	sender, _, _ := mbox.ParseFromLine(r.FromLine())
+	if sender != from[0].Address {
+		t.Errorf("envelope sender %q != From %q", sender, from[0].Address)
+	}
+	domain := func(addr string) string {
+		return addr[strings.IndexByte(addr, '@'):]
+	}
+	if from[0].Address == to[0].Address || domain(from[0].Address) != domain(to[0].Address) {
+		t.Errorf("From = %v, To = %v: want different addresses in the same domain", from[0], to[0])
+	}
+	if domain(to[0].Address) == domain(to[1].Address) {
+		t.Errorf("To = %v: want different domains", to)
+	}
+}
+
+func TestRemoveAttachments(t *testing.T) {
+	in := "From alice@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Content-Type: multipart/mixed; boundary=outer\n" +
+		"\n" +
+		"Preamble.\n" +
+		"--outer\n" +
+		"Content-Type: multipart/alternative;\n" +
+		" boundary=\"inner\"\n" +
+		"\n" +
+		"--inner\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello.\n" +
+		"--inner\n" +
+		"Content-Type: image/png; name=\"=?UTF-8?Q?caf=C3=A9.png?=\"\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"Content-ID: <logo>\n" +
+		"\n" +
+		"iVBORw0KGgo=\n" +
+		"--inner--\n" +
+		"--outer\n" +
+		"Content-Type: application/pdf\n" +
+		"Content-Disposition: attachment;\n" +
+		"\tfilename=\"report.pdf\"\n" +
+		"\n" +
+		"JVBERi0=\n" +
+		"--outer--\n" +
+		"Epilogue.\n" +
+		"\n" +
+		"From bob@example.com Thu Jan  1 00:00:02 2015\n" +
+		"Content-Type: text/plain\n" +
+		"Content-Disposition: attachment; filename=notes.txt\n" +
+		"\n" +
+		"Notes.\n" +
+		"\n"
+
+	want := "From alice@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Content-Type: multipart/mixed; boundary=outer\n" +
+		"\n" +
+		"Preamble.\n" +
+		"--outer\n" +
+		"Content-Type: multipart/alternative;\n" +
+		" boundary=\"inner\"\n" +
+		"\n" +
+		"--inner\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello.\n" +
+		"--inner\n" +
+		"Content-Type: text/plain; charset=utf-8\n" +
+		"Content-Transfer-Encoding: 8bit\n" +
+		"\n" +
+		"Attachment removed: café.png (image/png)\n" +
+		"--inner--\n" +
+		"--outer\n" +
+		"Content-Type: text/plain; charset=utf-8\n" +
+		"\n" +
+		"Attachment removed: report.pdf (application/pdf)\n" +
+		"--outer--\n" +
+		"Epilogue.\n" +
+		"\n" +
+		"From bob@example.com Thu Jan  1 00:00:02 2015\n" +
+		"Content-Type: text/plain; charset=utf-8\n" +
+		"\n" +
+		"Attachment removed: notes.txt (text/plain)\n" +
+		"\n"
+
+	if out := applyString(t, in, RemoveAttachments()); out != want {
+		t.Errorf("Apply() = \n%v\nwant:\n%v", out, want)
+	}
+}
@@ -0,0 +1,504 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-mbox/internal/msgutil"
+)
+
+// FindingKind is the kind of a problem found by Validate.
+type FindingKind int
+
+const (
+	// FindingUnescapedFrom is a line starting with "From " in a message body
+	// which doesn't look like a From line.
+	FindingUnescapedFrom FindingKind = iota + 1
+	// FindingBadFromLine is a From line which can't be parsed, e.g. because
+	// its date is invalid.
+	FindingBadFromLine
+	// FindingMissingBlankLine is a From line which isn't preceded by a blank
+	// line.
+	FindingMissingBlankLine
+	// FindingMixedLineEndings is a message mixing CRLF and LF line endings.
+	FindingMixedLineEndings
+	// FindingTruncated is a message cut short by the end of the file.
+	FindingTruncated
+	// FindingNoHeader is a message without a header.
+	FindingNoHeader
+	// FindingDuplicateMessageID is a message with the same Message-ID as a
+	// previous one.
+	FindingDuplicateMessageID
+	// FindingGarbage is data outside of any message.
+	FindingGarbage
+)
+
+// String implements fmt.Stringer.
+func (k FindingKind) String() string {
+	switch k {
+	case FindingUnescapedFrom:
+		return "unescaped-from"
+	case FindingBadFromLine:
+		return "bad-from-line"
+	case FindingMissingBlankLine:
+		return "missing-blank-line"
+	case FindingMixedLineEndings:
+		return "mixed-line-endings"
+	case FindingTruncated:
+		return "truncated"
+	case FindingNoHeader:
+		return "no-header"
+	case FindingDuplicateMessageID:
+		return "duplicate-message-id"
+	case FindingGarbage:
+		return "garbage"
+	default:
+		return "unknown"
+	}
+}
+
+// maxFindingText is the maximum length of Finding.Text.
+const maxFindingText = 80
+
+// Finding is a problem found by Validate.
+type Finding struct {
+	Kind FindingKind
+	// Offset is the offset in the mbox stream of the offending line.
+	Offset int64
+	// Message is the index of the message containing the problem, or -1 if
+	// it's outside of any message.
+	Message int
+	// Text is the offending line or Message-ID, possibly shortened.
+	Text string
+}
+
+// String implements fmt.Stringer.
+func (f *Finding) String() string {
+	return fmt.Sprintf("offset %v: message %v: %v: %q", f.Offset, f.Message, f.Kind, f.Text)
+}
+
+// Report is the result of Validate.
+type Report struct {
+	// Messages is the number of messages found.
+	Messages int
+	Findings []Finding
+}
+
+// OK returns true if no problem was found.
+func (rep *Report) OK() bool {
+	return len(rep.Findings) == 0
+}
+
+// Validate checks mbox data read from r for common problems. format is the
+// mbox variant of the data: FormatMessage isn't supported.
+//
+// Messages are split as Reader does. A line starting with "From " which
+// doesn't look like a From line is reported as an unescaped From line: it
+// starts a new message when read with Reader, but is considered as part of
+// the previous message here.
+//
+// An error is only returned if reading fails: problems are listed in the
+// report.
+func Validate(r io.Reader, format Format) (*Report, error) {
+	v := newValidator(r, format)
+	return v.rep, v.run()
+}
+
+// Repair is like Validate, but also writes a repaired copy of the messages to
+// w. From lines which can't be parsed are replaced with ones derived from the
+// message header, unescaped From lines are escaped, missing blank lines are
+// added and line endings are normalized.
+func Repair(w *Writer, r io.Reader, format Format) (*Report, error) {
+	v := newValidator(r, format)
+	v.w = w
+	return v.rep, v.run()
+}
+
+// maxHeaderSize is the size after which a message header is processed even if
+// it isn't complete, so that it isn't buffered indefinitely.
+const maxHeaderSize = 1 << 20
+
+type validator struct {
+	format Format
+	r      *Reader
+	br     *bufio.Reader
+	w      *Writer
+	rep    *Report
+	msgIDs map[string]int
+
+	msg       int
+	open      bool
+	inGarbage bool
+
+	// Only valid if open is true
+	msgOffset  int64
+	fromLine   string
+	delimited  bool // The end of the message is given by Content-Length
+	inHeader   bool
+	hdr        []byte
+	hdrWritten bool
+	eol        string
+	mixed      bool
+	truncated  bool
+	mw         io.WriteCloser
+}
+
+func newValidator(r io.Reader, format Format) *validator {
+	mr := NewReader(r)
+	mr.Format = format
+	mr.raw = true
+	return &validator{
+		format: format,
+		r:      mr,
+		br:     bufio.NewReader(nil),
+		rep:    new(Report),
+		msgIDs: make(map[string]int),
+		msg:    -1,
+	}
+}
+
+func (v *validator) report(kind FindingKind, offset int64, text []byte) {
+	if len(text) > maxFindingText {
+		text = text[:maxFindingText]
+	}
+	msg := -1
+	if v.open {
+		msg = v.msg
+	}
+	v.rep.Findings = append(v.rep.Findings, Finding{
+		Kind:    kind,
+		Offset:  offset,
+		Message: msg,
+		Text:    string(text),
+	})
+}
+
+func splitEOL(line []byte) ([]byte, string) {
+	if bytes.HasSuffix(line, []byte("\r\n")) {
+		return line[:len(line)-2], "\r\n"
+	} else if bytes.HasSuffix(line, []byte("\n")) {
+		return line[:len(line)-1], "\n"
+	}
+	return line, ""
+}
+
+func (v *validator) run() error {
+	if v.format == FormatMessage {
+		return errors.New("mbox: Validate doesn't support FormatMessage")
+	}
+
+	for !v.truncated {
+		msg, err := v.r.NextMessage()
+		if err == io.EOF {
+			break
+		} else if err == ErrInvalidFormat {
+			// Reader skips one line at a time
+			if err := v.endMessage(); err != nil {
+				return err
+			}
+			if !v.inGarbage {
+				v.report(FindingGarbage, v.r.invalidOffset, v.r.invalidLine)
+				v.inGarbage = true
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		v.inGarbage = false
+
+		if err := v.separator(); err != nil {
+			return err
+		}
+		if err := v.readMessage(msg); err != nil {
+			return err
+		}
+	}
+
+	return v.endMessage()
+}
+
+// separator handles the From line of a message returned by Reader. A line
+// which doesn't look like a From line continues the previous message.
+func (v *validator) separator() error {
+	fromLine := v.r.FromLine()
+	offset := v.r.Offset()
+	var kind FindingKind
+	if v.format == FormatMMDF {
+		if fromLine != "" {
+			if _, _, err := ParseFromLine(fromLine); err != nil {
+				kind = FindingBadFromLine
+			}
+		}
+	} else if _, _, err := ParseFromLine(fromLine); err == nil {
+		if v.open && !v.delimited && !v.r.sepBlank {
+			kind = FindingMissingBlankLine
+		}
+	} else if v.open && !v.delimited && !looksLikeFromLine([]byte(fromLine)) {
+		v.report(FindingUnescapedFrom, offset, []byte(fromLine))
+		// The blank line preceding the From line and the From line itself
+		// were consumed by Reader
+		if v.r.sepBlank {
+			if err := v.line(offset, nil, false, false); err != nil {
+				return err
+			}
+		}
+		return v.line(offset, []byte(fromLine), false, false)
+	} else {
+		kind = FindingBadFromLine
+	}
+
+	if err := v.endMessage(); err != nil {
+		return err
+	}
+	v.startMessage(offset, fromLine)
+	if kind != 0 {
+		v.report(kind, offset, []byte(fromLine))
+	}
+	return nil
+}
+
+// looksLikeFromLine checks whether a line starting with "From " which can't
+// be parsed contains a time, as From lines do.
+func looksLikeFromLine(b []byte) bool {
+	fields := strings.Fields(string(b[len(header):]))
+	if len(fields) < 2 {
+		return false
+	}
+	for _, f := range fields[1:] {
+		if _, err := time.Parse("15:04:05", f); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *validator) startMessage(offset int64, fromLine string) {
+	_, delimited := v.r.cur.(*clMessageReader)
+
+	v.msg++
+	v.msgOffset = offset
+	v.rep.Messages++
+	v.open = true
+	v.fromLine = fromLine
+	v.delimited = delimited
+	v.inHeader = true
+	v.hdr = nil
+	v.hdrWritten = false
+	v.eol = ""
+	v.mixed = false
+	v.truncated = false
+	v.mw = nil
+}
+
+// readMessage reads the text of a message returned by Reader, line by line.
+// Long lines are processed in several parts, so that they aren't buffered
+// entirely.
+func (v *validator) readMessage(msg io.Reader) error {
+	v.br.Reset(msg)
+	offset := v.r.contentOffset
+	cont := false
+	for {
+		l, err := v.br.ReadSlice('\n')
+		more := err == bufio.ErrBufferFull
+		if more {
+			err = nil
+			// Keep a trailing CR along with the LF which may follow it
+			if len(l) > 1 && l[len(l)-1] == '\r' {
+				l = l[:len(l)-1]
+				v.br.UnreadByte()
+			}
+		}
+
+		if len(l) > 0 {
+			b, eol := l, ""
+			if !more {
+				b, eol = splitEOL(l)
+			}
+			if eol != "" {
+				if v.eol == "" {
+					v.eol = eol
+				} else if eol != v.eol && !v.mixed {
+					v.report(FindingMixedLineEndings, offset, b)
+					v.mixed = true
+				}
+			} else if !more && !v.delimited {
+				v.reportTruncated(offset, b)
+			}
+			if lineErr := v.line(offset, b, cont, more); lineErr != nil {
+				return lineErr
+			}
+			offset += int64(len(l))
+		}
+		cont = more
+
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			// Missing MMDF delimiter or short body for Content-Length
+			v.reportTruncated(offset, nil)
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (v *validator) reportTruncated(offset int64, text []byte) {
+	if !v.truncated {
+		v.report(FindingTruncated, offset, text)
+		v.truncated = true
+	}
+}
+
+// line processes a line of a message, without its line ending. cont is true
+// if b continues a long line, and more is true if the line continues after b.
+func (v *validator) line(offset int64, b []byte, cont, more bool) error {
+	if v.inHeader {
+		return v.headerLine(offset, b, cont, more)
+	}
+	return v.bodyLine(b, cont, more)
+}
+
+func (v *validator) headerLine(offset int64, b []byte, cont, more bool) error {
+	if !cont && !v.hdrWritten && len(v.hdr) == 0 && (len(b) == 0 || !isHeaderLine(b)) {
+		v.report(FindingNoHeader, offset, b)
+		v.inHeader = false
+		if err := v.createMessage(nil); err != nil {
+			return err
+		}
+		return v.bodyLine(b, cont, more)
+	}
+
+	if !cont && len(b) == 0 && !more {
+		v.inHeader = false
+		return v.endHeader()
+	}
+
+	if v.hdrWritten {
+		return v.write(b, more)
+	}
+	v.hdr = append(v.hdr, b...)
+	if !more {
+		v.hdr = append(v.hdr, '\n')
+	}
+	if len(v.hdr) > maxHeaderSize {
+		return v.writeHeader()
+	}
+	return nil
+}
+
+// writeHeader checks the Message-ID of the message and starts writing the
+// repaired message, if any, with the header read so far.
+func (v *validator) writeHeader() error {
+	if v.hdrWritten {
+		return nil
+	}
+	v.hdrWritten = true
+
+	h := mail.Header{}
+	if msg, err := mail.ReadMessage(bytes.NewReader(append(v.hdr, '\n'))); err == nil {
+		h = msg.Header
+	}
+
+	if id := strings.TrimSpace(h.Get("Message-Id")); id != "" {
+		if _, ok := v.msgIDs[id]; ok {
+			v.report(FindingDuplicateMessageID, v.msgOffset, []byte(id))
+		} else {
+			v.msgIDs[id] = v.msg
+		}
+	}
+
+	if err := v.createMessage(h); err != nil {
+		return err
+	}
+	hdr := v.hdr
+	v.hdr = nil
+	if v.mw == nil {
+		return nil
+	}
+	if v.format == FormatMboxcl2 {
+		hdr = msgutil.StripFields(hdr, "Content-Length")
+	}
+	_, err := v.mw.Write(hdr)
+	return err
+}
+
+// endHeader writes the header and the blank line ending it.
+func (v *validator) endHeader() error {
+	if err := v.writeHeader(); err != nil {
+		return err
+	}
+	return v.write(nil, false)
+}
+
+// createMessage starts writing the repaired message. h is used to derive the
+// envelope if the From line can't be parsed.
+func (v *validator) createMessage(h mail.Header) error {
+	if v.w == nil {
+		return nil
+	}
+	from, date, err := ParseFromLine(v.fromLine)
+	if err != nil || v.fromLine == "" {
+		from, date = envelopeSender(h), envelopeDate(h)
+	}
+	v.mw, err = v.w.CreateMessage(from, date)
+	return err
+}
+
+func (v *validator) bodyLine(b []byte, cont, more bool) error {
+	if v.mw == nil {
+		return nil
+	}
+	if !cont {
+		switch v.format {
+		case FormatMboxo:
+			if isEscapedHeader(b, false) {
+				b = b[1:]
+			}
+		case FormatMboxrd:
+			if isEscapedHeader(b, true) {
+				b = b[1:]
+			}
+		}
+	}
+	return v.write(b, more)
+}
+
+// write writes a line of the repaired message, if any, normalizing its line
+// ending.
+func (v *validator) write(b []byte, more bool) error {
+	if v.mw == nil {
+		return nil
+	}
+	if _, err := v.mw.Write(b); err != nil {
+		return err
+	}
+	if more {
+		return nil
+	}
+	_, err := v.mw.Write([]byte{'\n'})
+	return err
+}
+
+func (v *validator) endMessage() error {
+	if !v.open {
+		return nil
+	}
+	if v.inHeader {
+		v.inHeader = false
+		if err := v.endHeader(); err != nil {
+			return err
+		}
+	}
+	v.open = false
+	if v.mw != nil {
+		return v.mw.Close()
+	}
+	return nil
+}
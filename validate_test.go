@@ -0,0 +1,223 @@
+package mbox
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	validFrom1 = "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n"
+	validFrom2 = "From derp.herp@example.com Fri Jan  2 00:00:01 2015\n"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		mbox   string
+		want   []FindingKind
+		count  int
+	}{
+		{
+			name:  "valid",
+			mbox:  validFrom1 + "Subject: 1\n\nHi.\n\n" + validFrom2 + "Subject: 2\n\nBye.\n",
+			count: 2,
+		},
+		{
+			name:  "unescaped-from",
+			mbox:  validFrom1 + "Subject: 1\n\nHi.\n\nFrom the top, hi.\n",
+			want:  []FindingKind{FindingUnescapedFrom},
+			count: 1,
+		},
+		{
+			name:  "bad-from-line",
+			mbox:  "From herp.derp@example.com Thu Foo  1 00:00:01 2015\nSubject: 1\n\nHi.\n",
+			want:  []FindingKind{FindingBadFromLine},
+			count: 1,
+		},
+		{
+			name:  "missing-blank-line",
+			mbox:  validFrom1 + "Subject: 1\n\nHi.\n" + validFrom2 + "Subject: 2\n\nBye.\n",
+			want:  []FindingKind{FindingMissingBlankLine},
+			count: 2,
+		},
+		{
+			name:  "mixed-line-endings",
+			mbox:  validFrom1 + "Subject: 1\r\n\r\nHi.\nBye.\r\n",
+			want:  []FindingKind{FindingMixedLineEndings},
+			count: 1,
+		},
+		{
+			name:  "truncated",
+			mbox:  validFrom1 + "Subject: 1\n\nHi.",
+			want:  []FindingKind{FindingTruncated},
+			count: 1,
+		},
+		{
+			name:  "no-header",
+			mbox:  validFrom1 + "Hi.\n",
+			want:  []FindingKind{FindingNoHeader},
+			count: 1,
+		},
+		{
+			name: "duplicate-message-id",
+			mbox: validFrom1 + "Message-ID: <1@example.com>\n\nHi.\n\n" +
+				validFrom2 + "Message-ID: <1@example.com>\n\nHi.\n",
+			want:  []FindingKind{FindingDuplicateMessageID},
+			count: 2,
+		},
+		{
+			name:  "garbage",
+			mbox:  "Hi.\n\n" + validFrom1 + "Subject: 1\n\nHi.\n",
+			want:  []FindingKind{FindingGarbage},
+			count: 1,
+		},
+		{
+			name:   "mboxcl2",
+			format: FormatMboxcl2,
+			mbox:   validFrom1 + "Content-Length: 12\n\nFrom here.\n\n" + validFrom2 + "Subject: 2\n\nBye.\n",
+			count:  2,
+		},
+		{
+			name:   "mboxcl2-truncated",
+			format: FormatMboxcl2,
+			mbox:   validFrom1 + "Content-Length: 42\n\nHi.\n",
+			want:   []FindingKind{FindingTruncated},
+			count:  1,
+		},
+		{
+			name:   "mmdf",
+			format: FormatMMDF,
+			mbox:   "\x01\x01\x01\x01\nSubject: 1\n\nFrom here.\n\x01\x01\x01\x01\n",
+			count:  1,
+		},
+		{
+			name:   "mmdf-truncated",
+			format: FormatMMDF,
+			mbox:   "\x01\x01\x01\x01\nSubject: 1\n\nHi.\n",
+			want:   []FindingKind{FindingTruncated},
+			count:  1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rep, err := Validate(strings.NewReader(test.mbox), test.format)
+			if err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			var kinds []FindingKind
+			for _, f := range rep.Findings {
+				kinds = append(kinds, f.Kind)
+			}
+			if !reflect.DeepEqual(kinds, test.want) {
+				t.Errorf("Validate() findings = %v, want %v", rep.Findings, test.want)
+			}
+			if rep.Messages != test.count {
+				t.Errorf("Validate() messages = %v, want %v", rep.Messages, test.count)
+			}
+		})
+	}
+}
+
+func TestValidate_offsets(t *testing.T) {
+	s := validFrom1 + "Subject: 1\n\nHi.\n" + validFrom2 + "Subject: 2\n\nBye.\n"
+	rep, err := Validate(strings.NewReader(s), FormatMboxo)
+	if err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	want := []Finding{{
+		Kind:    FindingMissingBlankLine,
+		Offset:  int64(strings.Index(s, validFrom2)),
+		Message: 1,
+		Text:    strings.TrimSuffix(validFrom2, "\n"),
+	}}
+	if !reflect.DeepEqual(rep.Findings, want) {
+		t.Errorf("Validate() findings = %v, want %v", rep.Findings, want)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	in := validFrom1 + "Subject: 1\r\n\r\nHi.\n\nFrom the top, hi.\n" +
+		validFrom2 + "Subject: 2\n\nBye.\n\n" +
+		"From foo Thu Foo  1 00:00:01 2015\n" +
+		"From: Foo <foo@example.com>\nDate: Sat, 3 Jan 2015 00:00:01 +0000\n\nYo."
+	want := validFrom1 + "Subject: 1\n\nHi.\n\n>From the top, hi.\n\n" +
+		validFrom2 + "Subject: 2\n\nBye.\n\n" +
+		"From foo@example.com Sat Jan  3 00:00:01 2015\n" +
+		"From: Foo <foo@example.com>\nDate: Sat, 3 Jan 2015 00:00:01 +0000\n\nYo.\n\n"
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	rep, err := Repair(w, strings.NewReader(in), FormatMboxo)
+	if err != nil {
+		t.Fatalf("Repair() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if rep.OK() {
+		t.Errorf("Repair() didn't report any problem")
+	}
+	if buf.String() != want {
+		t.Errorf("Repair() wrote:\n%q\nwant:\n%q", buf.String(), want)
+	}
+
+	rep, err = Validate(&buf, FormatMboxo)
+	if err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	if !rep.OK() {
+		t.Errorf("Validate() on repaired copy = %v", rep.Findings)
+	}
+}
+
+func TestRepair_longLines(t *testing.T) {
+	// The CR of the second line falls at the end of the line buffer
+	long1 := strings.Repeat("a", 10000)
+	long2 := strings.Repeat("b", 4095)
+	in := strings.Replace(validFrom1, "\n", "\r\n", 1) +
+		"Subject: 1\r\n\r\n" + long1 + "\r\n" + long2 + "\r\n>From " + long1 + "\r\n\r\n" +
+		validFrom2 + "Subject: 2\r\n\r\nBye.\r\n"
+	want := validFrom1 + "Subject: 1\n\n" + long1 + "\n" + long2 + "\n>From " + long1 + "\n\n" +
+		validFrom2 + "Subject: 2\n\nBye.\n\n"
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	rep, err := Repair(w, strings.NewReader(in), FormatMboxo)
+	if err != nil {
+		t.Fatalf("Repair() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if !rep.OK() || rep.Messages != 2 {
+		t.Errorf("Repair() = %v messages, findings %v", rep.Messages, rep.Findings)
+	}
+	if buf.String() != want {
+		t.Errorf("Repair() wrote %v bytes, want %v", buf.Len(), len(want))
+	}
+}
+
+func TestValidate_sameMessagesAsReader(t *testing.T) {
+	// A From line with an invalid date starts a new message, as with Reader
+	s := validFrom1 + "Subject: 1\n\nHi.\n\n" +
+		"From herp.derp@example.com Thu Foo  1 00:00:01 2015\nSubject: 2\n\nBye.\n"
+	rep, err := Validate(strings.NewReader(s), FormatMboxo)
+	if err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+
+	r := NewReader(strings.NewReader(s))
+	n := 0
+	for {
+		if _, err := r.NextMessage(); err != nil {
+			break
+		}
+		n++
+	}
+	if rep.Messages != n {
+		t.Errorf("Validate() found %v messages, Reader %v", rep.Messages, n)
+	}
+}
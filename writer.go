@@ -1,19 +1,46 @@
 package mbox
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"net/mail"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/emersion/go-mbox/internal/msgutil"
+	"github.com/emersion/go-mbox/internal/spool"
 )
 
 type messageWriter struct {
-	w   io.Writer
-	buf bytes.Buffer
+	w      io.Writer
+	buf    bytes.Buffer
+	closed bool
+	format Format
+}
+
+func (mw *messageWriter) needsEscape(l []byte) bool {
+	switch mw.format {
+	case FormatMMDF:
+		return false
+	case FormatMboxrd:
+		return bytes.HasPrefix(bytes.TrimLeft(l, ">"), header)
+	default:
+		return bytes.HasPrefix(l, header)
+	}
 }
 
 func (mw *messageWriter) writeLine(l []byte) (int, error) {
-	if bytes.HasPrefix(l, header) {
+	// MMDF lines can't be escaped: a line equal to the delimiter would end the
+	// message early when read back
+	if mw.format == FormatMMDF && bytes.Equal(bytes.TrimSuffix(l, []byte("\n")), mmdfDelimiter) {
+		return 0, errors.New("mbox: message line equal to the MMDF delimiter")
+	}
+
+	if mw.needsEscape(l) {
 		if _, err := mw.w.Write([]byte{'>'}); err != nil {
 			return 0, err
 		}
@@ -23,6 +50,10 @@ func (mw *messageWriter) writeLine(l []byte) (int, error) {
 }
 
 func (mw *messageWriter) Write(p []byte) (int, error) {
+	if mw.closed {
+		return 0, errors.New("mbox: write to closed message")
+	}
+
 	// We will return the number of bytes *from p* that were written. Since
 	// we'll scan all the bytes already in the buffer before the write and
 	// those in p, we need to remember the initial buffer length.
@@ -71,23 +102,121 @@ func (mw *messageWriter) Write(p []byte) (int, error) {
 	return N, err
 }
 
+// Close finishes the message: it flushes the last partial line, if any, and
+// writes a blank line separating the message from the next one. A newline is
+// added to the last line of the message if it doesn't end with one, so
+// messages ending with a newline aren't followed by an extra blank line.
 func (mw *messageWriter) Close() error {
+	if mw.closed {
+		return nil
+	}
+	mw.closed = true
+
 	b := mw.buf.Bytes()
 	mw.buf.Reset()
-	if _, err := mw.writeLine(b); err != nil {
+	if len(b) > 0 {
+		// The message doesn't end with a newline
+		if _, err := mw.writeLine(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+
+	trailer := []byte("\n")
+	if mw.format == FormatMMDF {
+		trailer = append(mmdfDelimiter[:len(mmdfDelimiter):len(mmdfDelimiter)], '\n')
+	}
+	_, err := mw.w.Write(trailer)
+	return err
+}
+
+// clMessageWriter writes a message with a Content-Length header field. The
+// message is spooled until closed.
+type clMessageWriter struct {
+	w      io.Writer
+	spool  spool.Spool
+	closed bool
+}
+
+func (mw *clMessageWriter) Write(p []byte) (int, error) {
+	if mw.closed {
+		return 0, errors.New("mbox: write to closed message")
+	}
+	return mw.spool.Write(p)
+}
+
+// Close writes the spooled message, with a Content-Length header field
+// inserted at the end of its header.
+func (mw *clMessageWriter) Close() error {
+	if mw.closed {
+		return nil
+	}
+	mw.closed = true
+	defer mw.spool.Close()
+
+	r, err := mw.spool.Reader()
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	hdr, err := msgutil.ReadHeader(br)
+	if err != nil {
+		return err
+	}
+	bodyLen := mw.spool.Size() - int64(len(hdr))
+
+	fields, blank := msgutil.SplitHeader(hdr)
+	if blank == nil {
+		blank = []byte("\n")
+	}
+	fields = msgutil.StripFields(fields, "Content-Length")
+
+	var b bytes.Buffer
+	b.Write(fields)
+	fmt.Fprintf(&b, "Content-Length: %d", bodyLen)
+	b.Write(blank)
+	b.Write(blank)
+	if _, err := b.WriteTo(mw.w); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(mw.w, br); err != nil {
 		return err
 	}
 
-	_, err := mw.w.Write([]byte("\n\n"))
+	_, err = mw.w.Write([]byte("\n"))
 	return err
 }
 
+// defaultMaxMemory is the default number of bytes a message is buffered in
+// memory before being spilled to a temporary file.
+const defaultMaxMemory = 10 << 20
+
 // Writer writes messages to a mbox stream. The Close method must be called to
 // end the stream.
 type Writer struct {
+	// Format is the mbox format variant to write. It must be set before the
+	// first call to CreateMessage. Defaults to FormatMboxo.
+	//
+	// With FormatMboxcl2, messages are written as is, without line ending
+	// conversion nor escaping, and a Content-Length header field is added.
+	// Since the header precedes the body, messages are buffered until closed.
+	//
+	// With FormatMMDF, messages are enclosed in MMDF delimiters and a From
+	// line is written after the opening delimiter, as mutt does. Since lines
+	// aren't escaped, writing a message line equal to the delimiter fails.
+	//
+	// FormatMessage isn't supported.
+	Format Format
+	// MaxMemory is the number of bytes of a message buffered in memory before
+	// it is spilled to a temporary file. Zero means a default of 10 MiB.
+	MaxMemory int64
+
 	w      io.Writer
-	last   *messageWriter
+	last   io.WriteCloser
 	closed bool
+
+	// beforeMessage, if set, is called before a message is started
+	beforeMessage func() error
 }
 
 // NewWriter creates a new Writer that writes messages to w.
@@ -97,36 +226,74 @@ func NewWriter(w io.Writer) *Writer {
 
 // CreateMessage appends a message to the mbox stream. The message text
 // (including both the header and the body) should be written to the returned
-// io.Writer.
-func (w *Writer) CreateMessage(from string, t time.Time) (io.Writer, error) {
+// io.WriteCloser. Closing it finishes the message; if it hasn't been closed
+// yet, it is closed by the next call to CreateMessage or by Close.
+func (w *Writer) CreateMessage(from string, t time.Time) (io.WriteCloser, error) {
+	if from == "" {
+		from = "???@???"
+	}
+
+	if t.IsZero() {
+		t = time.Now()
+	}
+	date := t.UTC().Format(time.ANSIC)
+
+	return w.createMessage("From " + from + " " + date)
+}
+
+// CreateMessageFromLine is like CreateMessage, but writes line as is as the
+// From line of the message, e.g. to preserve the From line returned by
+// Reader.FromLine. line must start with "From " and must not contain line
+// breaks.
+func (w *Writer) CreateMessageFromLine(line string) (io.WriteCloser, error) {
+	if !strings.HasPrefix(line, string(header)) || strings.ContainsAny(line, "\r\n") {
+		return nil, errors.New("mbox: invalid From line")
+	}
+	return w.createMessage(line)
+}
+
+func (w *Writer) createMessage(line string) (io.WriteCloser, error) {
 	if w.closed {
 		return nil, errors.New("mbox: Writer.CreateMessage called after Close")
 	}
+	if w.Format == FormatMessage {
+		return nil, errors.New("mbox: Writer doesn't support FormatMessage")
+	}
 	if w.last != nil {
 		if err := w.last.Close(); err != nil {
 			return nil, err
 		}
 		w.last = nil
 	}
-
-	if from == "" {
-		from = "???@???"
+	if w.beforeMessage != nil {
+		if err := w.beforeMessage(); err != nil {
+			return nil, err
+		}
 	}
 
-	if t.IsZero() {
-		t = time.Now()
+	line += "\n"
+	if w.Format == FormatMMDF {
+		line = string(mmdfDelimiter) + "\n" + line
 	}
-	date := t.UTC().Format(time.ANSIC)
-
-	line := "From " + from + " " + date + "\n"
 	if _, err := io.WriteString(w.w, line); err != nil {
 		return nil, err
 	}
 
-	w.last = &messageWriter{w: w.w}
+	switch w.Format {
+	case FormatMboxcl2:
+		maxMemory := w.MaxMemory
+		if maxMemory == 0 {
+			maxMemory = defaultMaxMemory
+		}
+		w.last = &clMessageWriter{w: w.w, spool: spool.Spool{Max: maxMemory}}
+	default:
+		w.last = &messageWriter{w: w.w, format: w.Format}
+	}
 	return w.last, nil
 }
 
+// Close finishes the last message, if any, and ends the stream. It doesn't
+// close the underlying io.Writer.
 func (w *Writer) Close() error {
 	if w.closed {
 		return errors.New("mbox: Writer already closed")
@@ -137,3 +304,88 @@ func (w *Writer) Close() error {
 	}
 	return nil
 }
+
+// WriteMessage appends a message read from r to the mbox stream. r must
+// contain the whole message text (including both the header and the body).
+//
+// If from is empty or t is zero, they are derived from the message header: the
+// envelope sender from the Return-Path, Sender or From fields and the date from
+// the topmost Received field or the Date field.
+func (w *Writer) WriteMessage(from string, t time.Time, r io.Reader) error {
+	var hdr []byte
+	if from == "" || t.IsZero() {
+		br := bufio.NewReader(r)
+		var err error
+		hdr, err = msgutil.ReadHeader(br)
+		if err != nil {
+			return err
+		}
+		r = br
+
+		if msg, err := mail.ReadMessage(bytes.NewReader(hdr)); err == nil {
+			if from == "" {
+				from = envelopeSender(msg.Header)
+			}
+			if t.IsZero() {
+				t = envelopeDate(msg.Header)
+			}
+		}
+	}
+
+	mw, err := w.CreateMessage(from, t)
+	if err != nil {
+		return err
+	}
+	if _, err := mw.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(mw, r); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// WriteMailMessage appends msg to the mbox stream. The envelope sender and date
+// are derived from the message header as in WriteMessage.
+//
+// mail.Header is a map and doesn't retain the original order of the header
+// fields, so they're written sorted by key to make the output deterministic.
+// The values of a field keep their relative order. Use WriteMessage to write a
+// raw header as is.
+func (w *Writer) WriteMailMessage(from string, t time.Time, msg *mail.Message) error {
+	if from == "" {
+		from = envelopeSender(msg.Header)
+	}
+	if t.IsZero() {
+		t = envelopeDate(msg.Header)
+	}
+
+	mw, err := w.CreateMessage(from, t)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(msg.Header))
+	for k := range msg.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		for _, v := range msg.Header[k] {
+			b.WriteString(k + ": " + v + "\n")
+		}
+	}
+	b.WriteString("\n")
+	if _, err := mw.Write(b.Bytes()); err != nil {
+		return err
+	}
+
+	if msg.Body != nil {
+		if _, err := io.Copy(mw, msg.Body); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
@@ -3,9 +3,13 @@ package mbox
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"net/mail"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/emersion/go-mbox/internal/msgutil"
 )
 
 type testMessage struct {
@@ -127,3 +131,393 @@ func TestWriter_crlfCount(t *testing.T) {
 		t.Errorf("Write() = %v, want %v", n, len(b))
 	}
 }
+
+func TestWriter_closeMessage(t *testing.T) {
+	var b bytes.Buffer
+	wc := NewWriter(&b)
+
+	date := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+	mw, err := wc.CreateMessage("herp.derp@example.com", date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(mw, "Subject: Test\n\nNo trailing newline"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	expected := "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: Test\n\nNo trailing newline\n\n"
+	if s := b.String(); s != expected {
+		t.Errorf("Invalid mbox output:\n%q\nexpected:\n%q", s, expected)
+	}
+
+	if _, err := mw.Write([]byte("more")); err == nil {
+		t.Error("Write() after Close() succeeded")
+	}
+
+	if err := wc.Close(); err != nil {
+		t.Fatalf("Writer.Close() = %v", err)
+	}
+	if s := b.String(); s != expected {
+		t.Errorf("Writer.Close() wrote after closed message:\n%q", s)
+	}
+}
+
+func TestWriter_closeMessageTrailingNewline(t *testing.T) {
+	for _, text := range []string{"Subject: Test\n\nHi.", "Subject: Test\n\nHi.\n"} {
+		var b bytes.Buffer
+		wc := NewWriter(&b)
+
+		date := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+		mw, err := wc.CreateMessage("herp.derp@example.com", date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(mw, text); err != nil {
+			t.Fatal(err)
+		}
+		if err := wc.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+
+		expected := "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+			"Subject: Test\n\nHi.\n\n"
+		if s := b.String(); s != expected {
+			t.Errorf("Invalid mbox output for %q:\n%q\nexpected:\n%q", text, s, expected)
+		}
+	}
+}
+
+func TestWriter_CreateMessageFromLine(t *testing.T) {
+	var b bytes.Buffer
+	wc := NewWriter(&b)
+
+	const line = "From MAILER-DAEMON Fri Jan 13 09:30:00 2017 remote from example.org"
+	mw, err := wc.CreateMessageFromLine(line)
+	if err != nil {
+		t.Fatalf("CreateMessageFromLine() = %v", err)
+	}
+	if _, err := io.WriteString(mw, "Subject: Test\n\nHi.\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	expected := line + "\nSubject: Test\n\nHi.\n\n"
+	if s := b.String(); s != expected {
+		t.Errorf("Invalid mbox output:\n%q\nexpected:\n%q", s, expected)
+	}
+
+	for _, line := range []string{"", "MAILER-DAEMON Fri Jan 13 09:30:00 2017", "From a\nb"} {
+		if _, err := NewWriter(&b).CreateMessageFromLine(line); err == nil {
+			t.Errorf("CreateMessageFromLine(%q) = nil error", line)
+		}
+	}
+}
+
+func TestWriter_WriteMessage(t *testing.T) {
+	var b bytes.Buffer
+	wc := NewWriter(&b)
+
+	text := "Return-Path: <bounce@example.org>\n" +
+		"Received: from mx.example.org by mail.example.com; Fri, 2 Jan 2015 10:00:00 +0000\n" +
+		"From: Herp Derp <herp.derp@example.com>\n" +
+		"Date: Thu, 01 Jan 2015 00:00:01 +0100\n" +
+		"\n" +
+		"From the body.\n"
+	if err := wc.WriteMessage("", time.Time{}, strings.NewReader(text)); err != nil {
+		t.Fatalf("WriteMessage() = %v", err)
+	}
+
+	text = "From: Herp Derp <herp.derp@example.com>\n" +
+		"Date: Thu, 01 Jan 2015 00:00:01 +0100\n" +
+		"\n" +
+		"Hi.\n"
+	if err := wc.WriteMessage("", time.Time{}, strings.NewReader(text)); err != nil {
+		t.Fatalf("WriteMessage() = %v", err)
+	}
+
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "From bounce@example.org Fri Jan  2 10:00:00 2015\n" +
+		"Return-Path: <bounce@example.org>\n" +
+		"Received: from mx.example.org by mail.example.com; Fri, 2 Jan 2015 10:00:00 +0000\n" +
+		"From: Herp Derp <herp.derp@example.com>\n" +
+		"Date: Thu, 01 Jan 2015 00:00:01 +0100\n" +
+		"\n" +
+		">From the body.\n" +
+		"\n" +
+		"From herp.derp@example.com Wed Dec 31 23:00:01 2014\n" +
+		"From: Herp Derp <herp.derp@example.com>\n" +
+		"Date: Thu, 01 Jan 2015 00:00:01 +0100\n" +
+		"\n" +
+		"Hi.\n" +
+		"\n"
+	if s := b.String(); s != expected {
+		t.Errorf("Invalid mbox output:\n%q\nexpected:\n%q", s, expected)
+	}
+}
+
+func TestWriter_WriteMailMessage(t *testing.T) {
+	msg := &mail.Message{
+		Header: mail.Header{
+			"Subject":  {"Test"},
+			"From":     {"Herp Derp <herp.derp@example.com>"},
+			"Date":     {"Thu, 01 Jan 2015 00:00:01 +0100"},
+			"Received": {"from b by c; Thu, 01 Jan 2015 00:00:03 +0100", "from a by b; Thu, 01 Jan 2015 00:00:02 +0100"},
+		},
+		Body: strings.NewReader("Bye.\n"),
+	}
+
+	var b bytes.Buffer
+	wc := NewWriter(&b)
+	if err := wc.WriteMailMessage("", time.Time{}, msg); err != nil {
+		t.Fatalf("WriteMailMessage() = %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "From herp.derp@example.com Wed Dec 31 23:00:03 2014\n" +
+		"Date: Thu, 01 Jan 2015 00:00:01 +0100\n" +
+		"From: Herp Derp <herp.derp@example.com>\n" +
+		"Received: from b by c; Thu, 01 Jan 2015 00:00:03 +0100\n" +
+		"Received: from a by b; Thu, 01 Jan 2015 00:00:02 +0100\n" +
+		"Subject: Test\n" +
+		"\n" +
+		"Bye.\n" +
+		"\n"
+	if s := b.String(); s != expected {
+		t.Errorf("Invalid mbox output:\n%q\nexpected:\n%q", s, expected)
+	}
+}
+
+func TestWriter_mboxcl2(t *testing.T) {
+	messages := []string{
+		"From: herp.derp@example.com\n" +
+			"Content-Length: 42\n" +
+			"Subject: Test\n" +
+			"\n" +
+			"From lines are not escaped in mboxcl2.\n" +
+			"\n" +
+			"From herp.derp@example.com Thu Jan  1 00:00:01 2015\n",
+		"From: derp.herp@example.com\r\n" +
+			"Subject: Another test\r\n" +
+			"\r\n" +
+			"CRLF line endings are preserved.\r\n" +
+			"No trailing newline.",
+	}
+
+	for _, maxMemory := range []int64{0, 16} {
+		var b bytes.Buffer
+		wc := NewWriter(&b)
+		wc.Format = FormatMboxcl2
+		wc.MaxMemory = maxMemory
+
+		date := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+		for _, text := range messages {
+			if err := wc.WriteMessage("herp.derp@example.com", date, strings.NewReader(text)); err != nil {
+				t.Fatalf("WriteMessage() = %v", err)
+			}
+		}
+		if err := wc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+			"From: herp.derp@example.com\n" +
+			"Subject: Test\n" +
+			"Content-Length: 92\n" +
+			"\n" +
+			"From lines are not escaped in mboxcl2.\n" +
+			"\n" +
+			"From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+			"\n" +
+			"From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+			"From: derp.herp@example.com\r\n" +
+			"Subject: Another test\r\n" +
+			"Content-Length: 54\r\n" +
+			"\r\n" +
+			"CRLF line endings are preserved.\r\n" +
+			"No trailing newline.\n"
+		if s := b.String(); s != expected {
+			t.Fatalf("Invalid mbox output:\n%q\nexpected:\n%q", s, expected)
+		}
+
+		mr := NewReader(&b)
+		mr.Format = FormatMboxcl2
+		for i, text := range messages {
+			r, err := mr.NextMessage()
+			if err != nil {
+				t.Fatalf("NextMessage() = %v", err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll() = %v", err)
+			}
+
+			want := msgutil.StripFields([]byte(text), "Content-Length")
+			if i == 0 {
+				want = bytes.Replace(want, []byte("\n\n"), []byte("\nContent-Length: 92\n\n"), 1)
+			} else {
+				want = bytes.Replace(want, []byte("\r\n\r\n"), []byte("\r\nContent-Length: 54\r\n\r\n"), 1)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Message %v:\n%q\nexpected:\n%q", i, got, want)
+			}
+		}
+		if _, err := mr.NextMessage(); err != io.EOF {
+			t.Errorf("NextMessage() = %v, want io.EOF", err)
+		}
+	}
+}
+
+func TestWriter_mmdf(t *testing.T) {
+	var b bytes.Buffer
+	wc := NewWriter(&b)
+	wc.Format = FormatMMDF
+
+	date := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+	texts := []string{
+		"Subject: Test\n\nFrom is not escaped.\n",
+		"Subject: Another test\r\n\r\nNo trailing newline.",
+	}
+	for _, text := range texts {
+		if err := wc.WriteMessage("herp.derp@example.com", date, strings.NewReader(text)); err != nil {
+			t.Fatalf("WriteMessage() = %v", err)
+		}
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "\x01\x01\x01\x01\n" +
+		"From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: Test\n\nFrom is not escaped.\n" +
+		"\x01\x01\x01\x01\n" +
+		"\x01\x01\x01\x01\n" +
+		"From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: Another test\n\nNo trailing newline.\n" +
+		"\x01\x01\x01\x01\n"
+	if s := b.String(); s != expected {
+		t.Fatalf("Invalid MMDF output:\n%q\nexpected:\n%q", s, expected)
+	}
+
+	mr, err := NewAutoReader(&b)
+	if err != nil {
+		t.Fatalf("NewAutoReader() = %v", err)
+	}
+	if mr.Format != FormatMMDF {
+		t.Fatalf("Detected format %v, want %v", mr.Format, FormatMMDF)
+	}
+	for _, text := range texts {
+		r, err := mr.NextMessage()
+		if err != nil {
+			t.Fatalf("NextMessage() = %v", err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll() = %v", err)
+		}
+		want := toCRLF(strings.Replace(text, "\r\n", "\n", -1))
+		if !strings.HasSuffix(want, "\r\n") {
+			want += "\r\n"
+		}
+		if string(got) != want {
+			t.Errorf("Message:\n%q\nexpected:\n%q", got, want)
+		}
+		if l := mr.FromLine(); l != "From herp.derp@example.com Thu Jan  1 00:00:01 2015" {
+			t.Errorf("FromLine() = %q", l)
+		}
+	}
+	if _, err := mr.NextMessage(); err != io.EOF {
+		t.Errorf("NextMessage() = %v, want io.EOF", err)
+	}
+}
+
+func TestWriter_mmdfDelimiterLine(t *testing.T) {
+	date := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+
+	// Lines which only look like the delimiter are read back unchanged
+	text := "Subject: Test\n\n\x01\x01\x01\x01 and more\n\x01\x01\x01\n \x01\x01\x01\x01\n"
+	var b bytes.Buffer
+	wc := NewWriter(&b)
+	wc.Format = FormatMMDF
+	if err := wc.WriteMessage("herp.derp@example.com", date, strings.NewReader(text)); err != nil {
+		t.Fatalf("WriteMessage() = %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mr := NewReader(&b)
+	mr.Format = FormatMMDF
+	r, err := mr.NextMessage()
+	if err != nil {
+		t.Fatalf("NextMessage() = %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	if want := toCRLF(text); string(got) != want {
+		t.Errorf("Message:\n%q\nexpected:\n%q", got, want)
+	}
+	if _, err := mr.NextMessage(); err != io.EOF {
+		t.Errorf("NextMessage() = %v, want io.EOF", err)
+	}
+
+	// Lines equal to the delimiter are rejected
+	for _, text := range []string{
+		"Subject: Test\n\n\x01\x01\x01\x01\nFrom the next message?\n",
+		"Subject: Test\r\n\r\n\x01\x01\x01\x01\r\n",
+		"Subject: Test\n\n\x01\x01\x01\x01",
+	} {
+		wc := NewWriter(ioutil.Discard)
+		wc.Format = FormatMMDF
+		if err := wc.WriteMessage("herp.derp@example.com", date, strings.NewReader(text)); err == nil {
+			t.Errorf("WriteMessage(%q) = nil, want an error", text)
+		}
+	}
+}
+
+func TestWriter_mboxrd(t *testing.T) {
+	text := "Subject: Test\n\nFrom the start.\n>From a quoted message.\n>>From deeper.\n"
+
+	var b bytes.Buffer
+	wc := NewWriter(&b)
+	wc.Format = FormatMboxrd
+	date := time.Date(2015, time.January, 1, 0, 0, 1, 0, time.UTC)
+	if err := wc.WriteMessage("herp.derp@example.com", date, strings.NewReader(text)); err != nil {
+		t.Fatalf("WriteMessage() = %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "From herp.derp@example.com Thu Jan  1 00:00:01 2015\n" +
+		"Subject: Test\n\n>From the start.\n>>From a quoted message.\n>>>From deeper.\n\n"
+	if s := b.String(); s != expected {
+		t.Fatalf("Invalid mboxrd output:\n%q\nexpected:\n%q", s, expected)
+	}
+
+	mr := NewReader(&b)
+	mr.Format = FormatMboxrd
+	r, err := mr.NextMessage()
+	if err != nil {
+		t.Fatalf("NextMessage() = %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := toCRLF(text); string(got) != want {
+		t.Errorf("Message:\n%q\nexpected:\n%q", got, want)
+	}
+}